@@ -0,0 +1,306 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	ID_MODULE_ADMIN = "admin.api.valkey_storage"
+
+	ADMIN_ENDPOINT_BASE = "/valkey-storage/"
+
+	// Replaces the content of any private key PEM block when fetching values
+	REDACTED_PEM_CONTENT = "REDACTED"
+)
+
+// StorageValkeyAdmin serves read-only admin endpoints to inspect the active
+// valkey storage of the running config.
+type StorageValkeyAdmin struct {
+	storage *CaddyStorageValkey
+	logger  *zap.Logger
+}
+
+type adminKeyInfo struct {
+	Key        string    `json:"key"`
+	Modified   time.Time `json:"modified"`
+	Size       int64     `json:"size"`
+	IsTerminal bool      `json:"terminal"`
+}
+
+type adminHealth struct {
+	Topology string `json:"topology"`
+	Healthy  bool   `json:"healthy"`
+	Latency  string `json:"latency,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func init() {
+	caddy.RegisterModule(StorageValkeyAdmin{})
+}
+
+func (StorageValkeyAdmin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  ID_MODULE_ADMIN,
+		New: func() caddy.Module { return new(StorageValkeyAdmin) },
+	}
+}
+
+func (a *StorageValkeyAdmin) Provision(ctx caddy.Context) error {
+	// NOTE: Admin modules are not associated with the context, so we pass ourselves
+	a.logger = ctx.Logger(a)
+
+	// The endpoints are only useful when the configured storage is a valkey storage
+	if storage, ok := ctx.Storage().(*CaddyStorageValkey); ok {
+		a.storage = storage
+	}
+
+	return nil
+}
+
+func (a *StorageValkeyAdmin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: ADMIN_ENDPOINT_BASE,
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+func (a *StorageValkeyAdmin) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	// All endpoints are only for inspection
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	if a.storage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("the configured storage is no valkey storage"),
+		}
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, ADMIN_ENDPOINT_BASE) {
+	case "keys":
+		return a.handleKeys(w, r)
+	case "stat":
+		return a.handleStat(w, r)
+	case "value":
+		return a.handleValue(w, r)
+	case "locks":
+		return a.handleLocks(w, r)
+	case "health":
+		return a.handleHealth(w, r)
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+func (a *StorageValkeyAdmin) handleKeys(w http.ResponseWriter, r *http.Request) error {
+	prefix := r.URL.Query().Get("prefix")
+
+	recursive, err := parseQueryBool(r, "recursive", false)
+	if err != nil {
+		return err
+	}
+
+	keys, err := a.storage.List(r.Context(), prefix, recursive)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to list keys with prefix '%s': %v", prefix, err),
+		}
+	}
+	sort.Strings(keys)
+
+	return writeJson(w, http.StatusOK, keys)
+}
+
+func (a *StorageValkeyAdmin) handleStat(w http.ResponseWriter, r *http.Request) error {
+	key, err := requireQueryKey(r)
+	if err != nil {
+		return err
+	}
+
+	info, err := a.storage.Stat(withoutMigration(r.Context()), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keyNotFoundError(key)
+	} else if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to stat key '%s': %v", key, err),
+		}
+	}
+
+	return writeJson(w, http.StatusOK, adminKeyInfo{
+		Key:        info.Key,
+		Modified:   info.Modified,
+		Size:       info.Size,
+		IsTerminal: info.IsTerminal,
+	})
+}
+
+func (a *StorageValkeyAdmin) handleValue(w http.ResponseWriter, r *http.Request) error {
+	key, err := requireQueryKey(r)
+	if err != nil {
+		return err
+	}
+
+	// Private keys are only revealed when explicitly requested
+	redact, err := parseQueryBool(r, "redact", true)
+	if err != nil {
+		return err
+	}
+
+	value, err := a.storage.Load(withoutMigration(r.Context()), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keyNotFoundError(key)
+	} else if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to load key '%s': %v", key, err),
+		}
+	}
+
+	if redact {
+		value = redactPrivateKeys(value)
+	} else {
+		a.logger.Warn("revealed unredacted value via admin endpoint", zap.String("key", key))
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(value)
+
+	return nil
+}
+
+func (a *StorageValkeyAdmin) handleLocks(w http.ResponseWriter, r *http.Request) error {
+	locks := a.storage.HeldLocks()
+	sort.Strings(locks)
+
+	return writeJson(w, http.StatusOK, locks)
+}
+
+func (a *StorageValkeyAdmin) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	health := adminHealth{Topology: a.storage.Topology()}
+
+	status := http.StatusOK
+
+	start := time.Now()
+	if err := a.storage.Ping(r.Context()); err != nil {
+		health.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	} else {
+		health.Healthy = true
+		health.Latency = time.Since(start).String()
+	}
+
+	return writeJson(w, status, health)
+}
+
+func requireQueryKey(r *http.Request) (string, error) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("missing query parameter `key`"),
+		}
+	}
+
+	return key, nil
+}
+
+func parseQueryBool(r *http.Request, name string, fallback bool) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	val, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid value for query parameter `%s`: %v", name, err),
+		}
+	}
+
+	return val, nil
+}
+
+func keyNotFoundError(key string) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("key not found: %s", key),
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// redactPrivateKeys replaces the content of every PEM block containing a private
+// key, while keeping all other blocks and data untouched. Everything from a
+// malformed block on is replaced, as it can not be told apart from a key.
+func redactPrivateKeys(value []byte) []byte {
+	var r bytes.Buffer
+	rest := value
+
+	for {
+		start := bytes.Index(rest, []byte("-----BEGIN "))
+		if start < 0 {
+			break
+		}
+
+		r.Write(rest[:start])
+
+		// The decoder skips malformed blocks, so the block found needs to start here
+		block, remaining := pem.Decode(rest[start:])
+		end := len(rest) - len(remaining)
+		if next := bytes.Index(rest[start+1:], []byte("-----BEGIN ")); block != nil && next >= 0 && start+1+next < end {
+			block = nil
+		}
+		if block == nil {
+			// A malformed block, e.g. a truncated key, could be anything, so the rest is redacted
+			fmt.Fprintf(&r, "%s\n", REDACTED_PEM_CONTENT)
+			return r.Bytes()
+		}
+
+		if strings.Contains(block.Type, "PRIVATE KEY") {
+			fmt.Fprintf(&r, "-----BEGIN %s-----\n%s\n-----END %s-----\n", block.Type, REDACTED_PEM_CONTENT, block.Type)
+		} else {
+			r.Write(rest[start:end])
+		}
+		rest = remaining
+	}
+	r.Write(rest)
+
+	return r.Bytes()
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*StorageValkeyAdmin)(nil)
+	_ caddy.Provisioner = (*StorageValkeyAdmin)(nil)
+	_ caddy.AdminRouter = (*StorageValkeyAdmin)(nil)
+)
@@ -0,0 +1,341 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+type storageConfig struct {
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+}
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "valkey-storage",
+		Short: "Commands for browsing the valkey storage",
+		Long: `
+Allows browsing the contents of the valkey storage configured in the given
+config, without the need to know how the entries are stored internally.
+
+All commands mirror the semantics of their filesystem counterparts and only
+operate through the regular storage interface used by Caddy itself.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.PersistentFlags().StringP("config", "c", "", "Configuration file containing the valkey storage")
+			cmd.PersistentFlags().StringP("adapter", "a", "", "Name of config adapter to apply")
+
+			lsCmd := &cobra.Command{
+				Use:   "ls [--recursive] [<prefix>]",
+				Short: "Lists the keys below the given prefix",
+				Args:  cobra.MaximumNArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdList),
+			}
+			lsCmd.Flags().BoolP("recursive", "r", false, "List all keys below the prefix instead of only the direct children")
+			cmd.AddCommand(lsCmd)
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "stat <key>",
+				Short: "Shows the size and modification time of a key",
+				Args:  cobra.ExactArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdStat),
+			})
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "cat <key>",
+				Short: "Writes the value of a key to stdout",
+				Args:  cobra.ExactArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdCat),
+			})
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "rm <key>...",
+				Short: "Deletes the given keys",
+				Args:  cobra.MinimumNArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdRemove),
+			})
+
+			cmd.AddCommand(&cobra.Command{
+				Use:   "du [<prefix>]",
+				Short: "Summarizes the number of keys and bytes below the given prefix",
+				Args:  cobra.MaximumNArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdDiskUsage),
+			})
+
+			exportCmd := &cobra.Command{
+				Use:   "export --to <dir|file.tar> [--include <prefix>] [--exclude <prefix>] [--dry-run]",
+				Short: "Exports all keys into a directory or tar archive",
+				Long: `
+Exports all keys of the valkey storage into a directory using the same layout as
+the file_system storage, or into a tar archive when the target ends with .tar.
+The modification times of all keys are kept and the written data is read back
+and verified after the export.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdExport),
+			}
+			exportCmd.Flags().String("to", "", "Target directory or tar archive (required)")
+			addTransferFlags(exportCmd)
+			cmd.AddCommand(exportCmd)
+
+			importCmd := &cobra.Command{
+				Use:   "import --from <dir|file.tar> [--include <prefix>] [--exclude <prefix>] [--lock-wait <duration>] [--dry-run]",
+				Short: "Imports all keys from a directory or tar archive",
+				Long: `
+Imports all files of a directory using the file_system storage layout, or of a
+tar archive when the source ends with .tar, into the valkey storage. The
+modification times of all files are kept and every imported entry is read back
+and verified while its locks are still held.
+
+During the import the storage_clean lock and the issuance lock of every imported
+certificate are held, so live Caddy instances using the same storage do not
+race with the import. Locks held by another instance are waited for up to
+--lock-wait, or without a limit when it is 0.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdImport),
+			}
+			importCmd.Flags().String("from", "", "Source directory or tar archive (required)")
+			importCmd.Flags().Duration("lock-wait", DEFAULT_IMPORT_LOCK_WAIT_TIMEOUT, "Maximum duration to wait for a lock held by another instance (0 waits without a limit)")
+			addTransferFlags(importCmd)
+			cmd.AddCommand(importCmd)
+
+			reconcileCmd := &cobra.Command{
+				Use:   "reconcile [--dry-run]",
+				Short: "Fixes the drift between the storage and its mirror",
+				Long: `
+Makes the configured mirror storage equal to the valkey storage. Keys that are
+missing or differ in the mirror are stored again and keys that only exist in the
+mirror are deleted.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdReconcile),
+			}
+			reconcileCmd.Flags().Bool("dry-run", false, "Only print the keys that would be changed")
+			cmd.AddCommand(reconcileCmd)
+
+			migrateCmd := &cobra.Command{
+				Use:   "migrate [--dry-run]",
+				Short: "Migrates all entries to the current schema version",
+				Long: `
+Rewrites all entries key by key into the schema version supported by this
+version of the module. Caddy instances using the same storage can keep running
+during the migration, as long as they support both versions. Only a single
+migration runs at a time and an aborted migration continues where it stopped.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdMigrate),
+			}
+			migrateCmd.Flags().Bool("dry-run", false, "Only print the keys that would be migrated")
+			cmd.AddCommand(migrateCmd)
+		},
+	})
+}
+
+func addTransferFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("include", nil, "Only transfer keys below this prefix (repeatable)")
+	cmd.Flags().StringArray("exclude", nil, "Skip keys below this prefix (repeatable)")
+	cmd.Flags().Bool("dry-run", false, "Only print the keys that would be transferred")
+}
+
+// loadStorageFromConfig provisions the valkey storage of the given config. The
+// returned cancel function needs to be called to close all connections again.
+func loadStorageFromConfig(fl caddycmd.Flags) (*CaddyStorageValkey, context.CancelFunc, error) {
+	cfg, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var storageCfg storageConfig
+	if err := json.Unmarshal(cfg, &storageCfg); err != nil {
+		return nil, nil, err
+	}
+
+	if storageCfg.StorageRaw == nil {
+		return nil, nil, errors.New("no storage configured in config")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	val, err := ctx.LoadModule(&storageCfg, "StorageRaw")
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	module, ok := val.(*StorageValkeyModule)
+	if !ok {
+		cancel()
+		return nil, nil, errors.New("configured storage is no valkey storage")
+	}
+
+	return module.storage, cancel, nil
+}
+
+func cmdList(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	keys, err := storage.List(context.Background(), fl.Arg(0), fl.Bool("recursive"))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdStat(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	key := fl.Arg(0)
+
+	info, err := storage.Stat(withoutMigration(context.Background()), key)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %w", key, err)
+	}
+
+	fmt.Printf("Key:      %s\n", info.Key)
+	fmt.Printf("Size:     %d\n", info.Size)
+	fmt.Printf("Modified: %s\n", info.Modified.Format(time.RFC3339))
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdCat(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	key := fl.Arg(0)
+
+	value, err := storage.Load(withoutMigration(context.Background()), key)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %w", key, err)
+	}
+
+	if _, err := os.Stdout.Write(value); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdRemove(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	// Browsing never copies entries of the storage migrated from into valkey
+	ctx := withoutMigration(context.Background())
+
+	for _, key := range fl.Args() {
+		// Like rm, deleting a missing key is an error
+		if _, err := storage.Stat(ctx, key); err != nil {
+			return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %w", key, err)
+		}
+
+		if err := storage.Delete(ctx, key); err != nil {
+			return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdDiskUsage(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	ctx := withoutMigration(context.Background())
+
+	keys, err := storage.List(ctx, fl.Arg(0), true)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	var total int64
+	for _, key := range keys {
+		info, err := storage.Stat(ctx, key)
+		if err != nil {
+			return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %w", key, err)
+		}
+		total += info.Size
+	}
+
+	fmt.Printf("%d\t%d keys\t%s\n", total, len(keys), fl.Arg(0))
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdReconcile(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if storage.mirror == nil {
+		return caddy.ExitCodeFailedStartup, errors.New("no `mirror` configured for the valkey storage")
+	}
+
+	result, err := storage.mirror.reconcile(context.Background(), storage, fl.Bool("dry-run"))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	for _, key := range result.Stored {
+		fmt.Printf("store\t%s\n", key)
+	}
+	for _, key := range result.Deleted {
+		fmt.Printf("delete\t%s\n", key)
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdMigrate(fl caddycmd.Flags) (int, error) {
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	result, err := storage.MigrateSchema(context.Background(), fl.Bool("dry-run"))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	for _, key := range result.Migrated {
+		fmt.Printf("migrate\t%s\n", key)
+	}
+	fmt.Printf("schema version %d -> %d\n", result.FromVersion, result.ToVersion)
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,98 @@
+package caddystoragevalkey
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+	"github.com/spf13/pflag"
+)
+
+// commandFlags returns the flags of a command using the given config.
+func commandFlags(t *testing.T, config string, args ...string) caddycmd.Flags {
+	t.Helper()
+
+	flags := pflag.NewFlagSet("valkey-storage", pflag.ContinueOnError)
+	flags.String("config", "", "")
+	flags.String("adapter", "", "")
+	if err := flags.Parse(append([]string{"--config", config}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return caddycmd.Flags{FlagSet: flags}
+}
+
+// requireModuleLoading skips the test, when caddy does not recognize the raw
+// module configs, as json.RawMessage is an alias of another type with json v2.
+func requireModuleLoading(t *testing.T) {
+	t.Helper()
+
+	if reflect.TypeFor[json.RawMessage]().Name() != "RawMessage" {
+		t.Skip("caddy can not load modules from json.RawMessage fields with json v2")
+	}
+}
+
+// writeCommandConfig writes a config of a storage using the fake server, which
+// migrates from a file_system storage in the given directory.
+func writeCommandConfig(t *testing.T, server *fakeValkey, migrateFrom string) string {
+	t.Helper()
+
+	config, err := json.Marshal(map[string]any{
+		"storage": map[string]any{
+			"module":       "valkey",
+			"address":      []string{server.address},
+			"migrate_from": map[string]any{"module": "file_system", "root": migrateFrom},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "caddy.json")
+	if err := os.WriteFile(file, config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestCommandsDoNotMigrate(t *testing.T) {
+	requireModuleLoading(t)
+
+	server := newFakeValkey(t)
+	migrateFrom := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(migrateFrom, "certificates"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(migrateFrom, "certificates", "old.crt"), []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := writeCommandConfig(t, server, migrateFrom)
+
+	if _, err := cmdStat(commandFlags(t, config, "certificates/old.crt")); err != nil {
+		t.Fatalf("expected stat of the storage migrated from: %v", err)
+	}
+	if _, err := cmdStat(commandFlags(t, config, "certificates/missing.crt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected missing key to be reported, got %v", err)
+	}
+	if _, err := cmdRemove(commandFlags(t, config, "certificates/missing.crt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected removing a missing key to fail, got %v", err)
+	}
+
+	if _, err := cmdRemove(commandFlags(t, config, "certificates/old.crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.received("HMSET")) != 0 {
+		t.Fatal("expected commands not to migrate entries into valkey")
+	}
+	if len(server.received("DEL")) != 1 {
+		t.Fatal("expected key to be deleted in valkey")
+	}
+}
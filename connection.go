@@ -0,0 +1,218 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/valkey-io/valkey-go"
+	"github.com/valkey-io/valkey-go/valkeylock"
+)
+
+// Connections shared by all storages with the same connection config. This keeps
+// the connections and held locks alive across config reloads.
+var connectionPool = caddy.NewUsagePool()
+
+// ConnectionWatcher runs in the background while connected, e.g. to keep the
+// addresses of the nodes up to date. It is started once the connection has been
+// created and stopped when the connection is closed.
+type ConnectionWatcher interface {
+	Start(client valkey.Client)
+	Stop()
+}
+
+// valkeyConnection contains everything bound to the connection with valkey,
+// including the locks held through it.
+type valkeyConnection struct {
+	client valkey.Client
+	locker valkeylock.Locker
+	locks  sync.Map
+
+	// The client for the replica operations of the storage, if there are any
+	replicaClient valkey.Client
+
+	topology string
+
+	// The addresses connected to, which may have been discovered
+	address        []string
+	replicaAddress []string
+
+	watchers []ConnectionWatcher
+
+	// The client is owned by the locker and is closed together with it
+	sharedClient bool
+}
+
+func newValkeyConnection(clientOptions valkey.ClientOption, lockMajority int, shareLockerClient bool, replicaReads bool, watchers []ConnectionWatcher) (*valkeyConnection, error) {
+	var connection *valkeyConnection
+	var err error
+
+	if shareLockerClient {
+		connection, err = newSharedValkeyConnection(clientOptions, lockMajority)
+	} else {
+		connection, err = newSeparateValkeyConnection(clientOptions, lockMajority)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Cluster nodes only provide a single database
+	if connection.topology == string(valkey.ClientModeCluster) && clientOptions.SelectDB != 0 {
+		connection.Destruct()
+		return nil, errors.New("selecting a database other than 0 is not possible in cluster mode")
+	}
+
+	// Replica operations use a client of their own, so all other commands of
+	// the storage and the locker stay on the primary
+	if replicaReads {
+		connection.replicaClient, err = newReplicaClient(clientOptions)
+		if err != nil {
+			connection.Destruct()
+			return nil, err
+		}
+	}
+
+	connection.address = clientOptions.InitAddress
+	connection.replicaAddress = clientOptions.Standalone.ReplicaAddress
+
+	connection.watchers = watchers
+	for _, watcher := range watchers {
+		watcher.Start(connection.client)
+	}
+
+	return connection, nil
+}
+
+// newSeparateValkeyConnection creates separate clients for the storage and the locker.
+func newSeparateValkeyConnection(clientOptions valkey.ClientOption, lockMajority int) (*valkeyConnection, error) {
+	// Create a new client for valkey
+	valkeyClient, err := valkey.NewClient(clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new locker for valkey
+	valkeyLocker, err := valkeylock.NewLocker(valkeylock.LockerOption{
+		ClientOption:   clientOptions,
+		KeyPrefix:      LOCKER_PREFIX,
+		NoLoopTracking: true,
+		KeyMajority:    int32(lockMajority),
+	})
+
+	if err != nil {
+		// Cleanup unused client
+		valkeyClient.Close()
+		return nil, err
+	}
+
+	return &valkeyConnection{
+		client:   valkeyClient,
+		locker:   valkeyLocker,
+		topology: detectTopology(valkeyClient, clientOptions),
+	}, nil
+}
+
+// newSharedValkeyConnection creates a single client used for the storage and
+// the locker. The locker would track every key read by the client and force a
+// single pipeline, so the client is built with the pipelines of the config and
+// only the lock keys are tracked by broadcast instead.
+func newSharedValkeyConnection(clientOptions valkey.ClientOption, lockMajority int) (*valkeyConnection, error) {
+	// The lock keys would be read from replicas, which are not tracked by the locker
+	if clientOptions.SendToReplicas != nil {
+		return nil, errors.New("the locker can not share the client when sending commands to replicas")
+	}
+
+	var valkeyClient valkey.Client
+
+	valkeyLocker, err := valkeylock.NewLocker(valkeylock.LockerOption{
+		ClientOption:   clientOptions,
+		KeyPrefix:      LOCKER_PREFIX,
+		NoLoopTracking: true,
+		KeyMajority:    int32(lockMajority),
+		ClientBuilder: func(option valkey.ClientOption) (valkey.Client, error) {
+			// The locker is notified about released locks of other instances
+			if !option.DisableCache {
+				option.ClientTrackingOptions = []string{"BCAST", "PREFIX", LOCKER_PREFIX + ":", "NOLOOP"}
+			}
+			option.PipelineMultiplex = clientOptions.PipelineMultiplex
+
+			client, err := valkey.NewClient(option)
+			valkeyClient = client
+
+			return client, err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &valkeyConnection{
+		client:       valkeyClient,
+		locker:       valkeyLocker,
+		topology:     detectTopology(valkeyClient, clientOptions),
+		sharedClient: true,
+	}, nil
+}
+
+// loadOrNewValkeyConnection returns the pooled connection of the given key, or
+// creates it with newConnection. Every call needs to be paired with releasing
+// the key again.
+func loadOrNewValkeyConnection(poolKey string, newConnection func() (*valkeyConnection, error)) (*valkeyConnection, bool, error) {
+	val, loaded, err := connectionPool.LoadOrNew(poolKey, func() (caddy.Destructor, error) {
+		return newConnection()
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return val.(*valkeyConnection), loaded, nil
+}
+
+func releaseValkeyConnection(poolKey string) error {
+	_, err := connectionPool.Delete(poolKey)
+
+	return err
+}
+
+func detectTopology(client valkey.Client, clientOptions valkey.ClientOption) string {
+	mode := client.Mode()
+
+	// The client does not distinguish between standalone with or without replicas
+	if mode == valkey.ClientModeStandalone && len(clientOptions.Standalone.ReplicaAddress) > 0 {
+		return TOPOLOGY_REPLICA
+	}
+
+	return string(mode)
+}
+
+// Destruct releases all held locks and closes the connection.
+func (c *valkeyConnection) Destruct() error {
+	for _, watcher := range c.watchers {
+		watcher.Stop()
+	}
+
+	// Cleanup all held locks by this instance
+	c.locks.Range(func(key, value any) bool {
+		value.(context.CancelFunc)()
+		storageMetrics.locksHeld.Dec()
+
+		return true
+	})
+	c.locks.Clear()
+
+	// Close all connections
+	if !c.sharedClient {
+		c.client.Close()
+	}
+	if c.replicaClient != nil {
+		c.replicaClient.Close()
+	}
+	c.locker.Close()
+
+	return nil
+}
+
+var (
+	_ caddy.Destructor = (*valkeyConnection)(nil)
+)
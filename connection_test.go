@@ -0,0 +1,136 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+func TestSharedConnectionTracksOnlyLockKeys(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{ShareLockerClient: true})
+
+	if err := storage.Store(context.Background(), "certificates/example.com.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Unlock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	tracking := server.received("CLIENT")
+	tracking = slices.DeleteFunc(tracking, func(args []string) bool { return !strings.EqualFold(args[1], "TRACKING") })
+	if len(tracking) == 0 {
+		t.Fatal("expected client tracking to be enabled")
+	}
+	for _, args := range tracking {
+		if strings.Join(args, " ") != "CLIENT TRACKING ON BCAST PREFIX caddylock: NOLOOP" {
+			t.Fatalf("expected only the lock keys to be tracked, got %v", args)
+		}
+	}
+}
+
+func TestSharedConnectionUsesStorageClient(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		server := newFakeValkey(t)
+		storage := newTestStorage(t, server, CaddyStorageValkeyOptions{ShareLockerClient: shared})
+
+		if shared && storage.client != storage.locker.Client() {
+			t.Fatal("expected the locker to use the client of the storage")
+		}
+		if !shared && storage.client == storage.locker.Client() {
+			t.Fatal("expected the locker to use a client of its own")
+		}
+	}
+}
+
+// countingWatcher counts how often it has been started and stopped.
+type countingWatcher struct {
+	started atomic.Int32
+	stopped atomic.Int32
+}
+
+func (w *countingWatcher) Start(client valkey.Client) { w.started.Add(1) }
+func (w *countingWatcher) Stop()                      { w.stopped.Add(1) }
+
+func TestPooledConnectionBuildsOptionsOnce(t *testing.T) {
+	server := newFakeValkey(t)
+	watcher := &countingWatcher{}
+
+	var built atomic.Int32
+	options := CaddyStorageValkeyOptions{
+		ConnectionPoolKey: fmt.Sprintf("%s-%s", t.Name(), server.address),
+		ConnectionOptions: func(clientOptions valkey.ClientOption) (valkey.ClientOption, []ConnectionWatcher, error) {
+			built.Add(1)
+			return clientOptions, []ConnectionWatcher{watcher}, nil
+		},
+	}
+
+	first, err := NewCaddyStorageValkey(valkey.ClientOption{InitAddress: []string{server.address}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewCaddyStorageValkey(valkey.ClientOption{InitAddress: []string{server.address}}, options)
+	if err != nil {
+		first.Close()
+		t.Fatal(err)
+	}
+
+	if first.valkeyConnection != second.valkeyConnection {
+		t.Fatal("expected the pooled connection to be reused")
+	}
+	if built.Load() != 1 || watcher.started.Load() != 1 {
+		t.Fatalf("expected the connection options to be built and started once, got %d and %d", built.Load(), watcher.started.Load())
+	}
+
+	first.Close()
+	if watcher.stopped.Load() != 0 {
+		t.Fatal("expected the watcher to run while the connection is still used")
+	}
+	second.Close()
+	if watcher.stopped.Load() != 1 {
+		t.Fatal("expected the watcher to be stopped with the connection")
+	}
+}
+
+// BenchmarkConnectionCount reports the connections opened to valkey for a
+// storage with a lock, with a separate and a shared client for the locker.
+func BenchmarkConnectionCount(b *testing.B) {
+	for _, shared := range []bool{false, true} {
+		name := "separate"
+		if shared {
+			name = "shared"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			conns := 0
+			for b.Loop() {
+				server := newFakeValkey(b)
+				storage := newTestStorage(b, server, CaddyStorageValkeyOptions{ShareLockerClient: shared})
+
+				if err := storage.Store(context.Background(), "certificates/example.com.crt", []byte("certificate")); err != nil {
+					b.Fatal(err)
+				}
+				if err := storage.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+					b.Fatal(err)
+				}
+				if err := storage.Unlock(context.Background(), "issue_cert_example.com"); err != nil {
+					b.Fatal(err)
+				}
+
+				server.mu.Lock()
+				conns = server.conns
+				server.mu.Unlock()
+			}
+
+			b.ReportMetric(float64(conns), "conns")
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+const (
+	DEFAULT_CREDENTIALS_COMMAND_TIMEOUT = 10 * time.Second
+
+	CREDENTIALS_SOURCE_FILE    = "file"
+	CREDENTIALS_SOURCE_ENV     = "env"
+	CREDENTIALS_SOURCE_COMMAND = "command"
+)
+
+// CredentialsConfig contains the sources of the credentials, which are read again
+// for every new connection. Rotated credentials are picked up on reconnects
+// without reloading the config.
+type CredentialsConfig struct {
+	UsernameFile string `json:"username_file,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+
+	UsernameEnv string `json:"username_env,omitempty"`
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	// The command prints the password, or the username and the password on two lines
+	Command        []string       `json:"command,omitempty"`
+	CommandTimeout caddy.Duration `json:"command_timeout,omitempty"`
+}
+
+// passwordSource returns the name of the source the password is read from.
+func (c *CredentialsConfig) passwordSource() string {
+	switch {
+	case len(c.PasswordFile) > 0:
+		return CREDENTIALS_SOURCE_FILE
+	case len(c.PasswordEnv) > 0:
+		return CREDENTIALS_SOURCE_ENV
+	case len(c.Command) > 0:
+		return CREDENTIALS_SOURCE_COMMAND
+	}
+
+	return ""
+}
+
+func (c *CredentialsConfig) validate() error {
+	passwordSources := 0
+	for _, isSet := range []bool{len(c.PasswordFile) > 0, len(c.PasswordEnv) > 0, len(c.Command) > 0} {
+		if isSet {
+			passwordSources++
+		}
+	}
+
+	if passwordSources == 0 {
+		return errors.New("the `credentials` block requires one of `password_file`, `password_env` or `command`")
+	} else if passwordSources > 1 {
+		return errors.New("setting more than one of `credentials.password_file`, `credentials.password_env` and `credentials.command` is not allowed")
+	}
+
+	if len(c.UsernameFile) > 0 && len(c.UsernameEnv) > 0 {
+		return errors.New("setting the `credentials.username_file` and `credentials.username_env` option is not allowed")
+	}
+
+	// The command may print the username as well
+	if len(c.Command) > 0 && (len(c.UsernameFile) > 0 || len(c.UsernameEnv) > 0) {
+		return errors.New("setting the `credentials.command` and `credentials.username_file` or `credentials.username_env` option is not allowed")
+	}
+
+	if c.CommandTimeout < 0 {
+		return errors.New("impossible value for `credentials.command_timeout` option (value >= 0 required)")
+	} else if c.CommandTimeout > 0 && len(c.Command) == 0 {
+		return errors.New("the `credentials.command_timeout` option requires `credentials.command`")
+	}
+
+	return nil
+}
+
+// authCredentialsFn returns the function called by the client for every new
+// connection. The given username is used when no source provides a username.
+func (c *CredentialsConfig) authCredentialsFn(username string) func(valkey.AuthCredentialsContext) (valkey.AuthCredentials, error) {
+	return func(authContext valkey.AuthCredentialsContext) (valkey.AuthCredentials, error) {
+		credentials := valkey.AuthCredentials{Username: username}
+
+		switch {
+		case len(c.Command) > 0:
+			address := ""
+			if authContext.Address != nil {
+				address = authContext.Address.String()
+			}
+
+			commandUsername, password, err := c.runCommand(address)
+			if err != nil {
+				return credentials, err
+			}
+			if len(commandUsername) > 0 {
+				credentials.Username = commandUsername
+			}
+			credentials.Password = password
+
+			return credentials, nil
+		case len(c.UsernameFile) > 0:
+			fileUsername, err := readCredentialsFile(c.UsernameFile)
+			if err != nil {
+				return credentials, err
+			}
+			credentials.Username = fileUsername
+		case len(c.UsernameEnv) > 0:
+			envUsername, err := readCredentialsEnv(c.UsernameEnv)
+			if err != nil {
+				return credentials, err
+			}
+			credentials.Username = envUsername
+		}
+
+		var err error
+		if len(c.PasswordFile) > 0 {
+			credentials.Password, err = readCredentialsFile(c.PasswordFile)
+		} else {
+			credentials.Password, err = readCredentialsEnv(c.PasswordEnv)
+		}
+
+		return credentials, err
+	}
+}
+
+// runCommand runs the command and returns the username, which is empty when only
+// the password has been printed, and the password.
+func (c *CredentialsConfig) runCommand(address string) (string, string, error) {
+	timeout := time.Duration(c.CommandTimeout)
+	if timeout == 0 {
+		timeout = DEFAULT_CREDENTIALS_COMMAND_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("VALKEY_ADDRESS=%s", address))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// Never include the output in errors, as it contains the password
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("running credentials command: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	lines := strings.Split(strings.TrimRight(stdout.String(), "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+
+	switch {
+	case len(lines) == 1 && len(lines[0]) > 0:
+		return "", lines[0], nil
+	case len(lines) == 2 && len(lines[0]) > 0 && len(lines[1]) > 0:
+		return lines[0], lines[1], nil
+	}
+
+	return "", "", errors.New("credentials command needs to print the password, or the username and the password on two lines")
+}
+
+// readCredentialsFile reads the file without the trailing line break. Empty files
+// are rejected, as they are most likely written at the moment.
+func readCredentialsFile(filePath string) (string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	value := strings.TrimRight(string(content), "\r\n")
+	if len(value) == 0 {
+		return "", fmt.Errorf("credentials file '%s' is empty", filePath)
+	}
+
+	return value, nil
+}
+
+func readCredentialsEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || len(value) == 0 {
+		return "", fmt.Errorf("credentials environment variable '%s' is not set", name)
+	}
+
+	return value, nil
+}
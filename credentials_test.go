@@ -0,0 +1,200 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// lastHelloAuth returns the username and password of the last HELLO received.
+func (f *fakeValkey) lastHelloAuth() (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return lastAuth(f.hellos)
+}
+
+// lastAuth returns the username and password of the last HELLO with AUTH.
+func lastAuth(hellos [][]string) (string, string) {
+	for i := len(hellos) - 1; i >= 0; i-- {
+		hello := hellos[i]
+		if index := slices.IndexFunc(hello, func(arg string) bool { return strings.EqualFold(arg, "AUTH") }); index >= 0 && index+2 < len(hello) {
+			return hello[index+1], hello[index+2]
+		}
+	}
+
+	return "", ""
+}
+
+func TestCredentialsRotateOnReconnect(t *testing.T) {
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	commandOutput := filepath.Join(dir, "output")
+
+	tests := map[string]struct {
+		credentials CredentialsConfig
+		rotate      func(username string, password string)
+	}{
+		"file": {
+			credentials: CredentialsConfig{UsernameFile: usernameFile, PasswordFile: passwordFile},
+			rotate: func(username string, password string) {
+				writeFile(t, usernameFile, []byte(username+"\n"))
+				writeFile(t, passwordFile, []byte(password+"\n"))
+			},
+		},
+		"env": {
+			credentials: CredentialsConfig{UsernameEnv: "TEST_VALKEY_USERNAME", PasswordEnv: "TEST_VALKEY_PASSWORD"},
+			rotate: func(username string, password string) {
+				t.Setenv("TEST_VALKEY_USERNAME", username)
+				t.Setenv("TEST_VALKEY_PASSWORD", password)
+			},
+		},
+		"command": {
+			credentials: CredentialsConfig{Command: []string{"cat", commandOutput}},
+			rotate: func(username string, password string) {
+				writeFile(t, commandOutput, []byte(username+"\n"+password+"\n"))
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newFakeValkey(t)
+
+			test.rotate("caddy", "old-password")
+			client, err := valkey.NewClient(valkey.ClientOption{
+				InitAddress:       []string{server.address},
+				AuthCredentialsFn: test.credentials.authCredentialsFn("default"),
+				DisableCache:      true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if username, password := server.lastHelloAuth(); username != "caddy" || password != "old-password" {
+				t.Fatalf("expected initial credentials, got %s:%s", username, password)
+			}
+
+			// Established connections keep their credentials
+			test.rotate("caddy-rotated", "new-password")
+			if err := client.Do(context.Background(), client.B().Ping().Build()).Error(); err != nil {
+				t.Fatal(err)
+			}
+			if username, _ := server.lastHelloAuth(); username != "caddy" {
+				t.Fatalf("expected no reconnect, got credentials of %s", username)
+			}
+
+			server.disconnect()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				client.Do(context.Background(), client.B().Ping().Build())
+
+				if username, password := server.lastHelloAuth(); username == "caddy-rotated" && password == "new-password" {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("expected rotated credentials after reconnect")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestCredentialsCommandOutput(t *testing.T) {
+	tests := map[string]struct {
+		output   string
+		username string
+		password string
+		fails    bool
+	}{
+		"password":              {output: "secret\n", password: "secret"},
+		"password without eol":  {output: "secret", password: "secret"},
+		"username and password": {output: "caddy\nsecret\n", username: "caddy", password: "secret"},
+		"windows line breaks":   {output: "caddy\r\nsecret\r\n", username: "caddy", password: "secret"},
+		"empty":                 {output: "", fails: true},
+		"empty username":        {output: "\nsecret\n", fails: true},
+		"three lines":           {output: "caddy\nsecret\nmore\n", fails: true},
+	}
+
+	dir := t.TempDir()
+	for name, test := range tests {
+		output := filepath.Join(dir, strings.ReplaceAll(name, " ", "_"))
+		if err := os.WriteFile(output, []byte(test.output), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		credentials := CredentialsConfig{Command: []string{"cat", output}}
+		username, password, err := credentials.runCommand("127.0.0.1:6379")
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected output to be rejected", name)
+			} else if len(test.output) > 0 && strings.Contains(err.Error(), strings.TrimSpace(test.output)) {
+				t.Errorf("%s: expected error without the output", name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if username != test.username || password != test.password {
+			t.Errorf("%s: expected %q and %q, got %q and %q", name, test.username, test.password, username, password)
+		}
+	}
+}
+
+func TestCredentialsCommandReceivesAddress(t *testing.T) {
+	credentials := CredentialsConfig{Command: []string{"sh", "-c", "echo \"$VALKEY_ADDRESS\""}}
+
+	_, password, err := credentials.runCommand("10.0.0.1:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "10.0.0.1:6379" {
+		t.Fatalf("expected address in environment, got %q", password)
+	}
+
+	credentials = CredentialsConfig{Command: []string{"sh", "-c", "echo failed >&2; exit 1"}}
+	if _, _, err := credentials.runCommand("10.0.0.1:6379"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("expected error with output of stderr, got %v", err)
+	}
+}
+
+func TestCredentialsValidate(t *testing.T) {
+	tests := map[string]struct {
+		credentials CredentialsConfig
+		valid       bool
+	}{
+		"password file":             {credentials: CredentialsConfig{PasswordFile: "/run/password"}, valid: true},
+		"password env":              {credentials: CredentialsConfig{PasswordEnv: "PASSWORD"}, valid: true},
+		"command":                   {credentials: CredentialsConfig{Command: []string{"vault"}}, valid: true},
+		"username file":             {credentials: CredentialsConfig{UsernameFile: "/run/username", PasswordEnv: "PASSWORD"}, valid: true},
+		"no password":               {credentials: CredentialsConfig{UsernameFile: "/run/username"}},
+		"password file and env":     {credentials: CredentialsConfig{PasswordFile: "/run/password", PasswordEnv: "PASSWORD"}},
+		"password file and command": {credentials: CredentialsConfig{PasswordFile: "/run/password", Command: []string{"vault"}}},
+		"password env and command":  {credentials: CredentialsConfig{PasswordEnv: "PASSWORD", Command: []string{"vault"}}},
+		"both username sources":     {credentials: CredentialsConfig{UsernameFile: "/run/username", UsernameEnv: "USERNAME", PasswordEnv: "PASSWORD"}},
+		"command and username":      {credentials: CredentialsConfig{UsernameEnv: "USERNAME", Command: []string{"vault"}}},
+		"timeout without command":   {credentials: CredentialsConfig{PasswordEnv: "PASSWORD", CommandTimeout: 1}},
+		"negative timeout":          {credentials: CredentialsConfig{Command: []string{"vault"}, CommandTimeout: -1}},
+	}
+
+	for name, test := range tests {
+		err := test.credentials.validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected to be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package caddystoragevalkey
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	UNIX_ADDRESS_PREFIX = "unix://"
+
+	PROXY_SCHEME_SOCKS5  = "socks5"
+	PROXY_SCHEME_SOCKS5H = "socks5h"
+	PROXY_SCHEME_HTTP    = "http"
+)
+
+// dialCtxFn is the signature of the dial function of the client.
+type dialCtxFn = func(context.Context, string, *net.Dialer, *tls.Config) (net.Conn, error)
+
+// isUnixAddress reports whether the address is given as unix socket.
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, UNIX_ADDRESS_PREFIX)
+}
+
+// unixSocketPath returns the path of the socket. Like the client does for unix
+// URLs, the path itself is used as address of the node.
+func unixSocketPath(address string) string {
+	return strings.TrimPrefix(address, UNIX_ADDRESS_PREFIX)
+}
+
+// isUnixSocketPath reports whether the address passed by the client to the dial
+// function is the path of a unix socket.
+func isUnixSocketPath(address string) bool {
+	return strings.HasPrefix(address, "/")
+}
+
+// validateProxyUrl checks the given proxy URL and returns it parsed.
+func validateProxyUrl(rawProxyUrl string) (*url.URL, error) {
+	proxyUrl, err := url.Parse(rawProxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for `proxy`: %v", err)
+	}
+
+	switch proxyUrl.Scheme {
+	case PROXY_SCHEME_SOCKS5, PROXY_SCHEME_SOCKS5H, PROXY_SCHEME_HTTP:
+		break
+	default:
+		return nil, fmt.Errorf("invalid scheme '%s' for `proxy` (socks5, socks5h or http required)", proxyUrl.Scheme)
+	}
+
+	if len(proxyUrl.Hostname()) == 0 || len(proxyUrl.Port()) == 0 {
+		return nil, errors.New("invalid value for `proxy` (host and port required)")
+	}
+
+	return proxyUrl, nil
+}
+
+// newDialCtxFn returns the dial function of the client, which connects to unix
+// sockets directly and to all other addresses through the proxy if given.
+func newDialCtxFn(proxyUrl *url.URL) dialCtxFn {
+	return func(ctx context.Context, address string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+		// Unix sockets are always local and do not use TLS
+		if isUnixSocketPath(address) {
+			return dialer.DialContext(ctx, "unix", address)
+		}
+
+		var conn net.Conn
+		var err error
+
+		switch {
+		case proxyUrl == nil:
+			conn, err = dialer.DialContext(ctx, "tcp", address)
+		case proxyUrl.Scheme == PROXY_SCHEME_HTTP:
+			conn, err = dialHttpConnect(ctx, proxyUrl, address, dialer)
+		default:
+			conn, err = dialSocks5(ctx, proxyUrl, address, dialer)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if tlsConfig == nil {
+			return conn, nil
+		}
+
+		// The TLS handshake happens through the tunnel of the proxy
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// dialSocks5 connects through a SOCKS5 proxy. The address is resolved by the
+// proxy with the socks5h scheme and locally otherwise.
+func dialSocks5(ctx context.Context, proxyUrl *url.URL, address string, dialer *net.Dialer) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		auth = &proxy.Auth{User: proxyUrl.User.Username(), Password: password}
+	}
+
+	if proxyUrl.Scheme == PROXY_SCHEME_SOCKS5 {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		resolver := dialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(ips[0].String(), port)
+	}
+
+	socksDialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s through proxy %s: %w", address, proxyUrl.Host, err)
+	}
+
+	return conn, nil
+}
+
+// dialHttpConnect connects through a proxy supporting the HTTP CONNECT method.
+func dialHttpConnect(ctx context.Context, proxyUrl *url.URL, address string, dialer *net.Dialer) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The context is not bound to the connection, so its deadline is applied instead
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to %s through proxy %s: %s", address, proxyUrl.Host, resp.Status)
+	}
+
+	// Valkey only answers after the client, but do not lose anything already read
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads the data buffered while reading the response of the proxy
+// before reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
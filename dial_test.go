@@ -0,0 +1,382 @@
+package caddystoragevalkey
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// fakeProxy is a proxy stand-in, which records the target addresses it is asked
+// to connect to and tunnels every connection to the upstream address instead.
+type fakeProxy struct {
+	address  string
+	scheme   string
+	upstream string
+
+	// The status of the replies to HTTP CONNECT requests
+	status int
+
+	mu          sync.Mutex
+	targets     []string
+	credentials []string
+}
+
+func newFakeProxy(t *testing.T, scheme string, upstream string) *fakeProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeProxy{
+		address:  listener.Addr().String(),
+		scheme:   scheme,
+		upstream: upstream,
+		status:   http.StatusOK,
+	}
+
+	var wg sync.WaitGroup
+	conns := map[net.Conn]struct{}{}
+	t.Cleanup(func() {
+		listener.Close()
+
+		p.mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			p.mu.Lock()
+			conns[conn] = struct{}{}
+			p.mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.serveConn(conn)
+			}()
+		}
+	}()
+
+	return p
+}
+
+// url returns the URL of the proxy, optionally with credentials.
+func (p *fakeProxy) url(user *url.Userinfo) *url.URL {
+	return &url.URL{Scheme: p.scheme, Host: p.address, User: user}
+}
+
+// received returns the target addresses and credentials of all connections.
+func (p *fakeProxy) received() ([]string, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string{}, p.targets...), append([]string{}, p.credentials...)
+}
+
+func (p *fakeProxy) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	var target string
+	var credentials string
+	var err error
+	if p.scheme == PROXY_SCHEME_HTTP {
+		target, credentials, err = p.httpConnectHandshake(conn, reader)
+	} else {
+		target, credentials, err = socks5Handshake(conn, reader)
+	}
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.credentials = append(p.credentials, credentials)
+	p.mu.Unlock()
+
+	if p.status != http.StatusOK {
+		return
+	}
+
+	upstream, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	go func() {
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+	io.Copy(upstream, reader)
+}
+
+// httpConnectHandshake reads the CONNECT request and replies with the status of
+// the proxy.
+func (p *fakeProxy) httpConnectHandshake(conn net.Conn, reader *bufio.Reader) (string, string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", "", fmt.Errorf("unexpected method %s", req.Method)
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", p.status, http.StatusText(p.status))
+
+	return req.RequestURI, req.Header.Get("Proxy-Authorization"), err
+}
+
+// socks5Handshake negotiates the authentication and reads the connect request,
+// which is always answered with success.
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return "", "", err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", "", err
+	}
+
+	// Username and password are preferred when offered
+	credentials := ""
+	if slices.Contains(methods, 0x02) {
+		if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+			return "", "", err
+		}
+
+		username, password, err := readSocks5Credentials(reader)
+		if err != nil {
+			return "", "", err
+		}
+		credentials = username + ":" + password
+
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return "", "", err
+		}
+	} else if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", "", err
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == 0x04 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		return "", "", errors.New("unknown address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", "", err
+	}
+
+	// Succeeded, bound to 0.0.0.0:0
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), credentials, nil
+}
+
+func readSocks5Credentials(reader *bufio.Reader) (string, string, error) {
+	fields := make([]string, 2)
+	if _, err := reader.ReadByte(); err != nil {
+		return "", "", err
+	}
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+
+	return fields[0], fields[1], nil
+}
+
+// newDialedTestStorage returns a storage connecting to the address with the dial
+// function of the given proxy.
+func newDialedTestStorage(t *testing.T, address string, proxyUrl *url.URL) *CaddyStorageValkey {
+	t.Helper()
+
+	storage, err := NewCaddyStorageValkey(valkey.ClientOption{
+		InitAddress: []string{address},
+		DialCtxFn:   newDialCtxFn(proxyUrl),
+	}, CaddyStorageValkeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	return storage
+}
+
+// storeAndLoad checks the storage reaches the fake valkey.
+func storeAndLoad(t *testing.T, storage *CaddyStorageValkey, server *fakeValkey) {
+	t.Helper()
+
+	ctx := context.Background()
+	if err := storage.Store(ctx, "certificates/example.com.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := storage.Load(ctx, "certificates/example.com.crt")
+	if err != nil || string(value) != "certificate" {
+		t.Fatalf("unexpected value %q: %v", value, err)
+	}
+	if len(server.received("HMSET")) != 1 {
+		t.Fatal("expected store to reach the server")
+	}
+}
+
+func TestDialThroughSocks5ProxyResolvesLocally(t *testing.T) {
+	server := newFakeValkey(t)
+	proxy := newFakeProxy(t, PROXY_SCHEME_SOCKS5, server.address)
+
+	storage := newDialedTestStorage(t, "localhost:6379", proxy.url(nil))
+	storeAndLoad(t, storage, server)
+
+	// The proxy only receives the resolved address
+	targets, credentials := proxy.received()
+	if len(targets) == 0 {
+		t.Fatal("expected connection through the proxy")
+	}
+	for i, target := range targets {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || port != "6379" || !net.ParseIP(host).IsLoopback() {
+			t.Fatalf("expected resolved address of localhost, got %s", target)
+		}
+		if len(credentials[i]) > 0 {
+			t.Fatalf("expected no credentials, got %s", credentials[i])
+		}
+	}
+}
+
+func TestDialThroughSocks5hProxyResolvesRemotely(t *testing.T) {
+	server := newFakeValkey(t)
+	proxy := newFakeProxy(t, PROXY_SCHEME_SOCKS5H, server.address)
+
+	// The name is only known to the proxy
+	storage := newDialedTestStorage(t, "valkey.internal:6379", proxy.url(url.UserPassword("caddy", "secret")))
+	storeAndLoad(t, storage, server)
+
+	targets, credentials := proxy.received()
+	if len(targets) == 0 {
+		t.Fatal("expected connection through the proxy")
+	}
+	for i, target := range targets {
+		if target != "valkey.internal:6379" {
+			t.Fatalf("expected unresolved address, got %s", target)
+		}
+		if credentials[i] != "caddy:secret" {
+			t.Fatalf("expected credentials of the proxy URL, got %s", credentials[i])
+		}
+	}
+}
+
+func TestDialThroughHttpConnectProxy(t *testing.T) {
+	server := newFakeValkey(t)
+	proxy := newFakeProxy(t, PROXY_SCHEME_HTTP, server.address)
+
+	storage := newDialedTestStorage(t, "valkey.internal:6379", proxy.url(url.UserPassword("caddy", "secret")))
+	storeAndLoad(t, storage, server)
+
+	targets, credentials := proxy.received()
+	if len(targets) == 0 {
+		t.Fatal("expected connection through the proxy")
+	}
+	for i, target := range targets {
+		if target != "valkey.internal:6379" {
+			t.Fatalf("expected address in CONNECT request, got %s", target)
+		}
+		// Basic base64("caddy:secret")
+		if credentials[i] != "Basic Y2FkZHk6c2VjcmV0" {
+			t.Fatalf("expected basic authorization of the proxy URL, got %s", credentials[i])
+		}
+	}
+}
+
+func TestDialThroughHttpConnectProxyRejected(t *testing.T) {
+	proxy := newFakeProxy(t, PROXY_SCHEME_HTTP, "")
+	proxy.status = http.StatusForbidden
+
+	dial := newDialCtxFn(proxy.url(nil))
+	if _, err := dial(context.Background(), "valkey.internal:6379", &net.Dialer{}, nil); err == nil {
+		t.Fatal("expected rejected CONNECT request to fail")
+	}
+
+	if targets, _ := proxy.received(); len(targets) != 1 || targets[0] != "valkey.internal:6379" {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+}
+
+func TestDialUnixSocketBypassesProxy(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "valkey.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeValkeyOn(t, listener)
+	proxy := newFakeProxy(t, PROXY_SCHEME_SOCKS5H, "")
+
+	storage := newDialedTestStorage(t, unixSocketPath(UNIX_ADDRESS_PREFIX+socket), proxy.url(nil))
+	storeAndLoad(t, storage, server)
+
+	if targets, _ := proxy.received(); len(targets) != 0 {
+		t.Fatalf("expected unix socket to be dialed directly, got proxy targets %v", targets)
+	}
+}
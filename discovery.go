@@ -0,0 +1,510 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_SRV_REFRESH_INTERVAL = 30 * time.Second
+	SRV_LOOKUP_TIMEOUT           = 10 * time.Second
+
+	DEFAULT_REPLICA_DISCOVERY_INTERVAL    = 10 * time.Second
+	DEFAULT_REPLICA_DISCOVERY_MAX_LAG     = 10 * time.Second
+	DEFAULT_REPLICA_DISCOVERY_CONNECTIONS = 3
+	REPLICA_DISCOVERY_TIMEOUT             = 5 * time.Second
+
+	// The client is given the discovered replicas as <name>#<slot>
+	REPLICA_DISCOVERY_NAME = "discovered-replica"
+	REPLICA_SLOT_SEPARATOR = "#"
+)
+
+// addressMapping maps the addresses given to the client to the currently known
+// targets, which are looked up whenever the client dials one of them. Replicas
+// are given to the client as a fixed number of slots, which are spread over the
+// targets, as the client can not add or remove replicas while connected.
+//
+// When the targets change, connections to targets an address no longer maps to
+// are closed, which makes the client reconnect to the current targets.
+type addressMapping struct {
+	name string
+
+	// Dialed instead when no target is known, e.g. the primary for replicas
+	fallback string
+
+	mu      sync.Mutex
+	targets []string
+	conns   map[*mappedConn]struct{}
+}
+
+func newAddressMapping(name string, fallback string, targets []string) *addressMapping {
+	return &addressMapping{
+		name:     name,
+		fallback: fallback,
+		targets:  targets,
+		conns:    map[*mappedConn]struct{}{},
+	}
+}
+
+// slots returns the addresses of the given number of replica slots.
+func (a *addressMapping) slots(count int) []string {
+	addresses := make([]string, count)
+	for i := range addresses {
+		addresses[i] = a.name + REPLICA_SLOT_SEPARATOR + strconv.Itoa(i)
+	}
+
+	return addresses
+}
+
+// candidates returns the targets the address may be connected to, in the order
+// they are tried, or nil for addresses of others. The caller needs to hold the lock.
+func (a *addressMapping) candidates(address string) []string {
+	var targets []string
+
+	if address == a.name {
+		targets = a.targets
+	} else {
+		slot, found := strings.CutPrefix(address, a.name+REPLICA_SLOT_SEPARATOR)
+		if !found {
+			return nil
+		}
+
+		index, err := strconv.Atoi(slot)
+		if err != nil || index < 0 {
+			return nil
+		}
+
+		// Slots share the targets, when there are less targets than slots
+		if len(a.targets) > 0 {
+			targets = []string{a.targets[index%len(a.targets)]}
+		}
+	}
+
+	if len(targets) == 0 && len(a.fallback) > 0 {
+		return []string{a.fallback}
+	}
+
+	return targets
+}
+
+// dialCtxFn wraps the given dial function, connecting the addresses of this
+// mapping to their targets and passing all other addresses through.
+func (a *addressMapping) dialCtxFn(next dialCtxFn) dialCtxFn {
+	return func(ctx context.Context, address string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+		a.mu.Lock()
+		candidates := slices.Clone(a.candidates(address))
+		a.mu.Unlock()
+
+		if candidates == nil {
+			return next(ctx, address, dialer, tlsConfig)
+		}
+
+		var errs []error
+		for _, target := range candidates {
+			conn, err := next(ctx, target, dialer, tlsConfig)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			return a.track(conn, address, target), nil
+		}
+
+		return nil, fmt.Errorf("connecting to '%s': %w", address, errors.Join(errs...))
+	}
+}
+
+func (a *addressMapping) track(conn net.Conn, address string, target string) net.Conn {
+	c := &mappedConn{Conn: conn, mapping: a, address: address, target: target}
+
+	a.mu.Lock()
+	a.conns[c] = struct{}{}
+	a.mu.Unlock()
+
+	return c
+}
+
+// update replaces the targets and closes the connections to targets their
+// address no longer maps to. It returns the added and removed targets and the
+// number of closed connections.
+func (a *addressMapping) update(targets []string) ([]string, []string, int) {
+	a.mu.Lock()
+
+	if slices.Equal(targets, a.targets) {
+		a.mu.Unlock()
+		return nil, nil, 0
+	}
+
+	var added, removed []string
+	for _, target := range targets {
+		if !slices.Contains(a.targets, target) {
+			added = append(added, target)
+		}
+	}
+	for _, target := range a.targets {
+		if !slices.Contains(targets, target) {
+			removed = append(removed, target)
+		}
+	}
+	a.targets = targets
+
+	var stale []*mappedConn
+	for c := range a.conns {
+		if !slices.Contains(a.candidates(c.address), c.target) {
+			stale = append(stale, c)
+		}
+	}
+
+	a.mu.Unlock()
+
+	for _, c := range stale {
+		c.Close()
+	}
+
+	return added, removed, len(stale)
+}
+
+// mappedConn is a connection to a target of an address mapping, which is
+// tracked until closed.
+type mappedConn struct {
+	net.Conn
+	mapping *addressMapping
+	address string
+	target  string
+}
+
+func (c *mappedConn) Close() error {
+	c.mapping.mu.Lock()
+	delete(c.mapping.conns, c)
+	c.mapping.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// srvDiscovery resolves the nodes published as DNS SRV records. The client is
+// given the name of the records as address, or a slot for each replica found
+// when connecting, so reconnects always use the current targets.
+type srvDiscovery struct {
+	*addressMapping
+
+	replica  bool
+	interval time.Duration
+	resolver *net.Resolver
+	logger   *zap.Logger
+
+	slotCount int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newSrvDiscovery resolves the records once with the given resolver, as there is
+// nothing to connect to without any target.
+func newSrvDiscovery(name string, replica bool, interval time.Duration, resolver *net.Resolver, logger *zap.Logger) (*srvDiscovery, error) {
+	if interval <= 0 {
+		interval = DEFAULT_SRV_REFRESH_INTERVAL
+	}
+
+	d := &srvDiscovery{
+		replica:  replica,
+		interval: interval,
+		resolver: resolver,
+		logger:   logger.Named("srv").With(zap.String("name", name), zap.Bool("replica", replica)),
+		stop:     make(chan struct{}),
+	}
+
+	targets, err := d.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	d.addressMapping = newAddressMapping(name, "", targets)
+	d.slotCount = len(targets)
+
+	d.logger.Info("resolved srv records", zap.Strings("targets", targets))
+
+	return d, nil
+}
+
+// lookup returns the targets ordered by priority and weight. The order is
+// stable, so unchanged records are recognized as such.
+func (d *srvDiscovery) lookup(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SRV_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("resolving srv records of '%s': %v", name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no srv records found for '%s'", name)
+	}
+
+	slices.SortFunc(records, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+		if a.Weight != b.Weight {
+			return int(b.Weight) - int(a.Weight)
+		}
+		if a.Target != b.Target {
+			return strings.Compare(a.Target, b.Target)
+		}
+
+		return int(a.Port) - int(b.Port)
+	})
+
+	targets := make([]string, 0, len(records))
+	for _, record := range records {
+		target := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+// addresses returns the addresses given to the client.
+func (d *srvDiscovery) addresses() []string {
+	if d.replica {
+		return d.slots(d.slotCount)
+	}
+
+	return []string{d.name}
+}
+
+// Start re-resolves the records periodically until stopped.
+func (d *srvDiscovery) Start(valkey.Client) {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.refresh()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *srvDiscovery) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// refresh resolves the records again. The previous targets are kept when the
+// records can not be resolved, as that is more likely a problem of the DNS.
+func (d *srvDiscovery) refresh() {
+	targets, err := d.lookup(d.name)
+	if err != nil {
+		d.logger.Warn("resolving srv records failed, keeping the previous targets", zap.Error(err))
+		return
+	}
+
+	added, removed, reconnecting := d.update(targets)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	d.logger.Info("srv records changed",
+		zap.Strings("targets", targets),
+		zap.Strings("added", added),
+		zap.Strings("removed", removed),
+		zap.Int("reconnecting", reconnecting),
+	)
+
+	if d.replica && len(targets) > d.slotCount {
+		d.logger.Warn("more replicas published than when connecting, reload the config to use all of them", zap.Int("replicas", len(targets)), zap.Int("slots", d.slotCount))
+	}
+}
+
+// ReplicaDiscoveryConfig enables the discovery of the replicas connected to a
+// standalone primary through `INFO replication`.
+type ReplicaDiscoveryConfig struct {
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Replicas lagging behind the primary for longer are skipped
+	MaxLag caddy.Duration `json:"max_lag,omitempty"`
+
+	// The number of replica connections, which are spread over the replicas
+	Connections int `json:"connections,omitempty"`
+}
+
+func (c *ReplicaDiscoveryConfig) validate() error {
+	if c.Interval < 0 || c.MaxLag < 0 {
+		return errors.New("impossible value for `replica_discovery.interval` or `replica_discovery.max_lag` option (value >= 0 required)")
+	}
+
+	if c.Connections < 0 {
+		return errors.New("impossible value for `replica_discovery.connections` option (value >= 0 required)")
+	}
+
+	return nil
+}
+
+// replicaDiscovery asks the primary for its replicas. The client is given a
+// fixed number of replica slots, which are connected to the primary until the
+// first replicas are discovered and whenever no replica is available.
+type replicaDiscovery struct {
+	*addressMapping
+
+	interval    time.Duration
+	maxLag      time.Duration
+	connections int
+	logger      *zap.Logger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newReplicaDiscovery(config ReplicaDiscoveryConfig, primary string, logger *zap.Logger) *replicaDiscovery {
+	d := &replicaDiscovery{
+		addressMapping: newAddressMapping(REPLICA_DISCOVERY_NAME, primary, nil),
+
+		interval:    time.Duration(config.Interval),
+		maxLag:      time.Duration(config.MaxLag),
+		connections: config.Connections,
+		logger:      logger.Named("replica_discovery"),
+
+		stop: make(chan struct{}),
+	}
+
+	if d.interval == 0 {
+		d.interval = DEFAULT_REPLICA_DISCOVERY_INTERVAL
+	}
+	if d.maxLag == 0 {
+		d.maxLag = DEFAULT_REPLICA_DISCOVERY_MAX_LAG
+	}
+	if d.connections == 0 {
+		d.connections = DEFAULT_REPLICA_DISCOVERY_CONNECTIONS
+	}
+
+	return d
+}
+
+// addresses returns the replica slots given to the client.
+func (d *replicaDiscovery) addresses() []string {
+	return d.slots(d.connections)
+}
+
+// Start discovers the replicas right away and then periodically until stopped.
+// Only reads are sent to replicas, so the client of the storage asks the primary.
+func (d *replicaDiscovery) Start(client valkey.Client) {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			d.refresh(client)
+
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *replicaDiscovery) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// refresh asks the primary for its replicas. The previous replicas are kept
+// when the primary can not be asked.
+func (d *replicaDiscovery) refresh(client valkey.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_DISCOVERY_TIMEOUT)
+	defer cancel()
+
+	info, err := client.Do(ctx, client.B().Info().Section("replication").Build()).ToString()
+	if err != nil {
+		d.logger.Warn("discovering replicas failed, keeping the previous replicas", zap.Error(err))
+		return
+	}
+
+	replicas, skipped := parseReplicationInfo(info, d.maxLag)
+
+	added, removed, reconnecting := d.update(replicas)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	d.logger.Info("replicas changed",
+		zap.Strings("replicas", replicas),
+		zap.Strings("added", added),
+		zap.Strings("removed", removed),
+		zap.Strings("skipped", skipped),
+		zap.Int("reconnecting", reconnecting),
+	)
+
+	if len(replicas) == 0 {
+		d.logger.Warn("no replica available, sending reads to the primary")
+	} else if len(replicas) > d.connections {
+		d.logger.Warn("more replicas than replica connections, some replicas are not used", zap.Int("replicas", len(replicas)), zap.Int("connections", d.connections))
+	}
+}
+
+// parseReplicationInfo returns the addresses of the online replicas listed by
+// `INFO replication`, sorted for a stable order, and the addresses of the
+// replicas skipped as they are not online or lag behind for too long.
+//
+// Replicas are listed as `slave0:ip=10.0.0.2,port=6379,state=online,offset=42,lag=0`.
+func parseReplicationInfo(info string, maxLag time.Duration) ([]string, []string) {
+	var replicas, skipped []string
+
+	for line := range strings.Lines(info) {
+		name, fields, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found || !strings.HasPrefix(name, "slave") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, "slave")); err != nil {
+			continue
+		}
+
+		values := map[string]string{}
+		for field := range strings.SplitSeq(fields, ",") {
+			key, value, _ := strings.Cut(field, "=")
+			values[key] = value
+		}
+
+		if len(values["ip"]) == 0 || len(values["port"]) == 0 {
+			continue
+		}
+		address := net.JoinHostPort(values["ip"], values["port"])
+
+		lag, err := strconv.Atoi(values["lag"])
+		if values["state"] != "online" || err != nil || time.Duration(lag)*time.Second > maxLag {
+			skipped = append(skipped, address)
+			continue
+		}
+
+		replicas = append(replicas, address)
+	}
+
+	slices.Sort(replicas)
+
+	return replicas, skipped
+}
+
+var (
+	_ ConnectionWatcher = (*srvDiscovery)(nil)
+	_ ConnectionWatcher = (*replicaDiscovery)(nil)
+)
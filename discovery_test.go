@@ -0,0 +1,371 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDns answers SRV queries with the records currently set for a name.
+type fakeDns struct {
+	address string
+
+	mu      sync.Mutex
+	records map[string][]net.SRV
+}
+
+func newFakeDns(t *testing.T) *fakeDns {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	d := &fakeDns{
+		address: conn.LocalAddr().String(),
+		records: map[string][]net.SRV{},
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if reply, err := d.reply(buf[:n]); err == nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	return d
+}
+
+// resolver returns a resolver asking only this server.
+func (d *fakeDns) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", d.address)
+		},
+	}
+}
+
+func (d *fakeDns) set(name string, records ...net.SRV) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.records[name] = records
+}
+
+func (d *fakeDns) reply(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	records, found := d.records[strings.TrimSuffix(question.Name.String(), ".")]
+	d.mu.Unlock()
+
+	header.Response = true
+	header.Authoritative = true
+	if !found {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	if question.Type == dnsmessage.TypeSRV {
+		for _, record := range records {
+			resource := dnsmessage.SRVResource{
+				Priority: record.Priority,
+				Weight:   record.Weight,
+				Port:     record.Port,
+				Target:   dnsmessage.MustNewName(record.Target),
+			}
+			resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 1}
+			if err := builder.SRVResource(resourceHeader, resource); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return builder.Finish()
+}
+
+func TestSrvDiscoveryOrdersByPriorityAndWeight(t *testing.T) {
+	dns := newFakeDns(t)
+	dns.set("_valkey._tcp.example.com",
+		net.SRV{Target: "backup.example.com.", Port: 6379, Priority: 20, Weight: 100},
+		net.SRV{Target: "light.example.com.", Port: 6379, Priority: 10, Weight: 5},
+		net.SRV{Target: "heavy-b.example.com.", Port: 6380, Priority: 10, Weight: 50},
+		net.SRV{Target: "heavy-a.example.com.", Port: 6379, Priority: 10, Weight: 50},
+		net.SRV{Target: "heavy-a.example.com.", Port: 6379, Priority: 30, Weight: 1},
+	)
+
+	discovery, err := newSrvDiscovery("_valkey._tcp.example.com", true, time.Minute, dns.resolver(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowest priority first, then highest weight, equal records by name; duplicates are dropped
+	expected := []string{"heavy-a.example.com:6379", "heavy-b.example.com:6380", "light.example.com:6379", "backup.example.com:6379"}
+	if !slices.Equal(discovery.targets, expected) {
+		t.Fatalf("expected targets %v, got %v", expected, discovery.targets)
+	}
+
+	// The order is stable, so resolving the same records again changes nothing
+	added, removed, closed := discovery.update(slices.Clone(expected))
+	if len(added) != 0 || len(removed) != 0 || closed != 0 {
+		t.Fatal("expected unchanged records to be recognized")
+	}
+
+	if _, err := newSrvDiscovery("_valkey._tcp.missing.example.com", false, time.Minute, dns.resolver(), zap.NewNop()); err == nil {
+		t.Fatal("expected missing records to be rejected")
+	}
+}
+
+func TestSrvDiscoveryMapsAddresses(t *testing.T) {
+	primary := newFakeValkey(t)
+	secondary := newFakeValkey(t)
+
+	// The dial function connects the published names to the fake servers
+	hosts := map[string]string{
+		"valkey-1.example.com:6379": primary.address,
+		"valkey-2.example.com:6379": secondary.address,
+	}
+	var mu sync.Mutex
+	var dialed []string
+	next := func(ctx context.Context, address string, dialer *net.Dialer, _ *tls.Config) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+
+		target, ok := hosts[address]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return dialer.DialContext(ctx, "tcp", target)
+	}
+
+	dns := newFakeDns(t)
+	dns.set("_valkey._tcp.example.com",
+		net.SRV{Target: "valkey-0.example.com.", Port: 6379, Priority: 0},
+		net.SRV{Target: "valkey-1.example.com.", Port: 6379, Priority: 10},
+		net.SRV{Target: "valkey-2.example.com.", Port: 6379, Priority: 20},
+	)
+
+	discovery, err := newSrvDiscovery("_valkey._tcp.example.com", false, time.Minute, dns.resolver(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := discovery.addresses(); !slices.Equal(addresses, []string{"_valkey._tcp.example.com"}) {
+		t.Fatalf("expected the name as address, got %v", addresses)
+	}
+
+	storage, err := NewCaddyStorageValkey(valkey.ClientOption{
+		InitAddress: discovery.addresses(),
+		DialCtxFn:   discovery.dialCtxFn(next),
+	}, CaddyStorageValkeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	// Unreachable targets are skipped in the order of their priority
+	ctx := context.Background()
+	if err := storage.Store(ctx, "certificates/before.crt", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.received("HMSET")) != 1 || len(secondary.received("HMSET")) != 0 {
+		t.Fatal("expected store to be sent to the first reachable target")
+	}
+	mu.Lock()
+	if len(dialed) < 2 || dialed[0] != "valkey-0.example.com:6379" || dialed[1] != "valkey-1.example.com:6379" {
+		t.Fatalf("unexpected dialed targets %v", dialed)
+	}
+	mu.Unlock()
+
+	// Once the records change, the client reconnects to the new target
+	dns.set("_valkey._tcp.example.com", net.SRV{Target: "valkey-2.example.com.", Port: 6379})
+	discovery.refresh()
+	if !slices.Equal(discovery.targets, []string{"valkey-2.example.com:6379"}) {
+		t.Fatalf("unexpected targets after refresh %v", discovery.targets)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(secondary.received("HMSET")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected stores to be sent to the new target")
+		}
+		storage.Store(ctx, "certificates/after.crt", []byte("after"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Failed lookups keep the previous targets
+	dns.set("_valkey._tcp.example.com")
+	discovery.refresh()
+	if !slices.Equal(discovery.targets, []string{"valkey-2.example.com:6379"}) {
+		t.Fatalf("expected previous targets to be kept, got %v", discovery.targets)
+	}
+}
+
+func TestSrvDiscoverySpreadsReplicaSlots(t *testing.T) {
+	dns := newFakeDns(t)
+	dns.set("_valkey-replica._tcp.example.com",
+		net.SRV{Target: "replica-1.example.com.", Port: 6379, Weight: 20},
+		net.SRV{Target: "replica-2.example.com.", Port: 6379, Weight: 10},
+	)
+
+	discovery, err := newSrvDiscovery("_valkey-replica._tcp.example.com", true, time.Minute, dns.resolver(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := discovery.addresses()
+	if !slices.Equal(addresses, []string{"_valkey-replica._tcp.example.com#0", "_valkey-replica._tcp.example.com#1"}) {
+		t.Fatalf("expected a slot for each replica, got %v", addresses)
+	}
+
+	// A replica removed later leaves its slot to the remaining ones
+	discovery.update([]string{"replica-2.example.com:6379"})
+
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+	for _, address := range addresses {
+		if candidates := discovery.candidates(address); !slices.Equal(candidates, []string{"replica-2.example.com:6379"}) {
+			t.Fatalf("unexpected candidates of %s: %v", address, candidates)
+		}
+	}
+	if candidates := discovery.candidates("other.example.com:6379"); candidates != nil {
+		t.Fatalf("expected other addresses to be passed through, got %v", candidates)
+	}
+}
+
+func TestParseReplicationInfo(t *testing.T) {
+	info := strings.Join([]string{
+		"# Replication",
+		"role:master",
+		"connected_slaves:6",
+		"slave_read_only:1",
+		"slave2:ip=10.0.0.3,port=6379,state=online,offset=42,lag=0",
+		"slave0:ip=10.0.0.2,port=6380,state=online,offset=42,lag=1",
+		"slave1:ip=10.0.0.4,port=6379,state=online,offset=10,lag=30",
+		"slave3:ip=10.0.0.5,port=6379,state=wait_bgsave,offset=0,lag=0",
+		"slave4:ip=fd00::6,port=6379,state=online,offset=42,lag=0",
+		"slave5:ip=10.0.0.7,port=6379,state=online,offset=42",
+		"slave6:port=6379,state=online,offset=42,lag=0",
+		"master_repl_offset:42",
+		"",
+	}, "\r\n")
+
+	replicas, skipped := parseReplicationInfo(info, 10*time.Second)
+
+	// Replicas lagging behind, not online or without a lag are skipped
+	if expected := []string{"10.0.0.2:6380", "10.0.0.3:6379", "[fd00::6]:6379"}; !slices.Equal(replicas, expected) {
+		t.Fatalf("expected replicas %v, got %v", expected, replicas)
+	}
+	if expected := []string{"10.0.0.4:6379", "10.0.0.5:6379", "10.0.0.7:6379"}; !slices.Equal(skipped, expected) {
+		t.Fatalf("expected skipped replicas %v, got %v", expected, skipped)
+	}
+
+	// A larger maximum lag keeps the lagging replica
+	if replicas, _ := parseReplicationInfo(info, time.Minute); !slices.Contains(replicas, "10.0.0.4:6379") {
+		t.Fatalf("expected the lagging replica within the maximum lag, got %v", replicas)
+	}
+}
+
+// replicationInfo lists the given replicas as online like `INFO replication`.
+func replicationInfo(replicas ...*fakeValkey) string {
+	lines := []string{"# Replication", "role:master"}
+	for i, replica := range replicas {
+		host, port, _ := net.SplitHostPort(replica.address)
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=42,lag=0", i, host, port))
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func TestReplicaDiscoveryPicksUpAddedReplica(t *testing.T) {
+	primary := newFakeValkey(t)
+	first := newFakeValkey(t)
+	second := newFakeValkey(t)
+
+	info := replicationInfo(first)
+	primary.handle = func(args []string) (string, bool) {
+		if strings.EqualFold(args[0], "INFO") {
+			return respBulk(info), true
+		}
+		return "", false
+	}
+
+	m := StorageValkeyModule{
+		InitAddress:    []string{primary.address},
+		SendToReplicas: "readonly",
+		ReplicaDiscovery: &ReplicaDiscoveryConfig{
+			Interval:    caddy.Duration(50 * time.Millisecond),
+			Connections: 2,
+		},
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Cleanup() })
+
+	// readUntil loads until the replica received a read
+	readUntil := func(replica *fakeValkey) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(replica.received("HGET")) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected reads to be sent to the replica %s", replica.address)
+			}
+			m.storage.Load(context.Background(), "certificates/example.crt")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	readUntil(first)
+
+	// The replica added after connecting takes over the free replica connection
+	primary.mu.Lock()
+	info = replicationInfo(first, second)
+	primary.mu.Unlock()
+
+	readUntil(second)
+}
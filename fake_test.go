@@ -0,0 +1,449 @@
+package caddystoragevalkey
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/valkey-io/valkey-go"
+)
+
+// fakeValkey is a valkey server speaking enough RESP for the storage and the
+// locker, which keeps everything in memory.
+type fakeValkey struct {
+	address string
+
+	mu       sync.Mutex
+	strings  map[string]string
+	hashes   map[string]map[string]string
+	commands [][]string
+	hellos   [][]string
+	conns    int
+	open     map[net.Conn]struct{}
+
+	// handle replies to a command instead of the default handling, when it
+	// returns true
+	handle func(args []string) (string, bool)
+}
+
+func newFakeValkey(t testing.TB) *fakeValkey {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newFakeValkeyOn(t, listener)
+}
+
+// newFakeValkeyOn serves the fake on the given listener, e.g. of a unix socket.
+func newFakeValkeyOn(t testing.TB, listener net.Listener) *fakeValkey {
+	t.Helper()
+
+	f := &fakeValkey{
+		address: listener.Addr().String(),
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		open:    map[net.Conn]struct{}{},
+	}
+	f.serve(t, listener)
+
+	return f
+}
+
+// serve accepts connections on the listener until the test is done.
+func (f *fakeValkey) serve(t testing.TB, listener net.Listener) {
+	t.Cleanup(func() {
+		listener.Close()
+		f.disconnect()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			f.mu.Lock()
+			f.open[conn] = struct{}{}
+			f.conns++
+			f.mu.Unlock()
+
+			go f.serveConn(conn)
+		}
+	}()
+}
+
+// disconnect closes all open connections, like a restarted server.
+func (f *fakeValkey) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for conn := range f.open {
+		conn.Close()
+		delete(f.open, conn)
+	}
+}
+
+func (f *fakeValkey) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		if _, err := io.WriteString(conn, f.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(elements ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(elements), strings.Join(elements, ""))
+}
+
+const (
+	respOk  = "+OK\r\n"
+	respNil = "_\r\n"
+)
+
+// received returns all commands received with the given name.
+func (f *fakeValkey) received(name string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := [][]string{}
+	for _, args := range f.commands {
+		if strings.EqualFold(args[0], name) {
+			r = append(r, args)
+		}
+	}
+
+	return r
+}
+
+func (f *fakeValkey) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commands = append(f.commands, args)
+
+	if f.handle != nil {
+		if reply, ok := f.handle(args); ok {
+			return reply
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		f.hellos = append(f.hellos, args)
+		return "%4\r\n" + respBulk("server") + respBulk("valkey") + respBulk("version") + respBulk("8.0.0") +
+			respBulk("proto") + ":3\r\n" + respBulk("role") + respBulk("master")
+	case "CLUSTER":
+		return "-ERR This instance has cluster support disabled\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "ROLE":
+		return respArray(respBulk("master"), ":0\r\n", respArray())
+	case "INFO":
+		return respBulk("# Replication\r\nrole:master\r\nmaster_repl_offset:0\r\n")
+	case "GET":
+		if value, ok := f.strings[args[1]]; ok {
+			return respBulk(value)
+		}
+		return respNil
+	case "SET":
+		return f.set(args)
+	case "HMSET", "HSET":
+		hash := f.hashes[args[1]]
+		if hash == nil {
+			hash = map[string]string{}
+			f.hashes[args[1]] = hash
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			hash[args[i]] = args[i+1]
+		}
+		return respOk
+	case "HGET":
+		if value, ok := f.hashes[args[1]][args[2]]; ok {
+			return respBulk(value)
+		}
+		return respNil
+	case "HMGET":
+		elements := []string{}
+		for _, field := range args[2:] {
+			if value, ok := f.hashes[args[1]][field]; ok {
+				elements = append(elements, respBulk(value))
+			} else {
+				elements = append(elements, respNil)
+			}
+		}
+		return respArray(elements...)
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if f.delete(key) {
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			if f.exists(key) {
+				found++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", found)
+	case "SCAN":
+		return f.scan(args)
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	case "EVAL":
+		return f.eval(args)
+	}
+
+	return respOk
+}
+
+func (f *fakeValkey) exists(key string) bool {
+	_, isString := f.strings[key]
+	_, isHash := f.hashes[key]
+
+	return isString || isHash
+}
+
+func (f *fakeValkey) delete(key string) bool {
+	found := f.exists(key)
+	delete(f.strings, key)
+	delete(f.hashes, key)
+
+	return found
+}
+
+func (f *fakeValkey) set(args []string) string {
+	if slices.ContainsFunc(args[3:], func(arg string) bool { return strings.EqualFold(arg, "NX") }) && f.exists(args[1]) {
+		return respNil
+	}
+	f.strings[args[1]] = args[2]
+
+	return respOk
+}
+
+func (f *fakeValkey) scan(args []string) string {
+	match, scanType := "*", ""
+	for i := 2; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "TYPE":
+			scanType = args[i+1]
+		}
+	}
+
+	keys := []string{}
+	if scanType == "" || scanType == "hash" {
+		for key := range f.hashes {
+			keys = append(keys, key)
+		}
+	}
+	if scanType == "" || scanType == "string" {
+		for key := range f.strings {
+			keys = append(keys, key)
+		}
+	}
+
+	elements := []string{}
+	for _, key := range keys {
+		if ok, _ := path.Match(match, key); ok || strings.HasPrefix(key, strings.TrimSuffix(match, "*")) {
+			elements = append(elements, respBulk(key))
+		}
+	}
+
+	return respArray(respBulk("0"), respArray(elements...))
+}
+
+// eval runs the scripts of the locker, which are recognized by their commands.
+func (f *fakeValkey) eval(args []string) string {
+	script, key, value := args[1], args[3], args[4]
+
+	switch {
+	case strings.Contains(script, `"SET"`):
+		if strings.Contains(script, `"NX"`) && f.exists(key) {
+			return respNil
+		}
+		f.strings[key] = value
+		return respOk
+	case strings.Contains(script, `"DEL"`), strings.Contains(script, `"PEXPIREAT"`):
+		if f.strings[key] != value {
+			return ":0\r\n"
+		}
+		if strings.Contains(script, `"DEL"`) {
+			delete(f.strings, key)
+		}
+		return ":1\r\n"
+	}
+
+	return respNil
+}
+
+// newTestStorage connects a storage to the fake server.
+func newTestStorage(t testing.TB, f *fakeValkey, options CaddyStorageValkeyOptions) *CaddyStorageValkey {
+	t.Helper()
+
+	storage, err := NewCaddyStorageValkey(valkey.ClientOption{InitAddress: []string{f.address}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	return storage
+}
+
+// memoryStorage is a storage keeping its entries in memory, which respects
+// the context like storages talking to a server do.
+type memoryStorage struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	modified map[string]time.Time
+	loaded   []string
+	deleted  []string
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{values: map[string][]byte{}, modified: map[string]time.Time{}}
+}
+
+func (s *memoryStorage) Lock(ctx context.Context, name string) error   { return ctx.Err() }
+func (s *memoryStorage) Unlock(ctx context.Context, name string) error { return nil }
+
+func (s *memoryStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.modified[key] = time.Now()
+
+	return nil
+}
+
+func (s *memoryStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = append(s.loaded, key)
+	value, ok := s.values[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return value, nil
+}
+
+func (s *memoryStorage) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, key)
+	if _, ok := s.values[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.values, key)
+
+	return nil
+}
+
+func (s *memoryStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Load(ctx, key)
+	return err == nil
+}
+
+func (s *memoryStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *memoryStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return certmagic.KeyInfo{Key: key, Modified: s.modified[key], Size: int64(len(value)), IsTerminal: true}, nil
+}
@@ -0,0 +1,521 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/valkey-io/valkey-go"
+)
+
+const (
+	// Entries are hashes with the value and its meta info, this is the default
+	LAYOUT_HASH = "hash"
+
+	// Entries as written by github.com/gamalan/caddy-tlsredis
+	LAYOUT_TLSREDIS                      = "tlsredis"
+	LAYOUT_TLSREDIS_DEFAULT_PREFIX       = "caddytls"
+	LAYOUT_TLSREDIS_DEFAULT_VALUE_PREFIX = "caddy-storage-redis"
+	LAYOUT_TLSREDIS_DEFAULT_AES_KEY      = "redistls-01234567890-caddytls-32"
+
+	// Entries as written by github.com/pberkel/caddy-storage-redis
+	LAYOUT_REDIS                = "redis"
+	LAYOUT_REDIS_DEFAULT_PREFIX = "caddy"
+)
+
+// ErrReadOnlyLayout is returned for writes to a storage using a read-only layout.
+var ErrReadOnlyLayout = errors.New("storage layout is read-only")
+
+// StorageLayout defines how the entries of the storage are kept in valkey. All
+// keys passed to the layout are storage keys, which the layout maps itself.
+type StorageLayout interface {
+	// Name identifies the layout in the configuration and logs
+	Name() string
+
+	// Key returns the valkey key holding the entry of the storage key
+	Key(key string) string
+
+	// StorageKey returns the storage key of a scanned valkey key, or false when
+	// the valkey key holds no entry of this layout
+	StorageKey(key string) (string, bool)
+
+	// ScanType is the valkey type of all keys holding entries
+	ScanType() string
+
+	// ReadOnly reports whether entries can only be read, but not changed
+	ReadOnly() bool
+
+	// Load and Stat return fs.ErrNotExist for missing entries
+	Store(ctx context.Context, client valkey.Client, key string, value []byte, modified time.Time) error
+	Load(ctx context.Context, client valkey.Client, key string) ([]byte, error)
+	Stat(ctx context.Context, client valkey.Client, key string) (certmagic.KeyInfo, error)
+}
+
+// StorageLayoutConfig selects and configures the layout of the storage.
+type StorageLayoutConfig struct {
+	Name     string `json:"name,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	// Only used by the tlsredis layout
+	AesKey      string `json:"aes_key,omitempty"`
+	ValuePrefix string `json:"value_prefix,omitempty"`
+}
+
+func (l *StorageLayoutConfig) validate() error {
+	switch l.Name {
+	case "", LAYOUT_HASH:
+		break
+	case LAYOUT_TLSREDIS:
+		// The AES key needs to select AES-128, AES-192 or AES-256
+		switch len(l.AesKey) {
+		case 0, 16, 24, 32:
+			break
+		default:
+			return errors.New("invalid length of `aes_key` for layout (16, 24 or 32 bytes required)")
+		}
+	case LAYOUT_REDIS:
+		break
+	default:
+		return errors.New("invalid value for `layout`")
+	}
+
+	if l.Name != LAYOUT_TLSREDIS && (len(l.AesKey) > 0 || len(l.ValuePrefix) > 0) {
+		return errors.New("`aes_key` and `value_prefix` are only supported by the `tlsredis` layout")
+	}
+
+	return nil
+}
+
+// newStorageLayout creates the layout of the given config, where a missing
+// config results in the default hash layout.
+func newStorageLayout(config *StorageLayoutConfig) (StorageLayout, error) {
+	if config == nil {
+		return hashLayout{}, nil
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var layout StorageLayout
+
+	switch config.Name {
+	case "", LAYOUT_HASH:
+		layout = hashLayout{prefix: config.Prefix}
+	case LAYOUT_TLSREDIS:
+		tlsredis := tlsredisLayout{
+			jsonLayout:  jsonLayout{prefix: config.Prefix},
+			valuePrefix: config.ValuePrefix,
+			aesKey:      []byte(config.AesKey),
+		}
+
+		if len(tlsredis.prefix) == 0 {
+			tlsredis.prefix = LAYOUT_TLSREDIS_DEFAULT_PREFIX
+		}
+		if len(tlsredis.valuePrefix) == 0 {
+			tlsredis.valuePrefix = LAYOUT_TLSREDIS_DEFAULT_VALUE_PREFIX
+		}
+		if len(tlsredis.aesKey) == 0 {
+			tlsredis.aesKey = []byte(LAYOUT_TLSREDIS_DEFAULT_AES_KEY)
+		}
+
+		layout = tlsredis
+	case LAYOUT_REDIS:
+		redis := redisLayout{jsonLayout{prefix: config.Prefix}}
+
+		if len(redis.prefix) == 0 {
+			redis.prefix = LAYOUT_REDIS_DEFAULT_PREFIX
+		}
+
+		layout = redis
+	}
+
+	if config.ReadOnly {
+		layout = readOnlyLayout{layout}
+	}
+
+	return layout, nil
+}
+
+// hashLayout stores every entry as hash with its value and meta info, directly
+// under the storage key or below the optional prefix.
+type hashLayout struct {
+	prefix string
+}
+
+func (hashLayout) Name() string {
+	return LAYOUT_HASH
+}
+
+func (l hashLayout) Key(key string) string {
+	if len(l.prefix) == 0 {
+		return key
+	}
+
+	return path.Join(l.prefix, key)
+}
+
+func (l hashLayout) StorageKey(key string) (string, bool) {
+	if len(l.prefix) > 0 {
+		return strings.CutPrefix(key, l.prefix+"/")
+	}
+
+	// The keys of the locker are no entries of the storage
+	return key, !strings.HasPrefix(key, LOCKER_PREFIX+":")
+}
+
+func (hashLayout) ScanType() string {
+	return "hash"
+}
+
+func (hashLayout) ReadOnly() bool {
+	return false
+}
+
+func (l hashLayout) Store(ctx context.Context, client valkey.Client, key string, value []byte, modified time.Time) error {
+	// Store the key and value with metdata
+	return client.Do(
+		ctx,
+		client.B().Hmset().
+			Key(l.Key(key)).
+			FieldValue().
+			FieldValue(ENTRY_KEY_VALUE, string(value[:])).
+			FieldValue(ENTRY_KEY_LASTMODIFIED, modified.Format(TIMEFORMAT)).
+			FieldValue(ENTRY_KEY_SIZE, fmt.Sprint(len(value))).Build()).Error()
+}
+
+func (l hashLayout) Load(ctx context.Context, client valkey.Client, key string) ([]byte, error) {
+	// Get only the value from valkey without meta info
+	value, err := client.Do(
+		ctx,
+		client.B().Hget().
+			Key(l.Key(key)).
+			Field(ENTRY_KEY_VALUE).Build()).AsBytes()
+
+	// Caddy expects a specific fs Error for when the key is not present, other
+	// errors are returned as is, so they are not mistaken for a missing key
+	if valkey.IsValkeyNil(err) {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	return value, nil
+}
+
+func (l hashLayout) Stat(ctx context.Context, client valkey.Client, key string) (certmagic.KeyInfo, error) {
+	// Minimal keyinfo (IsTerminal is always true, as we only create files, no directories)
+	info := certmagic.KeyInfo{Key: key, IsTerminal: true}
+
+	// Get meta info for key
+	value, err := client.Do(
+		ctx,
+		client.B().Hmget().
+			Key(l.Key(key)).
+			Field(ENTRY_KEY_LASTMODIFIED, ENTRY_KEY_SIZE).Build()).ToArray()
+
+	if err != nil {
+		return info, err
+	}
+
+	if len(value) != 2 {
+		return info, fmt.Errorf("unexpected return length of reading values for key '%s'", key)
+	}
+
+	// A missing key has no meta info at all
+	if value[0].IsNil() {
+		return info, fs.ErrNotExist
+	}
+
+	// Parse last modified
+	lastModifiedRaw, err := value[0].ToString()
+	if err != nil {
+		return info, err
+	}
+
+	lastModified, err := time.Parse(TIMEFORMAT, lastModifiedRaw)
+	if err != nil {
+		return info, err
+	}
+	info.Modified = lastModified
+
+	// Parse size
+	sizeRaw, err := value[1].ToString()
+	if err != nil {
+		return info, err
+	}
+
+	size, err := strconv.ParseInt(sizeRaw, 10, 64)
+	if err != nil {
+		return info, err
+	}
+	info.Size = size
+
+	return info, nil
+}
+
+// jsonLayout contains the key handling shared by all layouts storing every
+// entry as JSON string below a common key prefix.
+type jsonLayout struct {
+	prefix string
+}
+
+func (l jsonLayout) Key(key string) string {
+	return path.Join(l.prefix, key)
+}
+
+func (l jsonLayout) StorageKey(key string) (string, bool) {
+	storageKey, ok := strings.CutPrefix(key, l.prefix+"/")
+
+	return storageKey, ok
+}
+
+func (jsonLayout) ScanType() string {
+	return "string"
+}
+
+func (l jsonLayout) load(ctx context.Context, client valkey.Client, key string) ([]byte, error) {
+	raw, err := client.Do(ctx, client.B().Get().Key(l.Key(key)).Build()).AsBytes()
+	if valkey.IsValkeyNil(err) {
+		return nil, fs.ErrNotExist
+	}
+
+	return raw, err
+}
+
+// tlsredisEntry is the JSON encoding of a single entry of the tlsredis layout.
+type tlsredisEntry struct {
+	Value    []byte    `json:"value"`
+	Modified time.Time `json:"modified"`
+}
+
+// tlsredisLayout stores every entry as JSON string, prepended with a value prefix
+// and encrypted with AES-GCM. Unencrypted entries are accepted when reading.
+type tlsredisLayout struct {
+	jsonLayout
+
+	valuePrefix string
+	aesKey      []byte
+}
+
+func (tlsredisLayout) Name() string {
+	return LAYOUT_TLSREDIS
+}
+
+func (tlsredisLayout) ReadOnly() bool {
+	return false
+}
+
+func (l tlsredisLayout) Store(ctx context.Context, client valkey.Client, key string, value []byte, modified time.Time) error {
+	raw, err := json.Marshal(tlsredisEntry{Value: value, Modified: modified})
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := l.encrypt(append([]byte(l.valuePrefix), raw...))
+	if err != nil {
+		return err
+	}
+
+	return client.Do(ctx, client.B().Set().Key(l.Key(key)).Value(string(encrypted)).Build()).Error()
+}
+
+func (l tlsredisLayout) Load(ctx context.Context, client valkey.Client, key string) ([]byte, error) {
+	entry, err := l.loadEntry(ctx, client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.Value, nil
+}
+
+func (l tlsredisLayout) Stat(ctx context.Context, client valkey.Client, key string) (certmagic.KeyInfo, error) {
+	entry, err := l.loadEntry(ctx, client, key)
+	if err != nil {
+		return certmagic.KeyInfo{Key: key, IsTerminal: true}, err
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   entry.Modified,
+		Size:       int64(len(entry.Value)),
+		IsTerminal: true,
+	}, nil
+}
+
+func (l tlsredisLayout) loadEntry(ctx context.Context, client valkey.Client, key string) (tlsredisEntry, error) {
+	var entry tlsredisEntry
+
+	raw, err := l.load(ctx, client, key)
+	if err != nil {
+		return entry, err
+	}
+
+	// Only encrypted entries lack the value prefix in plain text
+	if !bytes.HasPrefix(raw, []byte(l.valuePrefix)) {
+		raw, err = l.decrypt(raw)
+		if err != nil {
+			return entry, fmt.Errorf("decrypting entry '%s': %v", key, err)
+		}
+
+		if !bytes.HasPrefix(raw, []byte(l.valuePrefix)) {
+			return entry, fmt.Errorf("invalid value prefix of entry '%s'", key)
+		}
+	}
+
+	if err := json.Unmarshal(raw[len(l.valuePrefix):], &entry); err != nil {
+		return entry, fmt.Errorf("decoding entry '%s': %v", key, err)
+	}
+
+	return entry, nil
+}
+
+func (l tlsredisLayout) encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := l.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	// The nonce is stored in front of the encrypted data
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (l tlsredisLayout) decrypt(ciphertext []byte) ([]byte, error) {
+	gcm, err := l.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (l tlsredisLayout) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(l.aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// redisEntry is the JSON encoding of a single entry of the redis layout.
+type redisEntry struct {
+	Value       []byte    `json:"value"`
+	Modified    time.Time `json:"modified"`
+	Size        int64     `json:"size"`
+	Compression int       `json:"compression"`
+	Encryption  int       `json:"encryption"`
+}
+
+// redisLayout reads entries stored as JSON strings. The directory index kept
+// next to the entries is not maintained, which is why the layout is read-only.
+type redisLayout struct {
+	jsonLayout
+}
+
+func (redisLayout) Name() string {
+	return LAYOUT_REDIS
+}
+
+func (l redisLayout) StorageKey(key string) (string, bool) {
+	storageKey, ok := l.jsonLayout.StorageKey(key)
+
+	// The locks are kept below the same prefix
+	return storageKey, ok && !strings.HasPrefix(storageKey, FILE_SYSTEM_LOCKS_PREFIX)
+}
+
+func (redisLayout) ReadOnly() bool {
+	return true
+}
+
+func (redisLayout) Store(ctx context.Context, client valkey.Client, key string, value []byte, modified time.Time) error {
+	return ErrReadOnlyLayout
+}
+
+func (l redisLayout) Load(ctx context.Context, client valkey.Client, key string) ([]byte, error) {
+	entry, err := l.loadEntry(ctx, client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.Value, nil
+}
+
+func (l redisLayout) Stat(ctx context.Context, client valkey.Client, key string) (certmagic.KeyInfo, error) {
+	entry, err := l.loadEntry(ctx, client, key)
+	if err != nil {
+		return certmagic.KeyInfo{Key: key, IsTerminal: true}, err
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   entry.Modified,
+		Size:       entry.Size,
+		IsTerminal: true,
+	}, nil
+}
+
+func (l redisLayout) loadEntry(ctx context.Context, client valkey.Client, key string) (redisEntry, error) {
+	var entry redisEntry
+
+	raw, err := l.load(ctx, client, key)
+	if err != nil {
+		return entry, err
+	}
+
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return entry, fmt.Errorf("decoding entry '%s': %v", key, err)
+	}
+
+	if entry.Compression != 0 || entry.Encryption != 0 {
+		return entry, fmt.Errorf("compressed or encrypted entry '%s' is not supported", key)
+	}
+
+	return entry, nil
+}
+
+// readOnlyLayout rejects all writes to the wrapped layout.
+type readOnlyLayout struct {
+	StorageLayout
+}
+
+func (readOnlyLayout) ReadOnly() bool {
+	return true
+}
+
+func (readOnlyLayout) Store(ctx context.Context, client valkey.Client, key string, value []byte, modified time.Time) error {
+	return ErrReadOnlyLayout
+}
+
+var (
+	_ StorageLayout = hashLayout{}
+	_ StorageLayout = tlsredisLayout{}
+	_ StorageLayout = redisLayout{}
+	_ StorageLayout = readOnlyLayout{}
+)
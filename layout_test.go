@@ -0,0 +1,189 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLayoutTestStorage(t *testing.T, f *fakeValkey, config StorageLayoutConfig) *CaddyStorageValkey {
+	t.Helper()
+
+	layout, err := newStorageLayout(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestStorage(t, f, CaddyStorageValkeyOptions{Layout: layout})
+}
+
+func TestTlsredisLayoutRoundTrip(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newLayoutTestStorage(t, server, StorageLayoutConfig{Name: LAYOUT_TLSREDIS})
+	ctx := context.Background()
+
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	if err := storage.StoreWithModified(ctx, "certificates/example.crt", []byte("certificate"), modified); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry is encrypted below the prefix of tlsredis
+	server.mu.Lock()
+	raw, ok := server.strings["caddytls/certificates/example.crt"]
+	server.mu.Unlock()
+	if !ok {
+		t.Fatal("expected the entry below the tlsredis prefix")
+	}
+	if strings.Contains(raw, LAYOUT_TLSREDIS_DEFAULT_VALUE_PREFIX) {
+		t.Fatal("expected the entry to be encrypted")
+	}
+
+	// Unencrypted entries written by tlsredis are read as well
+	plain, err := json.Marshal(tlsredisEntry{Value: []byte("key"), Modified: modified})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.strings["caddytls/certificates/example.key"] = LAYOUT_TLSREDIS_DEFAULT_VALUE_PREFIX + string(plain)
+	server.mu.Unlock()
+
+	for key, expected := range map[string]string{"certificates/example.crt": "certificate", "certificates/example.key": "key"} {
+		value, err := storage.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Fatalf("expected value %q of %s, got %q", expected, key, value)
+		}
+
+		info, err := storage.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Modified.Equal(modified) || info.Size != int64(len(expected)) {
+			t.Fatalf("unexpected info of %s: %+v", key, info)
+		}
+	}
+
+	keys, err := storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"certificates/example.crt", "certificates/example.key"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// Another AES key can not read the entries
+	other := newLayoutTestStorage(t, server, StorageLayoutConfig{Name: LAYOUT_TLSREDIS, AesKey: strings.Repeat("k", 32)})
+	if _, err := other.Load(ctx, "certificates/example.crt"); err == nil || !strings.Contains(err.Error(), "decrypting entry") {
+		t.Fatalf("expected the entry to be undecryptable with another key, got %v", err)
+	}
+}
+
+func TestRedisLayoutReadsDataset(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newLayoutTestStorage(t, server, StorageLayoutConfig{Name: LAYOUT_REDIS})
+	ctx := context.Background()
+
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	entry := func(value string, compression int) string {
+		raw, err := json.Marshal(redisEntry{Value: []byte(value), Modified: modified, Size: int64(len(value)), Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+
+	// The dataset as written by caddy-storage-redis, with its locks below the same prefix
+	server.mu.Lock()
+	server.strings["caddy/certificates/example.crt"] = entry("certificate", 0)
+	server.strings["caddy/certificates/compressed.crt"] = entry("certificate", 1)
+	server.strings["caddy/locks/issue_cert_example.com"] = "lock"
+	server.mu.Unlock()
+
+	value, err := storage.Load(ctx, "certificates/example.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "certificate" {
+		t.Fatalf("unexpected value %q", value)
+	}
+
+	info, err := storage.Stat(ctx, "certificates/example.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Modified.Equal(modified) || info.Size != int64(len("certificate")) {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	if _, err := storage.Load(ctx, "certificates/compressed.crt"); err == nil || !strings.Contains(err.Error(), "is not supported") {
+		t.Fatalf("expected compressed entries to be rejected, got %v", err)
+	}
+
+	keys, err := storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"certificates/compressed.crt", "certificates/example.crt"}) {
+		t.Fatalf("expected the locks not to be listed, got %v", keys)
+	}
+
+	// The layout is read-only
+	if err := storage.Store(ctx, "certificates/example.crt", []byte("other")); !errors.Is(err, ErrReadOnlyLayout) {
+		t.Fatalf("expected store to be rejected, got %v", err)
+	}
+	if err := storage.Delete(ctx, "certificates/example.crt"); !errors.Is(err, ErrReadOnlyLayout) {
+		t.Fatalf("expected delete to be rejected, got %v", err)
+	}
+	if len(server.received("SET")) != 0 || len(server.received("DEL")) != 0 {
+		t.Fatal("expected no writes with a read-only layout")
+	}
+}
+
+func TestStorageLayoutConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		config StorageLayoutConfig
+		err    string
+	}{
+		"hash": {
+			config: StorageLayoutConfig{Name: LAYOUT_HASH, Prefix: "caddy", ReadOnly: true},
+		},
+		"tlsredis": {
+			config: StorageLayoutConfig{Name: LAYOUT_TLSREDIS, AesKey: strings.Repeat("k", 16), ValuePrefix: "prefix"},
+		},
+		"unknown layout": {
+			config: StorageLayoutConfig{Name: "tlsredis2"},
+			err:    "invalid value for `layout`",
+		},
+		"aes key length": {
+			config: StorageLayoutConfig{Name: LAYOUT_TLSREDIS, AesKey: "short"},
+			err:    "invalid length of `aes_key` for layout (16, 24 or 32 bytes required)",
+		},
+		"aes key without tlsredis": {
+			config: StorageLayoutConfig{Name: LAYOUT_REDIS, AesKey: strings.Repeat("k", 16)},
+			err:    "`aes_key` and `value_prefix` are only supported by the `tlsredis` layout",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.config.validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_LOADER_RELOAD_INTERVAL = 10 * time.Minute
+)
+
+// LoaderClientCertificateConfig loads the client certificate for the TLS
+// connection with valkey with the certificate loaders of the caddy tls app,
+// like `load_files` or `load_folders`.
+type LoaderClientCertificateConfig struct {
+	LoadersRaw caddy.ModuleMap `json:"loaders,omitempty" caddy:"namespace=tls.certificates"`
+
+	// The tag of the certificate to use, otherwise the first loaded certificate is used
+	Tag string `json:"tag,omitempty"`
+
+	// The certificates are loaded again after this interval on the next new connection
+	ReloadInterval caddy.Duration `json:"reload_interval,omitempty"`
+}
+
+func (c *LoaderClientCertificateConfig) validate() error {
+	if len(c.LoadersRaw) == 0 {
+		return errors.New("the `tls_client_loader` block requires at least one loader")
+	}
+
+	if c.ReloadInterval < 0 {
+		return errors.New("impossible value for `tls_client_loader.reload_interval` option (value >= 0 required)")
+	}
+
+	return nil
+}
+
+// loaderClientCertificate loads the client certificate with certificate loaders
+// and loads it again after the reload interval, so renewed certificates are
+// used for new connections without a config reload.
+type loaderClientCertificate struct {
+	config  LoaderClientCertificateConfig
+	loaders []caddytls.CertificateLoader
+	logger  *zap.Logger
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	reloadAt    time.Time
+}
+
+func newLoaderClientCertificate(ctx caddy.Context, config LoaderClientCertificateConfig, logger *zap.Logger) (*loaderClientCertificate, error) {
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = caddy.Duration(DEFAULT_LOADER_RELOAD_INTERVAL)
+	}
+
+	// The storage loader reads from the global storage, which is not available
+	// while valkey itself is provisioned as the global storage
+	if _, ok := config.LoadersRaw["load_storage"]; ok && ctx.Storage() == nil {
+		return nil, errors.New("the `load_storage` loader of `tls_client_loader` can not be used when valkey is the global storage, as the client certificate is required to connect to valkey in the first place")
+	}
+
+	// Loading the modules clears the raw config
+	loadersConfig := config
+	val, err := ctx.LoadModule(&loadersConfig, "LoadersRaw")
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate loaders of `tls_client_loader`: %v", err)
+	}
+
+	// The loaders are used in a stable order
+	modules := val.(map[string]any)
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	loaders := make([]caddytls.CertificateLoader, 0, len(names))
+	for _, name := range names {
+		loader, ok := modules[name].(caddytls.CertificateLoader)
+		if !ok {
+			return nil, fmt.Errorf("module %s of `tls_client_loader` is not a certificate loader", name)
+		}
+		loaders = append(loaders, loader)
+	}
+
+	l := &loaderClientCertificate{
+		config:  config,
+		loaders: loaders,
+		logger:  logger.Named("loader"),
+	}
+
+	// Fail early on a missing certificate instead of on the first handshake
+	if _, err := l.getClientCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *loaderClientCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.certificate != nil && time.Now().Before(l.reloadAt) {
+		return l.certificate, nil
+	}
+
+	certificate, err := l.load()
+	if err != nil {
+		// Keep using the previous certificate while it is still valid
+		if l.certificate != nil && time.Now().Before(l.certificate.Leaf.NotAfter) {
+			l.logger.Error("loading client certificate failed, keeping the previous one", zap.Time("not_after", l.certificate.Leaf.NotAfter), zap.Error(err))
+			return l.certificate, nil
+		}
+
+		return nil, err
+	}
+
+	if l.certificate == nil || !bytes.Equal(l.certificate.Certificate[0], certificate.Certificate[0]) {
+		l.logger.Info("loaded client certificate",
+			zap.String("common_name", certificate.Leaf.Subject.CommonName),
+			zap.Time("not_after", certificate.Leaf.NotAfter),
+		)
+	}
+
+	l.certificate = certificate
+	l.reloadAt = time.Now().Add(time.Duration(l.config.ReloadInterval))
+
+	return certificate, nil
+}
+
+// load returns the first certificate loaded with the configured tag.
+func (l *loaderClientCertificate) load() (*tls.Certificate, error) {
+	for _, loader := range l.loaders {
+		certificates, err := loader.LoadCertificates()
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate of `tls_client_loader`: %v", err)
+		}
+
+		for _, certificate := range certificates {
+			if len(l.config.Tag) > 0 && !slices.Contains(certificate.Tags, l.config.Tag) {
+				continue
+			}
+			if len(certificate.Certificate.Certificate) == 0 {
+				continue
+			}
+
+			loaded := certificate.Certificate
+			if loaded.Leaf == nil {
+				leaf, err := x509.ParseCertificate(loaded.Certificate[0])
+				if err != nil {
+					return nil, fmt.Errorf("parsing client certificate of `tls_client_loader`: %v", err)
+				}
+				loaded.Leaf = leaf
+			}
+
+			return &loaded, nil
+		}
+	}
+
+	if len(l.config.Tag) > 0 {
+		return nil, fmt.Errorf("no client certificate with tag '%s' loaded by `tls_client_loader`", l.config.Tag)
+	}
+
+	return nil, errors.New("no client certificate loaded by `tls_client_loader`")
+}
@@ -0,0 +1,320 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+// fakeCertificateLoader returns the certificates currently set.
+type fakeCertificateLoader struct {
+	mu           sync.Mutex
+	certificates []caddytls.Certificate
+	err          error
+}
+
+func (l *fakeCertificateLoader) set(certificates []caddytls.Certificate, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.certificates = certificates
+	l.err = err
+}
+
+func (l *fakeCertificateLoader) LoadCertificates() ([]caddytls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.certificates, l.err
+}
+
+func TestLoaderClientCertificateReloadsRenewedCertificate(t *testing.T) {
+	ca := newTestCA(t, "loader ca")
+	first, _, _ := ca.issue(t, "caddy", nil, nil)
+	renewed, _, _ := ca.issue(t, "caddy", nil, nil)
+
+	loader := &fakeCertificateLoader{}
+	loader.set([]caddytls.Certificate{{Certificate: first}}, nil)
+
+	l := &loaderClientCertificate{
+		config:  LoaderClientCertificateConfig{ReloadInterval: caddy.Duration(time.Hour)},
+		loaders: []caddytls.CertificateLoader{loader},
+		logger:  zap.NewNop(),
+	}
+
+	certificate, err := l.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.Equal(first.Leaf) {
+		t.Fatal("expected the loaded certificate")
+	}
+
+	// The renewed certificate is only loaded after the reload interval
+	loader.set([]caddytls.Certificate{{Certificate: renewed}}, nil)
+	certificate, err = l.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.Equal(first.Leaf) {
+		t.Fatal("expected the certificate to be reused before the reload interval")
+	}
+
+	l.mu.Lock()
+	l.reloadAt = time.Now().Add(-time.Second)
+	l.mu.Unlock()
+
+	certificate, err = l.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.Equal(renewed.Leaf) {
+		t.Fatal("expected the renewed certificate after the reload interval")
+	}
+
+	// A failing loader keeps the valid certificate
+	loader.set(nil, errors.New("unavailable"))
+	l.mu.Lock()
+	l.reloadAt = time.Now().Add(-time.Second)
+	l.mu.Unlock()
+
+	certificate, err = l.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.Equal(renewed.Leaf) {
+		t.Fatal("expected the previous certificate while the loader fails")
+	}
+}
+
+func TestLoaderClientCertificateSelectsTag(t *testing.T) {
+	ca := newTestCA(t, "loader ca")
+	server, _, _ := ca.issue(t, "server", nil, nil)
+	client, _, _ := ca.issue(t, "caddy", nil, nil)
+
+	loader := &fakeCertificateLoader{}
+	loader.set([]caddytls.Certificate{{Certificate: server, Tags: []string{"server"}}, {Certificate: client, Tags: []string{"valkey"}}}, nil)
+
+	l := &loaderClientCertificate{
+		config:  LoaderClientCertificateConfig{Tag: "valkey", ReloadInterval: caddy.Duration(time.Hour)},
+		loaders: []caddytls.CertificateLoader{loader},
+		logger:  zap.NewNop(),
+	}
+
+	certificate, err := l.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Leaf.Subject.CommonName != "caddy" {
+		t.Fatalf("expected the certificate tagged valkey, got %s", certificate.Leaf.Subject.CommonName)
+	}
+
+	l = &loaderClientCertificate{
+		config:  LoaderClientCertificateConfig{Tag: "missing", ReloadInterval: caddy.Duration(time.Hour)},
+		loaders: []caddytls.CertificateLoader{loader},
+		logger:  zap.NewNop(),
+	}
+	if _, err := l.getClientCertificate(nil); err == nil || !strings.Contains(err.Error(), "no client certificate with tag 'missing'") {
+		t.Fatalf("expected error for missing tag, got %v", err)
+	}
+}
+
+func TestLoaderClientCertificateWithLoadFiles(t *testing.T) {
+	requireModuleLoading(t)
+
+	ca := newTestCA(t, "loader ca")
+	_, certPem, keyPem := ca.issue(t, "caddy", nil, nil)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeFile(t, certFile, certPem)
+	writeFile(t, keyFile, keyPem)
+
+	m := StorageValkeyModule{}
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`valkey {
+		tls_client_loader {
+			load_files ` + certFile + ` ` + keyFile + `
+			reload_interval 1m
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	l, err := newLoaderClientCertificate(ctx, *m.TlsClientLoader, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCertificate, _, _ := ca.issue(t, "server", nil, []net.IP{net.ParseIP("127.0.0.1")})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := newTestTlsServer(t, serverCertificate, clientCAs)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: rootCAs, GetClientCertificate: l.getClientCertificate}
+
+	for _, expected := range []string{"caddy", "caddy-renewed"} {
+		// A renewed certificate written to the files is used after the reload interval
+		if expected == "caddy-renewed" {
+			_, certPem, keyPem := ca.issue(t, expected, nil, nil)
+			writeFile(t, certFile, certPem)
+			writeFile(t, keyFile, keyPem)
+
+			l.mu.Lock()
+			l.reloadAt = time.Now().Add(-time.Second)
+			l.mu.Unlock()
+		}
+
+		if _, err := handshakeWith(server.address, tlsConfig); err != nil {
+			t.Fatalf("handshake with client certificate %s: %v", expected, err)
+		}
+
+		// The server finishes the handshake after the client
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if name := server.clientName.Load(); name != nil && *name == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected client certificate %s", expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestLoaderClientCertificateUnmarshalCaddyfile(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected *LoaderClientCertificateConfig
+		err      string
+	}{
+		"loaders": {
+			input: `valkey {
+				tls_client_loader {
+					load_files /etc/valkey/client.crt /etc/valkey/client.key
+					load_folders /etc/valkey/certs
+					load_storage valkey/client.crt valkey/client.key
+					tag valkey
+					reload_interval 5m
+				}
+			}`,
+			expected: &LoaderClientCertificateConfig{
+				LoadersRaw: caddy.ModuleMap{
+					"load_files":   []byte(`[{"certificate":"/etc/valkey/client.crt","key":"/etc/valkey/client.key"}]`),
+					"load_folders": []byte(`["/etc/valkey/certs"]`),
+					"load_storage": []byte(`{"pairs":[{"certificate":"valkey/client.crt","key":"valkey/client.key"}]}`),
+				},
+				Tag:            "valkey",
+				ReloadInterval: caddy.Duration(5 * time.Minute),
+			},
+		},
+		"missing key": {
+			input: `valkey {
+				tls_client_loader {
+					load_files /etc/valkey/client.crt
+				}
+			}`,
+			err: "expected a certificate and a key for `load_files`",
+		},
+		"unknown option": {
+			input: `valkey {
+				tls_client_loader {
+					load_pem cert key
+				}
+			}`,
+			err: "unknown tls_client_loader option 'load_pem'",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := StorageValkeyModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(m.TlsClientLoader.LoadersRaw) != len(test.expected.LoadersRaw) {
+				t.Fatalf("expected loaders %v, got %v", test.expected.LoadersRaw, m.TlsClientLoader.LoadersRaw)
+			}
+			for name, raw := range test.expected.LoadersRaw {
+				if string(m.TlsClientLoader.LoadersRaw[name]) != string(raw) {
+					t.Fatalf("expected %s loader %s, got %s", name, raw, m.TlsClientLoader.LoadersRaw[name])
+				}
+			}
+			m.TlsClientLoader.LoadersRaw = nil
+			test.expected.LoadersRaw = nil
+			if !reflect.DeepEqual(m.TlsClientLoader, test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, m.TlsClientLoader)
+			}
+		})
+	}
+}
+
+func TestLoaderClientCertificateValidate(t *testing.T) {
+	loader := &LoaderClientCertificateConfig{LoadersRaw: caddy.ModuleMap{"load_folders": []byte(`["/etc/valkey/certs"]`)}}
+	_, clientCert, _ := newTestCA(t, "ca").issue(t, "caddy", nil, nil)
+
+	tests := map[string]struct {
+		module StorageValkeyModule
+		err    string
+	}{
+		"valid": {
+			module: StorageValkeyModule{TlsClientLoader: loader},
+		},
+		"without loaders": {
+			module: StorageValkeyModule{TlsClientLoader: &LoaderClientCertificateConfig{}},
+			err:    "the `tls_client_loader` block requires at least one loader",
+		},
+		"with pki": {
+			module: StorageValkeyModule{TlsClientLoader: loader, TlsClientPki: &PkiClientCertificateConfig{}},
+			err:    "setting the `tls_client_loader` and `tls_client_pki` option is not allowed",
+		},
+		"with client certificate": {
+			module: StorageValkeyModule{TlsClientLoader: loader, TlsClientCert: string(clientCert)},
+			err:    "setting the `tls_client_loader` and `tls_client_cert` or `tls_client_key` option is not allowed",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The defaults are set by Provision, which runs first
+			test.module.LockMajority = 2
+
+			err := test.module.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package caddystoragevalkey
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valkey-io/valkey-go/valkeylock"
+)
+
+const (
+	METRICS_NAMESPACE = "caddy"
+	METRICS_SUBSYSTEM = "storage_valkey"
+
+	OPERATION_STORE  = "store"
+	OPERATION_LOAD   = "load"
+	OPERATION_DELETE = "delete"
+	OPERATION_EXISTS = "exists"
+	OPERATION_LIST   = "list"
+	OPERATION_STAT   = "stat"
+	OPERATION_LOCK   = "lock"
+	OPERATION_UNLOCK = "unlock"
+
+	OUTCOME_SUCCESS   = "success"
+	OUTCOME_NOT_FOUND = "not_found"
+	OUTCOME_CONTENDED = "contended"
+	OUTCOME_ERROR     = "error"
+)
+
+// The collectors are shared by all storage instances of this process, as caddy
+// creates a new metrics registry on every config load and we only want to
+// register the same collectors again instead of starting from zero.
+var storageMetrics = struct {
+	once sync.Once
+
+	operations         *prometheus.CounterVec
+	operationDuration  *prometheus.HistogramVec
+	locksHeld          prometheus.Gauge
+	listScanIterations prometheus.Histogram
+	bytesWritten       prometheus.Counter
+	bytesRead          prometheus.Counter
+	retries            *prometheus.CounterVec
+	circuitBreakerOpen *prometheus.GaugeVec
+
+	// The registry of the config, to which the collectors have been registered
+	registryMu sync.Mutex
+	registry   *prometheus.Registry
+}{}
+
+func initStorageMetrics() {
+	operationLabels := []string{"operation", "outcome"}
+
+	storageMetrics.once.Do(func() {
+		storageMetrics.operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "operations_total",
+			Help:      "Number of storage operations by operation and outcome.",
+		}, operationLabels)
+		storageMetrics.operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of storage operations by operation and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, operationLabels)
+		storageMetrics.locksHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "locks_held",
+			Help:      "Number of locks currently held by this process.",
+		})
+		storageMetrics.listScanIterations = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "list_scan_iterations",
+			Help:      "Number of SCAN iterations required per List call.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		})
+		storageMetrics.bytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "written_bytes_total",
+			Help:      "Number of value bytes written to the storage.",
+		})
+		storageMetrics.bytesRead = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "read_bytes_total",
+			Help:      "Number of value bytes read from the storage.",
+		})
+		storageMetrics.retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "retries_total",
+			Help:      "Number of storage operations retried after a transient error by operation.",
+		}, []string{"operation"})
+		storageMetrics.circuitBreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "circuit_breaker_open",
+			Help:      "Whether the circuit breaker currently fails all operations fast by address.",
+		}, []string{"address"})
+	})
+}
+
+// registerStorageMetrics registers the collectors once with the registry of a
+// config, which all storage modules of the config share.
+func registerStorageMetrics(registry *prometheus.Registry) error {
+	initStorageMetrics()
+
+	storageMetrics.registryMu.Lock()
+	defer storageMetrics.registryMu.Unlock()
+
+	if storageMetrics.registry == registry {
+		return nil
+	}
+
+	collectors := []prometheus.Collector{
+		storageMetrics.operations,
+		storageMetrics.operationDuration,
+		storageMetrics.locksHeld,
+		storageMetrics.listScanIterations,
+		storageMetrics.bytesWritten,
+		storageMetrics.bytesRead,
+		storageMetrics.retries,
+		storageMetrics.circuitBreakerOpen,
+	}
+	collectors = append(collectors, migrationCollectors()...)
+	collectors = append(collectors, mirrorCollectors()...)
+
+	for _, collector := range collectors {
+		// The collectors may have been registered with this registry before
+		// another one was used, e.g. by the storage modules of an older config
+		if err := registry.Register(collector); err != nil {
+			var alreadyRegistered prometheus.AlreadyRegisteredError
+			if !errors.As(err, &alreadyRegistered) {
+				return err
+			}
+		}
+	}
+	storageMetrics.registry = registry
+
+	return nil
+}
+
+func operationOutcome(err error) string {
+	switch {
+	case err == nil:
+		return OUTCOME_SUCCESS
+	case errors.Is(err, fs.ErrNotExist):
+		return OUTCOME_NOT_FOUND
+	case errors.Is(err, valkeylock.ErrNotLocked):
+		return OUTCOME_CONTENDED
+	default:
+		return OUTCOME_ERROR
+	}
+}
+
+func observeOperation(operation string, start time.Time, err error) {
+	outcome := operationOutcome(err)
+
+	storageMetrics.operations.WithLabelValues(operation, outcome).Inc()
+	storageMetrics.operationDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
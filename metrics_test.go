@@ -0,0 +1,177 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valkey-io/valkey-go/valkeylock"
+)
+
+// gatherValue returns the value of the counter or gauge with the given labels,
+// or the number of observations of a histogram.
+func gatherValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	if err := registerStorageMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+
+			switch family.GetType().String() {
+			case "GAUGE":
+				return metric.GetGauge().GetValue()
+			case "HISTOGRAM":
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+
+	// Collectors with labels are only gathered after their first observation
+	return 0
+}
+
+func TestMetricsRecordOperations(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	other := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	ctx := context.Background()
+
+	operations := func(operation string, outcome string) float64 {
+		return gatherValue(t, "caddy_storage_valkey_operations_total", map[string]string{"operation": operation, "outcome": outcome})
+	}
+
+	// Lock checks whether the lock is held locally with a nested exists
+	expected := map[[2]string]float64{
+		{OPERATION_STORE, OUTCOME_SUCCESS}:  1,
+		{OPERATION_LOAD, OUTCOME_SUCCESS}:   1,
+		{OPERATION_LOAD, OUTCOME_NOT_FOUND}: 1,
+		{OPERATION_EXISTS, OUTCOME_SUCCESS}: 3,
+		{OPERATION_STAT, OUTCOME_SUCCESS}:   1,
+		{OPERATION_LIST, OUTCOME_SUCCESS}:   1,
+		{OPERATION_DELETE, OUTCOME_SUCCESS}: 1,
+		{OPERATION_LOCK, OUTCOME_SUCCESS}:   1,
+		{OPERATION_LOCK, OUTCOME_CONTENDED}: 1,
+		{OPERATION_LOCK, OUTCOME_ERROR}:     0,
+		{OPERATION_UNLOCK, OUTCOME_SUCCESS}: 1,
+	}
+	before := map[[2]string]float64{}
+	for labels := range expected {
+		before[labels] = operations(labels[0], labels[1])
+	}
+	bytesWritten := gatherValue(t, "caddy_storage_valkey_written_bytes_total", nil)
+	bytesRead := gatherValue(t, "caddy_storage_valkey_read_bytes_total", nil)
+	scans := gatherValue(t, "caddy_storage_valkey_list_scan_iterations", nil)
+	loadDurations := gatherValue(t, "caddy_storage_valkey_operation_duration_seconds", map[string]string{"operation": OPERATION_LOAD, "outcome": OUTCOME_SUCCESS})
+	locksHeld := gatherValue(t, "caddy_storage_valkey_locks_held", nil)
+
+	if err := storage.Store(ctx, "certificates/example.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Load(ctx, "certificates/example.crt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Load(ctx, "certificates/missing.crt"); err == nil {
+		t.Fatal("expected missing key")
+	}
+	storage.Exists(ctx, "certificates/example.crt")
+	if _, err := storage.Stat(ctx, "certificates/example.crt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.List(ctx, "certificates", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(ctx, "certificates/example.crt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if held := gatherValue(t, "caddy_storage_valkey_locks_held", nil) - locksHeld; held != 1 {
+		t.Fatalf("expected 1 more lock held, got %v", held)
+	}
+
+	// The lock held by another instance is a contended lock, but no error
+	if err := other.Lock(ctx, "issue_cert_example.com"); !errors.Is(err, valkeylock.ErrNotLocked) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for labels, count := range expected {
+		if actual := operations(labels[0], labels[1]) - before[labels]; actual != count {
+			t.Errorf("expected %v %s operations with outcome %s, got %v", count, labels[0], labels[1], actual)
+		}
+	}
+
+	if written := gatherValue(t, "caddy_storage_valkey_written_bytes_total", nil) - bytesWritten; written != float64(len("certificate")) {
+		t.Errorf("expected %d bytes written, got %v", len("certificate"), written)
+	}
+	if read := gatherValue(t, "caddy_storage_valkey_read_bytes_total", nil) - bytesRead; read != float64(len("certificate")) {
+		t.Errorf("expected %d bytes read, got %v", len("certificate"), read)
+	}
+	if observed := gatherValue(t, "caddy_storage_valkey_list_scan_iterations", nil) - scans; observed != 1 {
+		t.Errorf("expected the SCAN iterations of 1 list, got %v", observed)
+	}
+	if observed := gatherValue(t, "caddy_storage_valkey_operation_duration_seconds", map[string]string{"operation": OPERATION_LOAD, "outcome": OUTCOME_SUCCESS}) - loadDurations; observed != 1 {
+		t.Errorf("expected the latency of 1 load, got %v", observed)
+	}
+	if held := gatherValue(t, "caddy_storage_valkey_locks_held", nil) - locksHeld; held != 0 {
+		t.Errorf("expected the lock to be released, got %v more locks held", held)
+	}
+}
+
+func TestMetricsRegisteredWithCaddyRegistry(t *testing.T) {
+	server := newFakeValkey(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	// Storage modules of the same config share the registry
+	modules := []*StorageValkeyModule{}
+	for range 2 {
+		m := &StorageValkeyModule{InitAddress: []string{server.address}}
+		if err := m.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { m.Cleanup() })
+		modules = append(modules, m)
+	}
+
+	if err := modules[0].storage.Store(context.Background(), "certificates/example.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := ctx.GetMetricsRegistry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "caddy_storage_valkey_operations_total" {
+			return
+		}
+	}
+	t.Fatal("expected the operations to be gathered from the metrics registry of the config")
+}
@@ -0,0 +1,126 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	MIGRATION_OUTCOME_HIT  = "hit"
+	MIGRATION_OUTCOME_MISS = "miss"
+)
+
+// Shows how many reads still need the old storage. Once no more hits are
+// recorded, every used entry has been migrated and the old storage can be retired.
+var migrationMetrics = struct {
+	once sync.Once
+
+	fallbackReads *prometheus.CounterVec
+	migratedKeys  prometheus.Counter
+}{}
+
+func initMigrationMetrics() {
+	migrationMetrics.once.Do(func() {
+		migrationMetrics.fallbackReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "migration_fallback_reads_total",
+			Help:      "Number of reads that missed in valkey and were checked in the storage migrated from.",
+		}, []string{"operation", "outcome"})
+		migrationMetrics.migratedKeys = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "migrated_keys_total",
+			Help:      "Number of keys copied from the storage migrated from into valkey.",
+		})
+	})
+}
+
+func migrationCollectors() []prometheus.Collector {
+	initMigrationMetrics()
+
+	return []prometheus.Collector{
+		migrationMetrics.fallbackReads,
+		migrationMetrics.migratedKeys,
+	}
+}
+
+func observeMigrationRead(operation string, found bool) {
+	outcome := MIGRATION_OUTCOME_MISS
+	if found {
+		outcome = MIGRATION_OUTCOME_HIT
+	}
+
+	migrationMetrics.fallbackReads.WithLabelValues(operation, outcome).Inc()
+}
+
+type withoutMigrationKey struct{}
+
+// withoutMigration returns a context, whose reads of entries missing in valkey
+// only read through to the storage migrated from without copying the entries,
+// e.g. for inspecting the storage.
+func withoutMigration(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutMigrationKey{}, true)
+}
+
+// migrateKey copies a single entry from the storage migrated from into valkey,
+// keeping its modification time. A missing entry is reported as fs.ErrNotExist.
+// With a read-only layout or a context without migration, the entry is returned
+// without copying it.
+func (c *CaddyStorageValkey) migrateKey(ctx context.Context, operation string, key string) ([]byte, certmagic.KeyInfo, error) {
+	value, err := c.migrateFrom.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		observeMigrationRead(operation, false)
+		return nil, certmagic.KeyInfo{}, fs.ErrNotExist
+	} else if err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+	observeMigrationRead(operation, true)
+
+	info, err := c.migrateFrom.Stat(ctx, key)
+	if err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+
+	// Read-only layouts only read through to the old storage
+	if c.layout.ReadOnly() || ctx.Value(withoutMigrationKey{}) != nil {
+		return value, info, nil
+	}
+
+	if err := c.StoreWithModified(ctx, key, value, info.Modified); err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+
+	migrationMetrics.migratedKeys.Inc()
+	c.logger.Info("migrated key from old storage", zap.String("key", key))
+
+	return value, info, nil
+}
+
+// listMigrationSource lists the keys of the storage migrated from. A prefix
+// missing in the old storage is no error, as it may only exist in valkey.
+func (c *CaddyStorageValkey) listMigrationSource(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := c.migrateFrom.List(ctx, prefix, recursive)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return keys, err
+}
+
+// deleteFromMigrationSource deletes the key in the storage migrated from, so
+// deleted entries are not migrated again with the next read.
+func (c *CaddyStorageValkey) deleteFromMigrationSource(ctx context.Context, key string) error {
+	err := c.migrateFrom.Delete(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
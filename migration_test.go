@@ -0,0 +1,137 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestExistsMigratesWithinReadTimeout(t *testing.T) {
+	server := newFakeValkey(t)
+	source := newMemoryStorage()
+	source.values["certificates/example.com.crt"] = []byte("certificate")
+
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{
+		ReadTimeout: time.Minute,
+		MigrateFrom: source,
+	})
+
+	if !storage.Exists(context.Background(), "certificates/example.com.crt") {
+		t.Fatal("expected key of the storage migrated from to exist")
+	}
+	if len(server.received("HMSET")) != 1 {
+		t.Fatal("expected key to be migrated into valkey")
+	}
+}
+
+func TestLockDoesNotReadMigrationSource(t *testing.T) {
+	server := newFakeValkey(t)
+	source := newMemoryStorage()
+
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{MigrateFrom: source})
+
+	if err := storage.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Unlock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(source.loaded) > 0 {
+		t.Fatalf("expected no reads of the storage migrated from, got %v", source.loaded)
+	}
+}
+
+func TestDeleteLeavesMigrationSourceUntouched(t *testing.T) {
+	for _, migrateDeletes := range []bool{false, true} {
+		server := newFakeValkey(t)
+		source := newMemoryStorage()
+		source.values["certificates/example.com.crt"] = []byte("certificate")
+
+		storage := newTestStorage(t, server, CaddyStorageValkeyOptions{
+			MigrateFrom:    source,
+			MigrateDeletes: migrateDeletes,
+		})
+
+		if err := storage.Delete(context.Background(), "certificates/example.com.crt"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, stillPresent := source.values["certificates/example.com.crt"]
+		if stillPresent == migrateDeletes {
+			t.Fatalf("expected the entry of the storage migrated from to be deleted only when enabled (enabled: %v)", migrateDeletes)
+		}
+	}
+}
+
+func TestReadOnlyLayoutReadsThroughMigrationSource(t *testing.T) {
+	server := newFakeValkey(t)
+	source := newMemoryStorage()
+	source.values["certificates/example.com.crt"] = []byte("certificate")
+
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{
+		Layout:      readOnlyLayout{hashLayout{}},
+		MigrateFrom: source,
+	})
+
+	value, err := storage.Load(context.Background(), "certificates/example.com.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "certificate" {
+		t.Fatalf("unexpected value %q", value)
+	}
+
+	info, err := storage.Stat(context.Background(), "certificates/example.com.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("certificate")) {
+		t.Fatalf("unexpected size %d", info.Size)
+	}
+
+	if !storage.Exists(context.Background(), "certificates/example.com.crt") {
+		t.Fatal("expected entry to exist")
+	}
+
+	if len(server.received("HMSET")) > 0 {
+		t.Fatal("expected no writes with a read-only layout")
+	}
+}
+
+func TestMigratedLoadRecordsBytesRead(t *testing.T) {
+	source := newMemoryStorage()
+	source.values["certificates/example.com.crt"] = []byte("certificate")
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	storage := newTestStorage(t, newFakeValkey(t), CaddyStorageValkeyOptions{
+		MigrateFrom:    source,
+		TracerProvider: provider,
+	})
+
+	bytesRead := gatherValue(t, "caddy_storage_valkey_read_bytes_total", nil)
+	if _, err := storage.Load(context.Background(), "certificates/example.com.crt"); err != nil {
+		t.Fatal(err)
+	}
+	if read := gatherValue(t, "caddy_storage_valkey_read_bytes_total", nil) - bytesRead; read != float64(len("certificate")) {
+		t.Fatalf("expected %d bytes read, got %v", len("certificate"), read)
+	}
+
+	for _, span := range exporter.GetSpans() {
+		if span.Name != SPAN_PREFIX+OPERATION_LOAD {
+			continue
+		}
+		if bytes := spanAttributes(span)[ATTRIBUTE_BYTES]; bytes != attribute.IntValue(len("certificate")) {
+			t.Fatalf("expected attribute %s of the migrated load to be %d, got %s", ATTRIBUTE_BYTES, len("certificate"), bytes.Emit())
+		}
+		return
+	}
+	t.Fatal("expected a load span")
+}
@@ -0,0 +1,292 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_MIRROR_QUEUE_SIZE = 1000
+
+	// Retries of a single mirror operation with an exponential backoff,
+	// starting with the initial delay and capped at the maximum delay.
+	MIRROR_MAX_ATTEMPTS     = 5
+	MIRROR_INITIAL_DELAY    = 500 * time.Millisecond
+	MIRROR_MAX_DELAY        = 10 * time.Second
+	MIRROR_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+	MIRROR_OUTCOME_SUCCESS = "success"
+	MIRROR_OUTCOME_FAILED  = "failed"
+	MIRROR_OUTCOME_DROPPED = "dropped"
+)
+
+var mirrorMetrics = struct {
+	once sync.Once
+
+	operations  *prometheus.CounterVec
+	queueLength prometheus.Gauge
+}{}
+
+func initMirrorMetrics() {
+	mirrorMetrics.once.Do(func() {
+		mirrorMetrics.operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "mirror_operations_total",
+			Help:      "Number of operations applied to the mirror storage by operation and outcome.",
+		}, []string{"operation", "outcome"})
+		mirrorMetrics.queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: METRICS_SUBSYSTEM,
+			Name:      "mirror_queue_length",
+			Help:      "Number of operations waiting to be applied to the mirror storage.",
+		})
+	})
+}
+
+func mirrorCollectors() []prometheus.Collector {
+	initMirrorMetrics()
+
+	return []prometheus.Collector{
+		mirrorMetrics.operations,
+		mirrorMetrics.queueLength,
+	}
+}
+
+// mirrorOperation is a single successful write to valkey, that still needs to
+// be applied to the mirror storage.
+type mirrorOperation struct {
+	key      string
+	value    []byte
+	modified time.Time
+	delete   bool
+}
+
+// modifiedStorage is a storage keeping a given modification time of an entry,
+// like this storage does.
+type modifiedStorage interface {
+	StoreWithModified(ctx context.Context, key string, value []byte, modified time.Time) error
+}
+
+// storeWithModified stores the value with the given modification time if the
+// storage supports it, so certmagic sees the same age of an entry in both.
+func storeWithModified(ctx context.Context, storage certmagic.Storage, key string, value []byte, modified time.Time) error {
+	if s, ok := storage.(modifiedStorage); ok {
+		return s.StoreWithModified(ctx, key, value, modified)
+	}
+
+	return storage.Store(ctx, key, value)
+}
+
+func (op mirrorOperation) name() string {
+	if op.delete {
+		return OPERATION_DELETE
+	}
+
+	return OPERATION_STORE
+}
+
+// storageMirror applies all writes asynchronously to a secondary storage. The
+// queue is bounded, so a slow or unavailable mirror never blocks the storage.
+// Dropped or failed operations are logged and can be fixed with a reconcile.
+type storageMirror struct {
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	queue  chan mirrorOperation
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	closed    bool
+}
+
+func newStorageMirror(storage certmagic.Storage, queueSize int, logger *zap.Logger) *storageMirror {
+	initMirrorMetrics()
+
+	if queueSize < 1 {
+		queueSize = DEFAULT_MIRROR_QUEUE_SIZE
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &storageMirror{
+		storage: storage,
+		logger:  logger.Named("mirror"),
+		queue:   make(chan mirrorOperation, queueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go m.run()
+
+	return m
+}
+
+func (m *storageMirror) enqueue(op mirrorOperation) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.queue <- op:
+		mirrorMetrics.queueLength.Inc()
+	default:
+		mirrorMetrics.operations.WithLabelValues(op.name(), MIRROR_OUTCOME_DROPPED).Inc()
+		m.logger.Warn("mirror queue is full, dropped operation", zap.String("operation", op.name()), zap.String("key", op.key))
+	}
+}
+
+func (m *storageMirror) run() {
+	defer close(m.done)
+
+	for op := range m.queue {
+		mirrorMetrics.queueLength.Dec()
+
+		if err := m.apply(op); err != nil {
+			mirrorMetrics.operations.WithLabelValues(op.name(), MIRROR_OUTCOME_FAILED).Inc()
+			m.logger.Error("failed to apply operation to mirror", zap.String("operation", op.name()), zap.String("key", op.key), zap.Error(err))
+		} else {
+			mirrorMetrics.operations.WithLabelValues(op.name(), MIRROR_OUTCOME_SUCCESS).Inc()
+		}
+	}
+}
+
+func (m *storageMirror) apply(op mirrorOperation) error {
+	delay := MIRROR_INITIAL_DELAY
+
+	var err error
+	for attempt := 1; attempt <= MIRROR_MAX_ATTEMPTS; attempt++ {
+		if op.delete {
+			err = m.storage.Delete(m.ctx, op.key)
+			// Deleting an already missing key leaves the mirror in the expected state
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = storeWithModified(m.ctx, m.storage, op.key, op.value, op.modified)
+		}
+
+		if err == nil || attempt == MIRROR_MAX_ATTEMPTS {
+			break
+		}
+
+		m.logger.Debug("retrying mirror operation", zap.String("key", op.key), zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-time.After(delay):
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		}
+		delay = min(delay*2, MIRROR_MAX_DELAY)
+	}
+
+	return err
+}
+
+// close stops accepting new operations and waits for the queued operations to
+// be applied, but at most for the shutdown timeout.
+func (m *storageMirror) close() {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		close(m.queue)
+		m.mu.Unlock()
+
+		select {
+		case <-m.done:
+		case <-time.After(MIRROR_SHUTDOWN_TIMEOUT):
+			m.logger.Warn("mirror did not finish in time, remaining operations are lost", zap.Int("remaining", len(m.queue)))
+			m.cancel()
+			<-m.done
+		}
+		m.cancel()
+	})
+}
+
+// mirrorReconcileResult lists all keys that have been changed in the mirror.
+type mirrorReconcileResult struct {
+	Stored  []string
+	Deleted []string
+}
+
+// reconcile makes the mirror equal to valkey by storing all missing or
+// differing keys and deleting all keys unknown to valkey.
+func (m *storageMirror) reconcile(ctx context.Context, source *CaddyStorageValkey, dryRun bool) (mirrorReconcileResult, error) {
+	result := mirrorReconcileResult{Stored: []string{}, Deleted: []string{}}
+
+	sourceKeys, err := source.List(ctx, "", true)
+	if err != nil {
+		return result, err
+	}
+
+	mirrorKeys, err := m.storage.List(ctx, "", true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return result, err
+	}
+
+	knownKeys := make(map[string]bool, len(sourceKeys))
+	for _, key := range sourceKeys {
+		knownKeys[key] = true
+
+		info, err := source.Stat(ctx, key)
+		if err != nil {
+			return result, err
+		}
+
+		value, err := source.Load(ctx, key)
+		if err != nil {
+			return result, err
+		}
+
+		mirrorValue, err := m.storage.Load(ctx, key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return result, err
+		}
+		if err == nil && bytes.Equal(value, mirrorValue) {
+			continue
+		}
+
+		result.Stored = append(result.Stored, key)
+		if !dryRun {
+			if err := storeWithModified(ctx, m.storage, key, value, info.Modified); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, key := range mirrorKeys {
+		// The file_system storage keeps its lock files next to the data
+		if knownKeys[key] || strings.HasPrefix(key, FILE_SYSTEM_LOCKS_PREFIX) {
+			continue
+		}
+
+		result.Deleted = append(result.Deleted, key)
+		if !dryRun {
+			if err := m.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+	}
+
+	sort.Strings(result.Stored)
+	sort.Strings(result.Deleted)
+
+	return result, nil
+}
@@ -0,0 +1,168 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestMirrorKeepsModifiedTime(t *testing.T) {
+	mirror := newTestStorage(t, newFakeValkey(t), CaddyStorageValkeyOptions{})
+	storage := newTestStorage(t, newFakeValkey(t), CaddyStorageValkeyOptions{MirrorTo: mirror})
+
+	ctx := context.Background()
+	modified := time.Now().Add(-30 * 24 * time.Hour).Truncate(time.Second).UTC()
+	if err := storage.StoreWithModified(ctx, "certificates/example.crt", []byte("value"), modified); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing applies the pending writes
+	storage.mirror.close()
+
+	info, err := mirror.Stat(ctx, "certificates/example.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Modified.Equal(modified) {
+		t.Fatalf("expected mirrored entry modified at %s, got %s", modified, info.Modified)
+	}
+}
+
+func TestMirrorReconcileKeepsModifiedTime(t *testing.T) {
+	mirror := newTestStorage(t, newFakeValkey(t), CaddyStorageValkeyOptions{})
+	storage := newTestStorage(t, newFakeValkey(t), CaddyStorageValkeyOptions{MirrorTo: mirror})
+
+	ctx := context.Background()
+	modified := time.Now().Add(-30 * 24 * time.Hour).Truncate(time.Second).UTC()
+	if err := storage.StoreWithModified(ctx, "certificates/example.crt", []byte("value"), modified); err != nil {
+		t.Fatal(err)
+	}
+	storage.mirror.close()
+
+	// The mirror missed a write while it was unavailable
+	if err := mirror.Delete(ctx, "certificates/example.crt"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := storage.mirror.reconcile(ctx, storage, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Stored, []string{"certificates/example.crt"}) {
+		t.Fatalf("unexpected reconciled keys %v", result.Stored)
+	}
+
+	info, err := mirror.Stat(ctx, "certificates/example.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Modified.Equal(modified) {
+		t.Fatalf("expected reconciled entry modified at %s, got %s", modified, info.Modified)
+	}
+}
+
+// testMirrorModule is a storage module recording its writes and cleanup.
+type testMirrorModule struct {
+	storage *memoryStorage
+}
+
+var testMirror = struct {
+	mu     sync.Mutex
+	events []string
+}{}
+
+func testMirrorEvent(event string) {
+	testMirror.mu.Lock()
+	defer testMirror.mu.Unlock()
+	testMirror.events = append(testMirror.events, event)
+}
+
+func init() {
+	caddy.RegisterModule(testMirrorModule{})
+}
+
+func (testMirrorModule) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.valkey_test_mirror",
+		New: func() caddy.Module { return &testMirrorModule{storage: newMemoryStorage()} },
+	}
+}
+
+func (m *testMirrorModule) CertMagicStorage() (certmagic.Storage, error) {
+	return slowStorage{m.storage}, nil
+}
+
+func (m *testMirrorModule) Cleanup() error {
+	testMirrorEvent("cleanup")
+	return nil
+}
+
+// slowStorage takes a while for every write, so writes are still queued when
+// the config is unloaded.
+type slowStorage struct {
+	*memoryStorage
+}
+
+func (s slowStorage) Store(ctx context.Context, key string, value []byte) error {
+	time.Sleep(20 * time.Millisecond)
+	testMirrorEvent("store " + key)
+
+	return s.memoryStorage.Store(ctx, key, value)
+}
+
+func TestMirrorFlushedBeforeCleanup(t *testing.T) {
+	requireModuleLoading(t)
+
+	testMirror.mu.Lock()
+	testMirror.events = nil
+	testMirror.mu.Unlock()
+
+	f := newFakeValkey(t)
+
+	config, err := json.Marshal(map[string]any{
+		"address": []string{f.address},
+		"mirror":  map[string]any{"module": "valkey_test_mirror"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	val, err := ctx.LoadModuleByID(ID_MODULE_STATE, config)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	storage, err := val.(*StorageValkeyModule).CertMagicStorage()
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	expected := []string{}
+	for i := range 5 {
+		key := fmt.Sprintf("certificates/%d.crt", i)
+		if err := storage.Store(context.Background(), key, []byte("value")); err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		expected = append(expected, "store "+key)
+	}
+	expected = append(expected, "cleanup")
+
+	// Unloading the config cleans up the modules
+	cancel()
+
+	testMirror.mu.Lock()
+	defer testMirror.mu.Unlock()
+	if !slices.Equal(testMirror.events, expected) {
+		t.Fatalf("expected the queue to be flushed before the cleanup of the mirror %v, got %v", expected, testMirror.events)
+	}
+}
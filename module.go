@@ -1,21 +1,36 @@
 package caddystoragevalkey
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
 	"github.com/caddyserver/certmagic"
 	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
 )
 
 const (
 	ID_MODULE_STATE = "caddy.storage.valkey"
+
+	// Limits of the connection tuning options
+	MAX_RING_SCALE_EACH_CONN = 20
+	MIN_BUFFER_EACH_CONN     = 32
 )
 
 type StorageValkeyModule struct {
@@ -25,23 +40,141 @@ type StorageValkeyModule struct {
 	ReplicaAddress []string `json:"replica,omitempty"`
 	SelectDb       int      `json:"db,omitempty"`
 
-	ShuffleInit       bool   `json:"shuffle_init,omitempty"`
-	SentinelMasterSet string `json:"sentinel_master_set,omitempty"`
+	// Names of DNS SRV records publishing the addresses, which are resolved again
+	// periodically
+	AddressSrv         string         `json:"address_srv,omitempty"`
+	ReplicaSrv         string         `json:"replica_srv,omitempty"`
+	SrvRefreshInterval caddy.Duration `json:"srv_refresh_interval,omitempty"`
+
+	ReplicaDiscovery *ReplicaDiscoveryConfig `json:"replica_discovery,omitempty"`
+
+	Proxy string `json:"proxy,omitempty"`
+
+	ShuffleInit       bool            `json:"shuffle_init,omitempty"`
+	SentinelMasterSet string          `json:"sentinel_master_set,omitempty"`
+	Sentinel          *SentinelConfig `json:"sentinel,omitempty"`
+
+	ClusterShardsRefreshInterval caddy.Duration `json:"cluster_shards_refresh_interval,omitempty"`
+	ForceSingleClient            bool           `json:"force_single_client,omitempty"`
+	ReplicaOnly                  bool           `json:"replica_only,omitempty"`
+	ReadNodeSelector             string         `json:"read_node_selector,omitempty"`
+	ReadNodeAz                   string         `json:"read_node_az,omitempty"`
 
 	LockMajority       int    `json:"lock_majority,omitempty"`
+	ShareLockClient    bool   `json:"share_lock_client,omitempty"`
 	DisableClientCache bool   `json:"disable_client_cache,omitempty"`
 	SendToReplicas     string `json:"send_to_replicas,omitempty"`
 
+	// Operations sent to replicas with the `operations` strategy of send_to_replicas
+	ReplicaOperations []string `json:"replica_operations,omitempty"`
+
+	// Replicas lagging behind the primary by more bytes of the replication
+	// offset are skipped for reads
+	MaxReplicaLag     int            `json:"max_replica_lag,omitempty"`
+	NodeProbeInterval caddy.Duration `json:"node_probe_interval,omitempty"`
+
+	Layout *StorageLayoutConfig `json:"layout,omitempty"`
+
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
 
-	TlsInsecure   bool   `json:"tls_insecure,omitempty"`
-	TlsMinVersion string `json:"tls_min_version,omitempty"`
-	TlsCaCert     string `json:"tls_ca_cert,omitempty"`
-	TlsClientCert string `json:"tls_client_cert,omitempty"`
-	TlsClientKey  string `json:"tls_client_key,omitempty"`
+	Credentials *CredentialsConfig `json:"credentials,omitempty"`
+
+	DialTimeout           caddy.Duration `json:"dial_timeout,omitempty"`
+	DialKeepAlive         caddy.Duration `json:"dial_keep_alive,omitempty"`
+	ConnWriteTimeout      caddy.Duration `json:"conn_write_timeout,omitempty"`
+	BlockingPoolSize      int            `json:"blocking_pool_size,omitempty"`
+	PipelineMultiplex     int            `json:"pipeline_multiplex,omitempty"`
+	RingScaleEachConn     int            `json:"ring_scale_each_conn,omitempty"`
+	ReadBufferEachConn    int            `json:"read_buffer_each_conn,omitempty"`
+	WriteBufferEachConn   int            `json:"write_buffer_each_conn,omitempty"`
+	MaxFlushDelay         caddy.Duration `json:"max_flush_delay,omitempty"`
+	DisableAutoPipelining bool           `json:"disable_auto_pipelining,omitempty"`
+	AlwaysResp2           bool           `json:"always_resp2,omitempty"`
+
+	TlsInsecure     bool     `json:"tls_insecure,omitempty"`
+	TlsMinVersion   string   `json:"tls_min_version,omitempty"`
+	TlsMaxVersion   string   `json:"tls_max_version,omitempty"`
+	TlsServerName   string   `json:"tls_server_name,omitempty"`
+	TlsCipherSuites []string `json:"tls_cipher_suites,omitempty"`
+	TlsCurves       []string `json:"tls_curves,omitempty"`
+	TlsCaCert       string   `json:"tls_ca_cert,omitempty"`
+	TlsCaCerts      []string `json:"tls_ca_certs,omitempty"`
+	TlsSystemRoots  bool     `json:"tls_system_roots,omitempty"`
+	TlsClientCert   string   `json:"tls_client_cert,omitempty"`
+	TlsClientKey    string   `json:"tls_client_key,omitempty"`
+	TlsReload       bool     `json:"tls_reload,omitempty"`
+
+	TlsClientPki *PkiClientCertificateConfig `json:"tls_client_pki,omitempty"`
+
+	// Load the client certificate with the certificate loaders of the tls app instead
+	TlsClientLoader *LoaderClientCertificateConfig `json:"tls_client_loader,omitempty"`
+
+	SlowOperationThreshold caddy.Duration `json:"slow_operation_threshold,omitempty"`
+
+	ReadTimeout             caddy.Duration `json:"read_timeout,omitempty"`
+	WriteTimeout            caddy.Duration `json:"write_timeout,omitempty"`
+	ListTimeout             caddy.Duration `json:"list_timeout,omitempty"`
+	LockTimeout             caddy.Duration `json:"lock_timeout,omitempty"`
+	MaxRetries              int            `json:"max_retries,omitempty"`
+	CircuitBreakerThreshold int            `json:"circuit_breaker_threshold,omitempty"`
+	CircuitBreakerCooldown  caddy.Duration `json:"circuit_breaker_cooldown,omitempty"`
+
+	// VerifyOnStart checks the permissions and operations of the storage with a
+	// canary entry while provisioning
+	VerifyOnStart bool `json:"verify_on_start,omitempty"`
+
+	MigrateFromRaw json.RawMessage `json:"migrate_from,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// Deletions are only applied to the storage migrated from when enabled
+	MigrateFromDelete bool `json:"migrate_from_delete,omitempty"`
+
+	MirrorRaw       json.RawMessage `json:"mirror,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	MirrorQueueSize int             `json:"mirror_queue_size,omitempty"`
+
+	storage      *CaddyStorageValkey
+	mirrorCancel context.CancelFunc
+	logger       *zap.Logger
+}
+
+// SentinelConfig contains the settings for connecting to the sentinels, which
+// can differ from the settings of the data nodes.
+type SentinelConfig struct {
+	MasterSet  string `json:"master_set,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	ClientName string `json:"client_name,omitempty"`
+
+	TlsInsecure     bool     `json:"tls_insecure,omitempty"`
+	TlsMinVersion   string   `json:"tls_min_version,omitempty"`
+	TlsMaxVersion   string   `json:"tls_max_version,omitempty"`
+	TlsServerName   string   `json:"tls_server_name,omitempty"`
+	TlsCipherSuites []string `json:"tls_cipher_suites,omitempty"`
+	TlsCurves       []string `json:"tls_curves,omitempty"`
+	TlsCaCert       string   `json:"tls_ca_cert,omitempty"`
+	TlsCaCerts      []string `json:"tls_ca_certs,omitempty"`
+	TlsSystemRoots  bool     `json:"tls_system_roots,omitempty"`
+	TlsClientCert   string   `json:"tls_client_cert,omitempty"`
+	TlsClientKey    string   `json:"tls_client_key,omitempty"`
+	TlsReload       bool     `json:"tls_reload,omitempty"`
+}
 
-	storage *CaddyStorageValkey
+func (s *SentinelConfig) tlsOptions() tlsOptions {
+	return tlsOptions{
+		Insecure:     s.TlsInsecure,
+		MinVersion:   s.TlsMinVersion,
+		MaxVersion:   s.TlsMaxVersion,
+		ServerName:   s.TlsServerName,
+		CipherSuites: s.TlsCipherSuites,
+		Curves:       s.TlsCurves,
+		CaCert:       s.TlsCaCert,
+		CaCerts:      s.TlsCaCerts,
+		SystemRoots:  s.TlsSystemRoots,
+		ClientCert:   s.TlsClientCert,
+		ClientKey:    s.TlsClientKey,
+		Reload:       s.TlsReload,
+		optionPrefix: "sentinel.",
+	}
 }
 
 func init() {
@@ -61,6 +194,102 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			configKey := d.Val()
 			var configVal []string
 
+			// Other storages are modules with their own configuration
+			switch configKey {
+			case "migrate_from":
+				{
+					migrateFromRaw, err := unmarshalStorageModule(d)
+					if err != nil {
+						return err
+					}
+
+					m.MigrateFromRaw = migrateFromRaw
+					continue
+				}
+			case "mirror":
+				{
+					mirrorRaw, err := unmarshalStorageModule(d)
+					if err != nil {
+						return err
+					}
+
+					m.MirrorRaw = mirrorRaw
+					continue
+				}
+			case "layout":
+				{
+					layout, err := unmarshalLayout(d)
+					if err != nil {
+						return err
+					}
+
+					m.Layout = layout
+					continue
+				}
+			case "sentinel":
+				{
+					sentinel, err := unmarshalSentinel(d)
+					if err != nil {
+						return err
+					}
+
+					m.Sentinel = sentinel
+					continue
+				}
+			case "replica_discovery":
+				{
+					replicaDiscovery, err := unmarshalReplicaDiscovery(d)
+					if err != nil {
+						return err
+					}
+
+					m.ReplicaDiscovery = replicaDiscovery
+					continue
+				}
+			case "credentials":
+				{
+					credentials, err := unmarshalCredentials(d)
+					if err != nil {
+						return err
+					}
+
+					m.Credentials = credentials
+					continue
+				}
+			case "tls_client_pki":
+				{
+					tlsClientPki, err := unmarshalPkiClientCertificate(d)
+					if err != nil {
+						return err
+					}
+
+					m.TlsClientPki = tlsClientPki
+					continue
+				}
+			case "tls_client_loader":
+				{
+					tlsClientLoader, err := unmarshalLoaderClientCertificate(d)
+					if err != nil {
+						return err
+					}
+
+					m.TlsClientLoader = tlsClientLoader
+					continue
+				}
+			case "tls_cipher_suites":
+				m.TlsCipherSuites = unmarshalList(d)
+				continue
+			case "tls_curves":
+				m.TlsCurves = unmarshalList(d)
+				continue
+			case "tls_ca_certs":
+				m.TlsCaCerts = unmarshalList(d)
+				continue
+			case "replica_operations":
+				m.ReplicaOperations = unmarshalList(d)
+				continue
+			}
+
 			if d.NextArg() {
 				// configuration item with single parameter
 				configVal = append(configVal, d.Val())
@@ -88,6 +317,39 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				m.InitAddress = configVal
 			case "replica":
 				m.ReplicaAddress = configVal
+			case "address_srv":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `address_srv`")
+					}
+
+					m.AddressSrv = configVal[0]
+				}
+			case "replica_srv":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `replica_srv`")
+					}
+
+					m.ReplicaSrv = configVal[0]
+				}
+			case "srv_refresh_interval":
+				{
+					srvRefreshInterval, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.SrvRefreshInterval = caddy.Duration(srvRefreshInterval)
+				}
+			case "proxy":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `proxy`")
+					}
+
+					m.Proxy = configVal[0]
+				}
 			case "db":
 				{
 					selectDb, err := parseConfigValToInt(configVal)
@@ -113,6 +375,67 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.SentinelMasterSet = configVal[0]
 				}
+			case "cluster_shards_refresh_interval":
+				{
+					shardsRefreshInterval, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ClusterShardsRefreshInterval = caddy.Duration(shardsRefreshInterval)
+				}
+			case "force_single_client":
+				{
+					forceSingleClient, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ForceSingleClient = forceSingleClient
+				}
+			case "replica_only":
+				{
+					replicaOnly, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ReplicaOnly = replicaOnly
+				}
+			case "read_node_selector":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `read_node_selector`")
+					}
+
+					m.ReadNodeSelector = configVal[0]
+				}
+			case "max_replica_lag":
+				{
+					maxReplicaLag, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.MaxReplicaLag = maxReplicaLag
+				}
+			case "node_probe_interval":
+				{
+					nodeProbeInterval, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.NodeProbeInterval = caddy.Duration(nodeProbeInterval)
+				}
+			case "read_node_az":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `read_node_az`")
+					}
+
+					m.ReadNodeAz = configVal[0]
+				}
 			case "lock_majority":
 				{
 					lockMajority, err := parseConfigValToInt(configVal)
@@ -126,6 +449,15 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.LockMajority = int(lockMajority)
 				}
+			case "share_lock_client":
+				{
+					shareLockClient, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ShareLockClient = shareLockClient
+				}
 			case "disable_client_cache":
 				{
 					disableClientCache, err := parseConfigValToBool(configVal)
@@ -159,6 +491,105 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.Password = configVal[0]
 				}
+			case "dial_timeout":
+				{
+					dialTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.DialTimeout = caddy.Duration(dialTimeout)
+				}
+			case "dial_keep_alive":
+				{
+					dialKeepAlive, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.DialKeepAlive = caddy.Duration(dialKeepAlive)
+				}
+			case "conn_write_timeout":
+				{
+					connWriteTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ConnWriteTimeout = caddy.Duration(connWriteTimeout)
+				}
+			case "blocking_pool_size":
+				{
+					blockingPoolSize, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.BlockingPoolSize = blockingPoolSize
+				}
+			case "pipeline_multiplex":
+				{
+					pipelineMultiplex, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.PipelineMultiplex = pipelineMultiplex
+				}
+			case "ring_scale_each_conn":
+				{
+					ringScaleEachConn, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.RingScaleEachConn = ringScaleEachConn
+				}
+			case "read_buffer_each_conn":
+				{
+					readBufferEachConn, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ReadBufferEachConn = readBufferEachConn
+				}
+			case "write_buffer_each_conn":
+				{
+					writeBufferEachConn, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.WriteBufferEachConn = writeBufferEachConn
+				}
+			case "max_flush_delay":
+				{
+					maxFlushDelay, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.MaxFlushDelay = caddy.Duration(maxFlushDelay)
+				}
+			case "disable_auto_pipelining":
+				{
+					disableAutoPipelining, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.DisableAutoPipelining = disableAutoPipelining
+				}
+			case "always_resp2":
+				{
+					alwaysResp2, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.AlwaysResp2 = alwaysResp2
+				}
 			case "tls_insecure":
 				{
 					tlsInsecure, err := parseConfigValToBool(configVal)
@@ -168,6 +599,15 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.TlsInsecure = tlsInsecure
 				}
+			case "tls_reload":
+				{
+					tlsReload, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.TlsReload = tlsReload
+				}
 			case "tls_min_version":
 				{
 					if len(configVal) > 1 {
@@ -176,6 +616,31 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.TlsMinVersion = configVal[0]
 				}
+			case "tls_max_version":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `tls_max_version`")
+					}
+
+					m.TlsMaxVersion = configVal[0]
+				}
+			case "tls_server_name":
+				{
+					if len(configVal) > 1 {
+						return d.Err("expected only a single value for `tls_server_name`")
+					}
+
+					m.TlsServerName = configVal[0]
+				}
+			case "tls_system_roots":
+				{
+					tlsSystemRoots, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.TlsSystemRoots = tlsSystemRoots
+				}
 			case "tls_ca_cert":
 				{
 					if len(configVal) > 1 {
@@ -200,271 +665,1128 @@ func (m *StorageValkeyModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 					m.TlsClientKey = configVal[0]
 				}
-			default:
-				// Unknown key for this config
-				d.ArgErr()
-			}
-		}
-	}
-
-	return nil
-}
+			case "mirror_queue_size":
+				{
+					mirrorQueueSize, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
 
-func parseConfigValToInt(configVal []string) (int, error) {
-	if len(configVal) != 1 {
-		return 0, errors.New("can only accept single value as integer")
-	}
+					// Zero uses the default, like an omitted value in JSON
+					if mirrorQueueSize < 0 {
+						return d.Err("impossible value for `mirror_queue_size` (value >= 0 required)")
+					}
 
-	// NOTE: Because int is "at-least 32bits", we only parse 32bits
-	val, err := strconv.ParseInt(configVal[0], 10, 32)
-	if err != nil {
-		return 0, err
-	}
+					m.MirrorQueueSize = mirrorQueueSize
+				}
+			case "migrate_from_delete":
+				{
+					migrateFromDelete, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
 
-	return int(val), nil
-}
+					m.MigrateFromDelete = migrateFromDelete
+				}
+			case "slow_operation_threshold":
+				{
+					slowOperationThreshold, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
 
-func parseConfigValToBool(configVal []string) (bool, error) {
-	if len(configVal) != 1 {
-		return false, errors.New("can only accept single value as bool")
-	}
+					m.SlowOperationThreshold = caddy.Duration(slowOperationThreshold)
+				}
+			case "read_timeout":
+				{
+					readTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
 
-	val, err := strconv.ParseBool(configVal[0])
-	if err != nil {
+					m.ReadTimeout = caddy.Duration(readTimeout)
+				}
+			case "write_timeout":
+				{
+					writeTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.WriteTimeout = caddy.Duration(writeTimeout)
+				}
+			case "list_timeout":
+				{
+					listTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.ListTimeout = caddy.Duration(listTimeout)
+				}
+			case "lock_timeout":
+				{
+					lockTimeout, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.LockTimeout = caddy.Duration(lockTimeout)
+				}
+			case "max_retries":
+				{
+					maxRetries, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.MaxRetries = maxRetries
+				}
+			case "circuit_breaker_threshold":
+				{
+					circuitBreakerThreshold, err := parseConfigValToInt(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.CircuitBreakerThreshold = circuitBreakerThreshold
+				}
+			case "circuit_breaker_cooldown":
+				{
+					circuitBreakerCooldown, err := parseConfigValToDuration(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.CircuitBreakerCooldown = caddy.Duration(circuitBreakerCooldown)
+				}
+			case "verify_on_start":
+				{
+					verifyOnStart, err := parseConfigValToBool(configVal)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+
+					m.VerifyOnStart = verifyOnStart
+				}
+			default:
+				// Unknown key for this config
+				d.ArgErr()
+			}
+		}
+	}
+
+	return nil
+}
+
+func unmarshalStorageModule(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	moduleName := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := unm.(caddy.StorageConverter); !ok {
+		return nil, d.Errf("module %s is not a storage module", moduleName)
+	}
+
+	return caddyconfig.JSONModuleObject(unm, "module", moduleName, nil), nil
+}
+
+func unmarshalLayout(d *caddyfile.Dispenser) (*StorageLayoutConfig, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	layout := &StorageLayoutConfig{Name: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	// The layout options are optional and only given as nested block
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		configVal := d.RemainingArgs()
+
+		switch configKey {
+		case "prefix":
+			{
+				if len(configVal) != 1 {
+					return nil, d.Err("expected a single value for `prefix`")
+				}
+
+				layout.Prefix = configVal[0]
+			}
+		case "read_only":
+			{
+				// Only giving the option enables it
+				if len(configVal) == 0 {
+					layout.ReadOnly = true
+					continue
+				}
+
+				readOnly, err := parseConfigValToBool(configVal)
+				if err != nil {
+					return nil, d.WrapErr(err)
+				}
+
+				layout.ReadOnly = readOnly
+			}
+		case "aes_key":
+			{
+				if len(configVal) != 1 {
+					return nil, d.Err("expected a single value for `aes_key`")
+				}
+
+				layout.AesKey = configVal[0]
+			}
+		case "value_prefix":
+			{
+				if len(configVal) != 1 {
+					return nil, d.Err("expected a single value for `value_prefix`")
+				}
+
+				layout.ValuePrefix = configVal[0]
+			}
+		default:
+			return nil, d.Errf("unknown layout option '%s'", configKey)
+		}
+	}
+
+	return layout, nil
+}
+
+func unmarshalSentinel(d *caddyfile.Dispenser) (*SentinelConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	sentinel := &SentinelConfig{}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		configVal := d.RemainingArgs()
+
+		// Boolean options are enabled by only giving the option
+		if configKey == "tls_insecure" || configKey == "tls_reload" || configKey == "tls_system_roots" {
+			enabled := true
+			if len(configVal) > 0 {
+				val, err := parseConfigValToBool(configVal)
+				if err != nil {
+					return nil, d.WrapErr(err)
+				}
+				enabled = val
+			}
+
+			switch configKey {
+			case "tls_insecure":
+				sentinel.TlsInsecure = enabled
+			case "tls_reload":
+				sentinel.TlsReload = enabled
+			case "tls_system_roots":
+				sentinel.TlsSystemRoots = enabled
+			}
+			continue
+		}
+
+		// List options take all values of the line
+		switch configKey {
+		case "tls_cipher_suites", "tls_curves", "tls_ca_certs":
+			if len(configVal) == 0 {
+				return nil, d.ArgErr()
+			}
+
+			switch configKey {
+			case "tls_cipher_suites":
+				sentinel.TlsCipherSuites = configVal
+			case "tls_curves":
+				sentinel.TlsCurves = configVal
+			case "tls_ca_certs":
+				sentinel.TlsCaCerts = configVal
+			}
+			continue
+		}
+
+		if len(configVal) != 1 {
+			return nil, d.Errf("expected a single value for `%s`", configKey)
+		}
+
+		switch configKey {
+		case "master_set":
+			sentinel.MasterSet = configVal[0]
+		case "username":
+			sentinel.Username = configVal[0]
+		case "password":
+			sentinel.Password = configVal[0]
+		case "client_name":
+			sentinel.ClientName = configVal[0]
+		case "tls_min_version":
+			sentinel.TlsMinVersion = configVal[0]
+		case "tls_max_version":
+			sentinel.TlsMaxVersion = configVal[0]
+		case "tls_server_name":
+			sentinel.TlsServerName = configVal[0]
+		case "tls_ca_cert":
+			sentinel.TlsCaCert = configVal[0]
+		case "tls_client_cert":
+			sentinel.TlsClientCert = configVal[0]
+		case "tls_client_key":
+			sentinel.TlsClientKey = configVal[0]
+		default:
+			return nil, d.Errf("unknown sentinel option '%s'", configKey)
+		}
+	}
+
+	return sentinel, nil
+}
+
+func unmarshalPkiClientCertificate(d *caddyfile.Dispenser) (*PkiClientCertificateConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	pki := &PkiClientCertificateConfig{}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+
+		// The storage is a module with its own configuration
+		if configKey == "storage" {
+			storageRaw, err := unmarshalStorageModule(d)
+			if err != nil {
+				return nil, err
+			}
+
+			pki.StorageRaw = storageRaw
+			continue
+		}
+
+		configVal := d.RemainingArgs()
+		if len(configVal) != 1 {
+			return nil, d.Errf("expected a single value for `%s`", configKey)
+		}
+
+		switch configKey {
+		case "ca":
+			pki.CA = configVal[0]
+		case "common_name":
+			pki.CommonName = configVal[0]
+		case "lifetime":
+			lifetime, err := parseConfigValToDuration(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			pki.Lifetime = caddy.Duration(lifetime)
+		default:
+			return nil, d.Errf("unknown tls_client_pki option '%s'", configKey)
+		}
+	}
+
+	return pki, nil
+}
+
+func unmarshalLoaderClientCertificate(d *caddyfile.Dispenser) (*LoaderClientCertificateConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	loader := &LoaderClientCertificateConfig{}
+
+	var files caddytls.FileLoader
+	var folders caddytls.FolderLoader
+	var stored []caddytls.CertKeyFilePair
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		configVal := d.RemainingArgs()
+
+		switch configKey {
+		case "load_files", "load_storage":
+			if len(configVal) != 2 {
+				return nil, d.Errf("expected a certificate and a key for `%s`", configKey)
+			}
+
+			pair := caddytls.CertKeyFilePair{Certificate: configVal[0], Key: configVal[1]}
+			if configKey == "load_files" {
+				files = append(files, pair)
+			} else {
+				stored = append(stored, pair)
+			}
+		case "load_folders":
+			if len(configVal) == 0 {
+				return nil, d.ArgErr()
+			}
+
+			folders = append(folders, configVal...)
+		case "tag":
+			if len(configVal) != 1 {
+				return nil, d.Errf("expected a single value for `%s`", configKey)
+			}
+
+			loader.Tag = configVal[0]
+		case "reload_interval":
+			reloadInterval, err := parseConfigValToDuration(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			loader.ReloadInterval = caddy.Duration(reloadInterval)
+		default:
+			return nil, d.Errf("unknown tls_client_loader option '%s'", configKey)
+		}
+	}
+
+	loader.LoadersRaw = caddy.ModuleMap{}
+	if len(files) > 0 {
+		loader.LoadersRaw["load_files"] = caddyconfig.JSON(files, nil)
+	}
+	if len(folders) > 0 {
+		loader.LoadersRaw["load_folders"] = caddyconfig.JSON(folders, nil)
+	}
+	if len(stored) > 0 {
+		loader.LoadersRaw["load_storage"] = caddyconfig.JSON(caddytls.StorageLoader{Pairs: stored}, nil)
+	}
+
+	return loader, nil
+}
+
+// unmarshalList returns the values given on the line of the option and in its block.
+func unmarshalList(d *caddyfile.Dispenser) []string {
+	values := d.RemainingArgs()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		values = append(values, d.Val())
+	}
+
+	return values
+}
+
+func unmarshalReplicaDiscovery(d *caddyfile.Dispenser) (*ReplicaDiscoveryConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	replicaDiscovery := &ReplicaDiscoveryConfig{}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		configVal := d.RemainingArgs()
+
+		switch configKey {
+		case "interval":
+			interval, err := parseConfigValToDuration(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			replicaDiscovery.Interval = caddy.Duration(interval)
+		case "max_lag":
+			maxLag, err := parseConfigValToDuration(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			replicaDiscovery.MaxLag = caddy.Duration(maxLag)
+		case "connections":
+			connections, err := parseConfigValToInt(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			replicaDiscovery.Connections = connections
+		default:
+			return nil, d.Errf("unknown replica_discovery option '%s'", configKey)
+		}
+	}
+
+	return replicaDiscovery, nil
+}
+
+func unmarshalCredentials(d *caddyfile.Dispenser) (*CredentialsConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	credentials := &CredentialsConfig{}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		configVal := d.RemainingArgs()
+
+		// The command is given with its arguments
+		if configKey == "command" {
+			if len(configVal) == 0 {
+				return nil, d.ArgErr()
+			}
+
+			credentials.Command = configVal
+			continue
+		}
+
+		if len(configVal) != 1 {
+			return nil, d.Errf("expected a single value for `%s`", configKey)
+		}
+
+		switch configKey {
+		case "username_file":
+			credentials.UsernameFile = configVal[0]
+		case "password_file":
+			credentials.PasswordFile = configVal[0]
+		case "username_env":
+			credentials.UsernameEnv = configVal[0]
+		case "password_env":
+			credentials.PasswordEnv = configVal[0]
+		case "command_timeout":
+			commandTimeout, err := parseConfigValToDuration(configVal)
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+
+			credentials.CommandTimeout = caddy.Duration(commandTimeout)
+		default:
+			return nil, d.Errf("unknown credentials option '%s'", configKey)
+		}
+	}
+
+	return credentials, nil
+}
+
+func parseConfigValToInt(configVal []string) (int, error) {
+	if len(configVal) != 1 {
+		return 0, errors.New("can only accept single value as integer")
+	}
+
+	// NOTE: Because int is "at-least 32bits", we only parse 32bits
+	val, err := strconv.ParseInt(configVal[0], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(val), nil
+}
+
+func parseConfigValToBool(configVal []string) (bool, error) {
+	if len(configVal) != 1 {
+		return false, errors.New("can only accept single value as bool")
+	}
+
+	val, err := strconv.ParseBool(configVal[0])
+	if err != nil {
 		return false, err
 	}
 
 	return val, nil
 }
 
+func parseConfigValToDuration(configVal []string) (time.Duration, error) {
+	if len(configVal) != 1 {
+		return 0, errors.New("can only accept single value as duration")
+	}
+
+	val, err := caddy.ParseDuration(configVal[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return val, nil
+}
+
+// unixSocketPaths replaces the unix addresses with the path of their socket.
+func unixSocketPaths(addresses []string) []string {
+	if addresses == nil {
+		return nil
+	}
+
+	paths := make([]string, len(addresses))
+	for i, address := range addresses {
+		paths[i] = unixSocketPath(address)
+	}
+
+	return paths
+}
+
+func redactUrl(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		// Better to log nothing than leaking a secret in an unparsable URL
+		return "<unparsable>"
+	}
+
+	return parsedUrl.Redacted()
+}
+
 func isFilePath(path string) bool {
 	info, err := os.Stat(path)
 	if err != nil {
-		return false
+		return false
+	}
+	return !info.IsDir()
+}
+
+func checkPemStringOrFilepath(val string) (bool, error) {
+	if cert, _ := pem.Decode([]byte(val)); cert == nil {
+		if !isFilePath(val) {
+			return false, errors.New("value is no certificate or filepath")
+		}
+	}
+
+	return true, nil
+}
+
+func validatePemStringOrFilepathOption(val string) bool {
+	// Not setting the options is valid
+	if len(val) == 0 {
+		return true
+	}
+
+	// Check if it is a PEM string or filepath
+	ok, err := checkPemStringOrFilepath(val)
+
+	return ok && err == nil
+}
+
+func (m *StorageValkeyModule) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger()
+
+	// Replace placeholders in relevant configuration options with their actual values
+
+	repl := caddy.NewReplacer()
+
+	m.Url = repl.ReplaceAll(m.Url, "")
+	m.Proxy = repl.ReplaceAll(m.Proxy, "")
+	m.Username = repl.ReplaceAll(m.Username, "")
+	m.Password = repl.ReplaceAll(m.Password, "")
+	m.TlsCaCert = repl.ReplaceAll(m.TlsCaCert, "")
+	m.TlsServerName = repl.ReplaceAll(m.TlsServerName, "")
+	for i := range m.TlsCaCerts {
+		m.TlsCaCerts[i] = repl.ReplaceAll(m.TlsCaCerts[i], "")
+	}
+	m.TlsClientCert = repl.ReplaceAll(m.TlsClientCert, "")
+	m.TlsClientKey = repl.ReplaceAll(m.TlsClientKey, "")
+	m.ReadNodeAz = repl.ReplaceAll(m.ReadNodeAz, "")
+
+	if m.Sentinel != nil {
+		m.Sentinel.MasterSet = repl.ReplaceAll(m.Sentinel.MasterSet, "")
+		m.Sentinel.Username = repl.ReplaceAll(m.Sentinel.Username, "")
+		m.Sentinel.Password = repl.ReplaceAll(m.Sentinel.Password, "")
+		m.Sentinel.ClientName = repl.ReplaceAll(m.Sentinel.ClientName, "")
+		m.Sentinel.TlsCaCert = repl.ReplaceAll(m.Sentinel.TlsCaCert, "")
+		m.Sentinel.TlsServerName = repl.ReplaceAll(m.Sentinel.TlsServerName, "")
+		for i := range m.Sentinel.TlsCaCerts {
+			m.Sentinel.TlsCaCerts[i] = repl.ReplaceAll(m.Sentinel.TlsCaCerts[i], "")
+		}
+		m.Sentinel.TlsClientCert = repl.ReplaceAll(m.Sentinel.TlsClientCert, "")
+		m.Sentinel.TlsClientKey = repl.ReplaceAll(m.Sentinel.TlsClientKey, "")
+	}
+
+	if m.Credentials != nil {
+		m.Credentials.UsernameFile = repl.ReplaceAll(m.Credentials.UsernameFile, "")
+		m.Credentials.PasswordFile = repl.ReplaceAll(m.Credentials.PasswordFile, "")
+		for i := range m.Credentials.Command {
+			m.Credentials.Command[i] = repl.ReplaceAll(m.Credentials.Command[i], "")
+		}
+	}
+
+	if m.Layout != nil {
+		m.Layout.AesKey = repl.ReplaceAll(m.Layout.AesKey, "")
+	}
+
+	for i := range m.InitAddress {
+		m.InitAddress[i] = repl.ReplaceAll(m.InitAddress[i], "")
+	}
+	for i := range m.ReplicaAddress {
+		m.ReplicaAddress[i] = repl.ReplaceAll(m.ReplicaAddress[i], "")
+	}
+	m.AddressSrv = repl.ReplaceAll(m.AddressSrv, "")
+	m.ReplicaSrv = repl.ReplaceAll(m.ReplicaSrv, "")
+
+	if m.TlsClientPki != nil {
+		m.TlsClientPki.CommonName = repl.ReplaceAll(m.TlsClientPki.CommonName, "")
+	}
+
+	// Apply defaults where required
+
+	if m.LockMajority < 1 {
+		m.LockMajority = 2
+	}
+
+	// Create a new client options object based on the parsed config
+	var clientOptions *valkey.ClientOption
+
+	if m.Url != "" {
+		optionsFromUrl, err := valkey.ParseURL(m.Url)
+
+		if err != nil {
+			return err
+		}
+
+		clientOptions = &optionsFromUrl
+	} else {
+		clientOptions = &valkey.ClientOption{
+			InitAddress: unixSocketPaths(m.InitAddress),
+			SelectDB:    m.SelectDb,
+		}
+	}
+
+	// Set the master set monitored by the sentinels if present
+	if len(m.SentinelMasterSet) > 0 {
+		clientOptions.Sentinel.MasterSet = m.SentinelMasterSet
+	}
+
+	// Apply the separate settings for connecting to the sentinels
+	if m.Sentinel != nil {
+		if len(m.Sentinel.MasterSet) > 0 {
+			clientOptions.Sentinel.MasterSet = m.Sentinel.MasterSet
+		}
+
+		clientOptions.Sentinel.Username = m.Sentinel.Username
+		clientOptions.Sentinel.Password = m.Sentinel.Password
+		clientOptions.Sentinel.ClientName = m.Sentinel.ClientName
+	}
+
+	// Set username and password connection details
+	if len(m.Username) > 0 {
+		clientOptions.Username = m.Username
+	}
+	if len(m.Password) > 0 {
+		clientOptions.Password = m.Password
+	}
+
+	// Read the credentials again for every new connection
+	if m.Credentials != nil {
+		// The client would authenticate at the sentinels with the same credentials
+		if len(clientOptions.Sentinel.MasterSet) > 0 {
+			return errors.New("the `credentials` block can not be used with sentinels, use `username` and `password` instead")
+		}
+
+		clientOptions.AuthCredentialsFn = m.Credentials.authCredentialsFn(clientOptions.Username)
+	}
+
+	// Transfer the connection and pipeline tuning options, zero keeps the client defaults
+	clientOptions.Dialer.Timeout = time.Duration(m.DialTimeout)
+	clientOptions.Dialer.KeepAlive = time.Duration(m.DialKeepAlive)
+	clientOptions.ConnWriteTimeout = time.Duration(m.ConnWriteTimeout)
+	clientOptions.BlockingPoolSize = m.BlockingPoolSize
+	clientOptions.PipelineMultiplex = m.PipelineMultiplex
+	clientOptions.RingScaleEachConn = m.RingScaleEachConn
+	clientOptions.ReadBufferEachConn = m.ReadBufferEachConn
+	clientOptions.WriteBufferEachConn = m.WriteBufferEachConn
+	clientOptions.MaxFlushDelay = time.Duration(m.MaxFlushDelay)
+	clientOptions.DisableAutoPipelining = m.DisableAutoPipelining
+	clientOptions.AlwaysRESP2 = m.AlwaysResp2
+
+	// Transfer Disable Client Cache option
+	clientOptions.DisableCache = m.DisableClientCache
+
+	// Transfer the options for choosing the nodes to connect to
+	clientOptions.ShuffleInit = m.ShuffleInit
+	clientOptions.ForceSingleClient = m.ForceSingleClient
+	clientOptions.ReplicaOnly = m.ReplicaOnly
+	clientOptions.ClusterOption.ShardsRefreshInterval = time.Duration(m.ClusterShardsRefreshInterval)
+
+	// Set SendToReplicas readonly strategy if present
+	if m.SendToReplicas == "readonly" {
+		clientOptions.SendToReplicas = func(cmd valkey.Completed) bool {
+			return cmd.IsReadOnly()
+		}
+	}
+
+	// Send only the commands of the given storage operations to replicas
+	var replicaOperations []string
+	if m.SendToReplicas == "operations" {
+		replicaOperations = m.ReplicaOperations
+		if len(replicaOperations) == 0 {
+			replicaOperations = DEFAULT_REPLICA_OPERATIONS
+		}
+	}
+
+	// Set the selection of the node for commands sent to replicas if present
+	switch m.ReadNodeSelector {
+	case "prefer_replica":
+		clientOptions.ReadNodeSelector = valkey.PreferReplicaNodeSelector()
+	case "az_affinity":
+		clientOptions.ReadNodeSelector = valkey.AZAffinityNodeSelector(m.ReadNodeAz)
+	case "az_affinity_replicas_and_primary":
+		clientOptions.ReadNodeSelector = valkey.AZAffinityReplicasAndPrimaryNodeSelector(m.ReadNodeAz)
+	}
+
+	// Expose the storage metrics through the caddy metrics registry
+	if err := registerStorageMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
+	// Create the layout of the entries
+	layout, err := newStorageLayout(m.Layout)
+	if err != nil {
+		return err
+	}
+
+	credentialsSource := "static"
+	if m.Credentials != nil {
+		credentialsSource = m.Credentials.passwordSource()
+	}
+
+	// Log the effective configuration without any secrets
+	m.logger.Info("provisioning valkey storage",
+		zap.String("url", redactUrl(m.Url)),
+		zap.Strings("address", clientOptions.InitAddress),
+		zap.Strings("replica", m.ReplicaAddress),
+		zap.String("address_srv", m.AddressSrv),
+		zap.String("replica_srv", m.ReplicaSrv),
+		zap.Bool("replica_discovery", m.ReplicaDiscovery != nil),
+		zap.String("proxy", redactUrl(m.Proxy)),
+		zap.Int("db", clientOptions.SelectDB),
+		zap.String("username", clientOptions.Username),
+		zap.Bool("password", len(clientOptions.Password) > 0),
+		zap.String("credentials", credentialsSource),
+		zap.Bool("tls", clientOptions.TLSConfig != nil || m.tlsOptions().isConfigured() || m.TlsClientPki != nil || m.TlsClientLoader != nil),
+		zap.Bool("tls_insecure", m.TlsInsecure),
+		zap.Bool("tls_reload", m.TlsReload),
+		zap.String("tls_server_name", m.TlsServerName),
+		zap.String("tls_max_version", m.TlsMaxVersion),
+		zap.Int("tls_ca_certs", len(m.TlsCaCerts)),
+		zap.Bool("tls_system_roots", m.TlsSystemRoots),
+		zap.Bool("tls_client_pki", m.TlsClientPki != nil),
+		zap.Bool("tls_client_loader", m.TlsClientLoader != nil),
+		zap.Bool("tls_ca_cert", len(m.TlsCaCert) > 0),
+		zap.Bool("tls_client_cert", len(m.TlsClientCert) > 0),
+		zap.String("sentinel_master_set", clientOptions.Sentinel.MasterSet),
+		zap.String("sentinel_username", clientOptions.Sentinel.Username),
+		zap.Bool("sentinel_password", len(clientOptions.Sentinel.Password) > 0),
+		zap.Bool("sentinel_tls", clientOptions.Sentinel.TLSConfig != nil || (m.Sentinel != nil && m.Sentinel.tlsOptions().isConfigured())),
+		zap.Int("lock_majority", m.LockMajority),
+		zap.Bool("share_lock_client", m.ShareLockClient),
+		zap.Bool("disable_client_cache", m.DisableClientCache),
+		zap.Bool("shuffle_init", m.ShuffleInit),
+		zap.Duration("dial_timeout", clientOptions.Dialer.Timeout),
+		zap.Duration("dial_keep_alive", clientOptions.Dialer.KeepAlive),
+		zap.Duration("conn_write_timeout", clientOptions.ConnWriteTimeout),
+		zap.Int("blocking_pool_size", clientOptions.BlockingPoolSize),
+		zap.Int("pipeline_multiplex", clientOptions.PipelineMultiplex),
+		zap.Int("ring_scale_each_conn", clientOptions.RingScaleEachConn),
+		zap.Int("read_buffer_each_conn", clientOptions.ReadBufferEachConn),
+		zap.Int("write_buffer_each_conn", clientOptions.WriteBufferEachConn),
+		zap.Duration("max_flush_delay", clientOptions.MaxFlushDelay),
+		zap.Bool("disable_auto_pipelining", clientOptions.DisableAutoPipelining),
+		zap.Bool("always_resp2", clientOptions.AlwaysRESP2),
+		zap.Bool("force_single_client", m.ForceSingleClient),
+		zap.Bool("replica_only", m.ReplicaOnly),
+		zap.Duration("cluster_shards_refresh_interval", time.Duration(m.ClusterShardsRefreshInterval)),
+		zap.String("read_node_selector", m.ReadNodeSelector),
+		zap.String("send_to_replicas", m.SendToReplicas),
+		zap.Strings("replica_operations", replicaOperations),
+		zap.Int("max_replica_lag", m.MaxReplicaLag),
+		zap.String("layout", layout.Name()),
+		zap.Duration("read_timeout", time.Duration(m.ReadTimeout)),
+		zap.Duration("write_timeout", time.Duration(m.WriteTimeout)),
+		zap.Duration("list_timeout", time.Duration(m.ListTimeout)),
+		zap.Duration("lock_timeout", time.Duration(m.LockTimeout)),
+		zap.Int("max_retries", m.MaxRetries),
+		zap.Int("circuit_breaker_threshold", m.CircuitBreakerThreshold),
+		zap.Bool("verify_on_start", m.VerifyOnStart),
+	)
+
+	// Unchanged connection configs reuse the connection of the previous config
+	poolKey, err := m.connectionPoolKey()
+	if err != nil {
+		return err
+	}
+
+	// Create caddy valkey storage specific options
+	options := CaddyStorageValkeyOptions{
+		ConnectionPoolKey:      poolKey,
+		LockMajority:           m.LockMajority,
+		ShareLockerClient:      m.ShareLockClient,
+		Layout:                 layout,
+		Logger:                 m.logger,
+		SlowOperationThreshold: time.Duration(m.SlowOperationThreshold),
+
+		ReadTimeout:             time.Duration(m.ReadTimeout),
+		WriteTimeout:            time.Duration(m.WriteTimeout),
+		ListTimeout:             time.Duration(m.ListTimeout),
+		LockTimeout:             time.Duration(m.LockTimeout),
+		MaxRetries:              m.MaxRetries,
+		CircuitBreakerThreshold: m.CircuitBreakerThreshold,
+		CircuitBreakerCooldown:  time.Duration(m.CircuitBreakerCooldown),
+
+		ReplicaOperations: replicaOperations,
+		ConnectionOptions: func(clientOptions valkey.ClientOption) (valkey.ClientOption, []ConnectionWatcher, error) {
+			return m.connectionOptions(ctx, clientOptions)
+		},
+	}
+
+	// Load the storage to migrate from if present
+	if m.MigrateFromRaw != nil {
+		migrateFrom, err := loadStorageModule(ctx, m, "MigrateFromRaw", "migrate_from")
+		if err != nil {
+			return err
+		}
+
+		m.logger.Info("migrating entries on access from other storage", zap.String("migrate_from", fmt.Sprintf("%T", migrateFrom)), zap.Bool("migrate_from_delete", m.MigrateFromDelete))
+		options.MigrateFrom = migrateFrom
+		options.MigrateDeletes = m.MigrateFromDelete
+	}
+
+	// Load the storage to mirror to if present
+	if m.MirrorRaw != nil {
+		// Caddy cleans up the modules of a context in no particular order, so
+		// the mirror gets its own context cleaned up after the queue is flushed
+		mirrorCtx, mirrorCancel := caddy.NewContext(ctx)
+		m.mirrorCancel = mirrorCancel
+
+		mirror, err := loadStorageModule(mirrorCtx, m, "MirrorRaw", "mirror")
+		if err != nil {
+			return err
+		}
+
+		m.logger.Info("mirroring writes to other storage", zap.String("mirror", fmt.Sprintf("%T", mirror)), zap.Int("mirror_queue_size", m.MirrorQueueSize))
+		options.MirrorTo = mirror
+		options.MirrorQueueSize = m.MirrorQueueSize
+	}
+
+	// Provision a new storage instance
+	valkeyStorage, err := NewCaddyStorageValkey(*clientOptions, options)
+
+	if err != nil {
+		return err
 	}
-	return !info.IsDir()
-}
 
-func checkPemStringOrFilepath(val string) (bool, error) {
-	if cert, _ := pem.Decode([]byte(val)); cert == nil {
-		if !isFilePath(val) {
-			return false, errors.New("value is no certificate or filepath")
-		}
+	// Entries written by a newer version of this module could be damaged
+	if err := valkeyStorage.CheckSchemaVersion(ctx); err != nil {
+		valkeyStorage.Close()
+		return err
 	}
 
-	return true, nil
-}
-
-func validatePemStringOrFilepathOption(val string) bool {
-	// Not setting the options is valid
-	if len(val) == 0 {
-		return true
+	// Fail on start instead of on the first renewal of a certificate
+	if m.VerifyOnStart {
+		if err := valkeyStorage.Verify(ctx); err != nil {
+			valkeyStorage.Close()
+			return err
+		}
 	}
 
-	// Check if it is a PEM string or filepath
-	ok, err := checkPemStringOrFilepath(val)
+	m.storage = valkeyStorage
 
-	return ok && err == nil
+	return nil
 }
 
-func (m *StorageValkeyModule) Provision(ctx caddy.Context) error {
-	// Replace placeholders in relevant configuration options with their actual values
+// connectionOptions completes the client options of a new connection. The
+// discoveries, TLS settings, client certificates and the node prober read
+// files, resolve or dial nodes or run in the background, so they are only built
+// for a new connection and never for a reused pooled one.
+func (m *StorageValkeyModule) connectionOptions(ctx caddy.Context, clientOptions valkey.ClientOption) (valkey.ClientOption, []ConnectionWatcher, error) {
+	// Discover the addresses through SRV records or from the primary, which the
+	// dial function maps to the current nodes on every reconnect
+	var watchers []ConnectionWatcher
+	var mappings []*addressMapping
+
+	if len(m.AddressSrv) > 0 {
+		discovery, err := newSrvDiscovery(m.AddressSrv, false, time.Duration(m.SrvRefreshInterval), net.DefaultResolver, m.logger)
+		if err != nil {
+			return clientOptions, nil, err
+		}
 
-	repl := caddy.NewReplacer()
+		clientOptions.InitAddress = discovery.addresses()
+		watchers = append(watchers, discovery)
+		mappings = append(mappings, discovery.addressMapping)
+	}
 
-	m.Url = repl.ReplaceAll(m.Url, "")
-	m.Username = repl.ReplaceAll(m.Username, "")
-	m.Password = repl.ReplaceAll(m.Password, "")
-	m.TlsCaCert = repl.ReplaceAll(m.TlsCaCert, "")
-	m.TlsClientCert = repl.ReplaceAll(m.TlsClientCert, "")
-	m.TlsClientKey = repl.ReplaceAll(m.TlsClientKey, "")
+	var replicaAddress []string
+	if len(m.ReplicaSrv) > 0 {
+		discovery, err := newSrvDiscovery(m.ReplicaSrv, true, time.Duration(m.SrvRefreshInterval), net.DefaultResolver, m.logger)
+		if err != nil {
+			return clientOptions, nil, err
+		}
 
-	for i := range m.InitAddress {
-		m.InitAddress[i] = repl.ReplaceAll(m.InitAddress[i], "")
-	}
-	for i := range m.ReplicaAddress {
-		m.ReplicaAddress[i] = repl.ReplaceAll(m.ReplicaAddress[i], "")
-	}
+		replicaAddress = discovery.addresses()
+		watchers = append(watchers, discovery)
+		mappings = append(mappings, discovery.addressMapping)
+	} else if m.ReplicaDiscovery != nil {
+		if len(clientOptions.InitAddress) == 0 {
+			return clientOptions, nil, errors.New("the `replica_discovery` option requires the address of the primary")
+		}
 
-	// Apply defaults where required
+		// Reads are sent to the primary until the first replicas are discovered
+		discovery := newReplicaDiscovery(*m.ReplicaDiscovery, clientOptions.InitAddress[0], m.logger)
 
-	if m.LockMajority < 1 {
-		m.LockMajority = 2
+		replicaAddress = discovery.addresses()
+		watchers = append(watchers, discovery)
+		mappings = append(mappings, discovery.addressMapping)
+	} else {
+		replicaAddress = unixSocketPaths(m.ReplicaAddress)
 	}
 
-	// Create a new client options object based on the parsed config
-	var clientOptions *valkey.ClientOption
+	// Connect to unix sockets, through the proxy and to discovered nodes with our own dial function
+	if len(m.Proxy) > 0 || len(mappings) > 0 || slices.ContainsFunc(m.InitAddress, isUnixAddress) || slices.ContainsFunc(m.ReplicaAddress, isUnixAddress) {
+		var proxyUrl *url.URL
+		if len(m.Proxy) > 0 {
+			parsedProxyUrl, err := validateProxyUrl(m.Proxy)
+			if err != nil {
+				return clientOptions, nil, err
+			}
+			proxyUrl = parsedProxyUrl
+		}
 
-	if m.Url != "" {
-		optionsFromUrl, err := valkey.ParseURL(m.Url)
+		clientOptions.DialCtxFn = newDialCtxFn(proxyUrl)
+	}
+
+	// Reloaded CA certificates are verified against the address actually dialed
+	var tlsReloaders []*tlsReloader
 
+	// Apply the TLS options if any TLS option has been set
+	if tlsOptions := m.tlsOptions(); tlsOptions.isConfigured() || m.TlsClientPki != nil || m.TlsClientLoader != nil {
+		tlsConfig, tlsReloader, err := tlsOptions.apply(clientOptions.TLSConfig, m.logger)
 		if err != nil {
-			return err
+			return clientOptions, nil, err
 		}
-
-		clientOptions = &optionsFromUrl
-	} else {
-		clientOptions = &valkey.ClientOption{
-			InitAddress: m.InitAddress,
-			SelectDB:    m.SelectDb,
+		clientOptions.TLSConfig = tlsConfig
+		if tlsReloader != nil {
+			tlsReloaders = append(tlsReloaders, tlsReloader)
 		}
 	}
 
-	// Check whether any TLS option has been set
-	isTlsConfigured := (m.TlsInsecure ||
-		len(m.TlsMinVersion) > 0 ||
-		len(m.TlsCaCert) > 0 ||
-		len(m.TlsClientCert) > 0 ||
-		len(m.TlsClientKey) > 0)
+	// Issue the client certificate with an authority of the pki app
+	if m.TlsClientPki != nil {
+		pkiClientCertificate, err := newPkiClientCertificate(ctx, *m.TlsClientPki, m.logger)
+		if err != nil {
+			return clientOptions, nil, err
+		}
+		clientOptions.TLSConfig.GetClientCertificate = pkiClientCertificate.getClientCertificate
+	}
 
-	if isTlsConfigured {
-		// Initialize client TLS config if not present
-		// NOTE: It can be present when we parse the URL and it has the TLS mentioned
-		if clientOptions.TLSConfig == nil {
-			clientOptions.TLSConfig = &tls.Config{
-				InsecureSkipVerify: m.TlsInsecure,
-			}
-		} else {
-			clientOptions.TLSConfig.InsecureSkipVerify = m.TlsInsecure
+	// Load the client certificate with the certificate loaders of the tls app
+	if m.TlsClientLoader != nil {
+		loaderClientCertificate, err := newLoaderClientCertificate(ctx, *m.TlsClientLoader, m.logger)
+		if err != nil {
+			return clientOptions, nil, err
 		}
+		clientOptions.TLSConfig.GetClientCertificate = loaderClientCertificate.getClientCertificate
+	}
 
-		// Set min version, or fallback to default
-		if len(m.TlsMinVersion) > 0 {
-			switch m.TlsMinVersion {
-			case "tlsv1.2":
-				clientOptions.TLSConfig.MinVersion = tls.VersionTLS12
-			case "tlsv1.3":
-				clientOptions.TLSConfig.MinVersion = tls.VersionTLS13
-			default:
-				return errors.New("invalid value for `tls_min_version`")
+	// Apply the separate TLS settings for connecting to the sentinels
+	if m.Sentinel != nil {
+		if tlsOptions := m.Sentinel.tlsOptions(); tlsOptions.isConfigured() {
+			tlsConfig, tlsReloader, err := tlsOptions.apply(clientOptions.Sentinel.TLSConfig, m.logger)
+			if err != nil {
+				return clientOptions, nil, err
 			}
-		} else {
-			// Default is TLS v1.2
-			clientOptions.TLSConfig.MinVersion = tls.VersionTLS12
-		}
-
-		// Initialize CA Certificate if present
-		if len(m.TlsCaCert) > 0 {
-			caCertPool := x509.NewCertPool()
-			if certData, _ := pem.Decode([]byte(m.TlsCaCert)); certData != nil {
-				if cert, err := x509.ParseCertificate(certData.Bytes); err == nil {
-					caCertPool.AddCert(cert)
-				} else {
-					return errors.New("failed to add `tls_ca_cert` PEM string to certificate pool")
-				}
-			} else if isFilePath(m.TlsCaCert) {
-				cert, err := os.ReadFile(m.TlsCaCert)
-				if err != nil {
-					return err
-				}
-				if ok := caCertPool.AppendCertsFromPEM(cert); !ok {
-					return errors.New("failed to add `tls_ca_cert` file content to certificate pool")
-				}
-			} else {
-				return errors.New("failed to add `tls_ca_cert` is no PEM string or filepath")
+			clientOptions.Sentinel.TLSConfig = tlsConfig
+			if tlsReloader != nil {
+				tlsReloaders = append(tlsReloaders, tlsReloader)
 			}
-			clientOptions.TLSConfig.RootCAs = caCertPool
 		}
+	}
 
-		// Configure client certificate
-		if len(m.TlsClientCert) > 0 || len(m.TlsClientKey) > 0 {
-			// SMall sanity check
-			if len(m.TlsClientCert) > 0 && len(m.TlsClientKey) == 0 {
-				return errors.New("both client certificate and key need to be provided, key is missing")
-			} else if len(m.TlsClientCert) == 0 && len(m.TlsClientKey) > 0 {
-				return errors.New("both client certificate and key need to be provided, certificate is missing")
+	// The addresses are mapped first, so the certificates are verified against
+	// the nodes behind them. The replicas discovered last may fall back to the
+	// primary given by the SRV records.
+	for _, tlsReloader := range tlsReloaders {
+		clientOptions.DialCtxFn = tlsReloader.dialCtxFn(clientOptions.DialCtxFn)
+	}
+	for _, mapping := range mappings {
+		clientOptions.DialCtxFn = mapping.dialCtxFn(clientOptions.DialCtxFn)
+	}
+
+	// Add replica addresses when entries present, which only receive the
+	// commands of the replica operations unless configured otherwise
+	if len(replicaAddress) > 0 {
+		clientOptions.Standalone.ReplicaAddress = replicaAddress
+		if clientOptions.SendToReplicas == nil {
+			clientOptions.SendToReplicas = func(cmd valkey.Completed) bool {
+				return false
 			}
+		}
+	}
 
-			var certPem []byte
-			var keyPem []byte
+	// Probe the nodes for choosing the replica by latency or skipping lagging replicas
+	if m.ReadNodeSelector == "lowest_latency" || m.MaxReplicaLag > 0 {
+		prober := newNodeProber(clientOptions, time.Duration(m.NodeProbeInterval), int64(m.MaxReplicaLag), m.logger)
 
-			// NOTE: The following two blocks have been copied in order to keep the verbose error messages
+		// Without a selector choosing from the replicas left, the lowest latency is chosen
+		base := clientOptions.ReadNodeSelector
+		if base == nil && m.ReadNodeSelector != "lowest_latency" {
+			base = randomReplica
+		}
 
-			if certData, _ := pem.Decode([]byte(m.TlsClientCert)); certData != nil {
-				certPem = []byte(m.TlsClientCert)
-			} else if isFilePath(m.TlsClientCert) {
-				rawCert, err := os.ReadFile(m.TlsClientCert)
-				if err != nil {
-					return err
-				}
-				if certData, _ := pem.Decode(rawCert); certData != nil {
-					certPem = rawCert
-				} else {
-					return errors.New("invalid PEM in `tls_client_cert` file")
-				}
-			} else {
-				return errors.New("failed to add `tls_client_cert` is no PEM string or filepath")
-			}
+		clientOptions.ReadNodeSelector = prober.selector(base)
+		watchers = append(watchers, prober)
+	}
 
-			if keyData, _ := pem.Decode([]byte(m.TlsClientKey)); keyData != nil {
-				keyPem = []byte(m.TlsClientKey)
-			} else if isFilePath(m.TlsClientKey) {
-				rawKey, err := os.ReadFile(m.TlsClientKey)
-				if err != nil {
-					return err
-				}
-				if keyData, _ := pem.Decode(rawKey); keyData != nil {
-					keyPem = rawKey
-				} else {
-					return errors.New("invalid PEM in `tls_client_key` file")
-				}
-			} else {
-				return errors.New("failed to add `tls_client_key` is no PEM string or filepath")
-			}
+	// Standalone clients only offer their nodes to the selector with the AZ info
+	if clientOptions.ReadNodeSelector != nil {
+		clientOptions.EnableReplicaAZInfo = true
+	}
 
-			// Build certificate out of keypair
-			clientCertificate, err := tls.X509KeyPair(certPem, keyPem)
+	return clientOptions, watchers, nil
+}
+
+// connectionPoolKey identifies the effective connection config, which are all
+// options except the ones only affecting the storage itself.
+func (m StorageValkeyModule) connectionPoolKey() (string, error) {
+	m.Layout = nil
+	m.SlowOperationThreshold = 0
+	m.ReadTimeout = 0
+	m.WriteTimeout = 0
+	m.ListTimeout = 0
+	m.LockTimeout = 0
+	m.MaxRetries = 0
+	m.CircuitBreakerThreshold = 0
+	m.CircuitBreakerCooldown = 0
+	m.VerifyOnStart = false
+	m.MigrateFromRaw = nil
+	m.MigrateFromDelete = false
+	m.MirrorRaw = nil
+	m.MirrorQueueSize = 0
+
+	// Rotated certificates in referenced files require a new connection, unless
+	// the connection reads them again by itself
+	files := []*string{&m.TlsCaCert, &m.TlsClientCert, &m.TlsClientKey}
+	m.TlsCaCerts = slices.Clone(m.TlsCaCerts)
+	for i := range m.TlsCaCerts {
+		files = append(files, &m.TlsCaCerts[i])
+	}
+	for _, file := range files {
+		if isFilePath(*file) && !m.TlsReload {
+			content, err := os.ReadFile(*file)
 			if err != nil {
-				return err
+				return "", err
 			}
-
-			// Given we have a client certificate, we require and verify everything for security purposes
-			clientOptions.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
-			clientOptions.TLSConfig.Certificates = []tls.Certificate{clientCertificate}
+			*file += "\n" + string(content)
 		}
 	}
 
-	// Set username and password connection details
-	if len(m.Username) > 0 {
-		clientOptions.Username = m.Username
-	}
-	if len(m.Password) > 0 {
-		clientOptions.Password = m.Password
+	config, err := json.Marshal(m)
+	if err != nil {
+		return "", err
 	}
 
-	// Add replica addresses when entries present
-	if len(m.ReplicaAddress) > 0 {
-		clientOptions.Standalone.ReplicaAddress = m.ReplicaAddress
-		clientOptions.SendToReplicas = func(cmd valkey.Completed) bool {
-			return false
-		}
-	}
+	// Avoid keeping any secrets of the config around as key
+	hash := sha256.Sum256(config)
 
-	// Transfer Disable Client Cache option
-	clientOptions.DisableCache = m.DisableClientCache
+	return hex.EncodeToString(hash[:]), nil
+}
 
-	// Set SendToReplicas readonly strategy if present
-	if m.SendToReplicas == "readonly" {
-		clientOptions.SendToReplicas = func(cmd valkey.Completed) bool {
-			return cmd.IsReadOnly()
-		}
+func loadStorageModule(ctx caddy.Context, m *StorageValkeyModule, fieldName string, configKey string) (certmagic.Storage, error) {
+	val, err := ctx.LoadModule(m, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("loading storage module for `%s`: %v", configKey, err)
 	}
 
-	// Create caddy valkey storage specific options
-	options := CaddyStorageValkeyOptions{
-		LockMajority: m.LockMajority,
+	storageConverter, ok := val.(caddy.StorageConverter)
+	if !ok {
+		return nil, fmt.Errorf("module for `%s` is not a storage module", configKey)
 	}
 
-	// Provision a new storage instance
-	valkeyStorage, err := NewCaddyStorageValkey(*clientOptions, options)
-
+	storage, err := storageConverter.CertMagicStorage()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("creating storage for `%s`: %v", configKey, err)
 	}
 
-	m.storage = valkeyStorage
-
-	return nil
+	return storage, nil
 }
 
 func (m *StorageValkeyModule) Validate() error {
@@ -477,6 +1799,36 @@ func (m *StorageValkeyModule) Validate() error {
 		return errors.New("setting the `address` and `url` option is not allowed")
 	}
 
+	// The SRV records replace the static addresses
+	if len(m.AddressSrv) > 0 && (len(m.InitAddress) > 0 || isUrlSet) {
+		return errors.New("setting the `address_srv` and `address` or `url` option is not allowed")
+	}
+
+	if len(m.ReplicaSrv) > 0 && len(m.ReplicaAddress) > 0 {
+		return errors.New("setting the `replica_srv` and `replica` option is not allowed")
+	}
+
+	// The replicas are either given or discovered
+	if m.ReplicaDiscovery != nil {
+		if err := m.ReplicaDiscovery.validate(); err != nil {
+			return err
+		}
+
+		if len(m.ReplicaAddress) > 0 || len(m.ReplicaSrv) > 0 {
+			return errors.New("setting the `replica_discovery` and `replica` or `replica_srv` option is not allowed")
+		}
+
+		if len(m.SentinelMasterSet) > 0 || m.Sentinel != nil {
+			return errors.New("the `replica_discovery` option requires a standalone primary and can not be used with sentinels")
+		}
+	}
+
+	if m.SrvRefreshInterval < 0 {
+		return errors.New("impossible value for `srv_refresh_interval` option (value >= 0 required)")
+	} else if m.SrvRefreshInterval > 0 && len(m.AddressSrv) == 0 && len(m.ReplicaSrv) == 0 {
+		return errors.New("the `srv_refresh_interval` option requires `address_srv` or `replica_srv`")
+	}
+
 	if len(m.Username) > 0 && isUrlSet {
 		return errors.New("setting the `username` and `url` option is not allowed")
 	}
@@ -485,17 +1837,190 @@ func (m *StorageValkeyModule) Validate() error {
 		return errors.New("setting the `password` and `url` option is not allowed")
 	}
 
+	// Check the credentials sources, which replace the static credentials
+	if m.Credentials != nil {
+		if err := m.Credentials.validate(); err != nil {
+			return err
+		}
+
+		if len(m.Password) > 0 {
+			return errors.New("setting the `password` and `credentials` option is not allowed")
+		}
+
+		if len(m.Username) > 0 && (len(m.Credentials.UsernameFile) > 0 || len(m.Credentials.UsernameEnv) > 0) {
+			return errors.New("setting the `username` and `credentials.username_file` or `credentials.username_env` option is not allowed")
+		}
+
+		// The client would authenticate at the sentinels with the same credentials
+		if len(m.SentinelMasterSet) > 0 || m.Sentinel != nil {
+			return errors.New("the `credentials` block can not be used with sentinels, use `username` and `password` instead")
+		}
+	}
+
 	// NOTE: I'm aware that setting the db option can be set to zero, but this is the default
 	// and doesn't change the behavior in any way. The workaround is not worth it.
 	if m.SelectDb != 0 && isUrlSet {
 		return errors.New("setting the `db` and `url` option is not allowed")
 	}
 
+	// Unix sockets are local and never use TLS or the proxy
+	hasUnixAddress := (slices.ContainsFunc(m.InitAddress, isUnixAddress) ||
+		slices.ContainsFunc(m.ReplicaAddress, isUnixAddress) ||
+		isUnixAddress(m.Url))
+
+	if len(m.Proxy) > 0 {
+		if _, err := validateProxyUrl(m.Proxy); err != nil {
+			return err
+		}
+
+		if hasUnixAddress {
+			return errors.New("setting the `proxy` option and unix socket addresses is not allowed")
+		}
+	}
+
+	if hasUnixAddress && (m.tlsOptions().isConfigured() || m.TlsClientPki != nil || m.TlsClientLoader != nil) {
+		return errors.New("TLS options can not be used with unix socket addresses")
+	}
+
+	for _, address := range append(slices.Clone(m.InitAddress), m.ReplicaAddress...) {
+		if isUnixAddress(address) && !strings.HasPrefix(unixSocketPath(address), "/") {
+			return fmt.Errorf("invalid unix socket address '%s' (absolute path required, e.g. unix:///run/valkey.sock)", address)
+		}
+	}
+
+	if m.ClusterShardsRefreshInterval < 0 {
+		return errors.New("impossible value for `cluster_shards_refresh_interval` option (value >= 0 required)")
+	}
+
+	// Only reads are possible on replicas
+	if m.ReplicaOnly {
+		if len(m.ReplicaAddress) > 0 || len(m.ReplicaSrv) > 0 || m.ReplicaDiscovery != nil || (len(m.SendToReplicas) > 0 && m.SendToReplicas != "none") {
+			return errors.New("setting the `replica_only` and `replica`, `replica_srv`, `replica_discovery` or `send_to_replicas` option is not allowed")
+		}
+
+		if m.ForceSingleClient {
+			return errors.New("setting the `replica_only` and `force_single_client` option is not allowed")
+		}
+
+		if m.Layout == nil || !m.Layout.ReadOnly {
+			return errors.New("the `replica_only` option requires a `layout` with `read_only`")
+		}
+	}
+
+	// Check ReadNodeSelector for valid strategy
+	switch m.ReadNodeSelector {
+	case "":
+		break
+	case "prefer_replica", "lowest_latency":
+		if len(m.ReadNodeAz) > 0 {
+			return errors.New("the `read_node_az` option is only used by the `az_affinity` selectors")
+		}
+	case "az_affinity", "az_affinity_replicas_and_primary":
+		if len(m.ReadNodeAz) == 0 {
+			return errors.New("the `az_affinity` selectors require the `read_node_az` option")
+		}
+	default:
+		return errors.New("invalid value for `read_node_selector`")
+	}
+
+	// The selector only applies to commands sent to replicas
+	if len(m.ReadNodeSelector) > 0 && (len(m.SendToReplicas) == 0 || m.SendToReplicas == "none") {
+		return errors.New("the `read_node_selector` option requires `send_to_replicas`")
+	}
+
+	if len(m.ReadNodeAz) > 0 && len(m.ReadNodeSelector) == 0 {
+		return errors.New("the `read_node_az` option requires `read_node_selector`")
+	}
+
+	// Verify the connection and pipeline tuning options, where zero keeps the client defaults
+	connectionDurations := map[string]caddy.Duration{
+		"dial_timeout":       m.DialTimeout,
+		"dial_keep_alive":    m.DialKeepAlive,
+		"conn_write_timeout": m.ConnWriteTimeout,
+		"max_flush_delay":    m.MaxFlushDelay,
+	}
+	for configKey, duration := range connectionDurations {
+		if duration < 0 {
+			return fmt.Errorf("impossible value for `%s` option (value >= 0 required)", configKey)
+		}
+	}
+
+	connectionSizes := map[string]int{
+		"blocking_pool_size":     m.BlockingPoolSize,
+		"ring_scale_each_conn":   m.RingScaleEachConn,
+		"read_buffer_each_conn":  m.ReadBufferEachConn,
+		"write_buffer_each_conn": m.WriteBufferEachConn,
+	}
+	for configKey, size := range connectionSizes {
+		if size < 0 {
+			return fmt.Errorf("impossible value for `%s` option (value >= 0 required)", configKey)
+		}
+	}
+
+	// The client refuses to connect with client side caching over RESP2
+	if m.AlwaysResp2 && !m.DisableClientCache {
+		return errors.New("the `always_resp2` option requires `disable_client_cache`, as client side caching requires RESP3")
+	}
+
+	// The client uses 2^pipeline_multiplex connections per node
+	if m.PipelineMultiplex < 0 || m.PipelineMultiplex > valkey.MaxPipelineMultiplex {
+		return fmt.Errorf("impossible value for `pipeline_multiplex` option (value between 0 and %d required)", valkey.MaxPipelineMultiplex)
+	}
+
+	// The ring of each connection has 2^ring_scale_each_conn entries
+	if m.RingScaleEachConn > MAX_RING_SCALE_EACH_CONN {
+		return fmt.Errorf("impossible value for `ring_scale_each_conn` option (value <= %d required)", MAX_RING_SCALE_EACH_CONN)
+	}
+
+	// Smaller buffers would silently be replaced by the client defaults
+	if (m.ReadBufferEachConn > 0 && m.ReadBufferEachConn < MIN_BUFFER_EACH_CONN) || (m.WriteBufferEachConn > 0 && m.WriteBufferEachConn < MIN_BUFFER_EACH_CONN) {
+		return fmt.Errorf("impossible value for `read_buffer_each_conn` or `write_buffer_each_conn` option (value >= %d required)", MIN_BUFFER_EACH_CONN)
+	}
+
+	// Negative durations would never be reached
+	if m.SlowOperationThreshold < 0 {
+		return errors.New("impossible value for `slow_operation_threshold` option (value >= 0 required)")
+	}
+
+	// Zero disables the timeouts, negative ones would expire immediately
+	if m.ReadTimeout < 0 || m.WriteTimeout < 0 || m.ListTimeout < 0 || m.LockTimeout < 0 {
+		return errors.New("impossible value for `read_timeout`, `write_timeout`, `list_timeout` or `lock_timeout` option (value >= 0 required)")
+	}
+
+	if m.MaxRetries < 0 {
+		return errors.New("impossible value for `max_retries` option (value >= 0 required)")
+	}
+
+	if m.CircuitBreakerThreshold < 0 || m.CircuitBreakerCooldown < 0 {
+		return errors.New("impossible value for `circuit_breaker_threshold` or `circuit_breaker_cooldown` option (value >= 0 required)")
+	}
+
+	// Negative queue sizes are replaced by the default, but are most likely a mistake
+	if m.MirrorQueueSize < 0 {
+		return errors.New("impossible value for `mirror_queue_size` option (value >= 0 required)")
+	}
+
+	if m.MigrateFromDelete && m.MigrateFromRaw == nil {
+		return errors.New("the `migrate_from_delete` option requires `migrate_from`")
+	}
+
+	// Check the layout and its options
+	if m.Layout != nil {
+		if err := m.Layout.validate(); err != nil {
+			return err
+		}
+	}
+
 	// Check for sensible value on lock majority
 	if m.LockMajority < 1 {
 		return errors.New("impossible value for `lock_majority` option (value > 0 required)")
 	}
 
+	// The locker needs to read the lock keys from the primary
+	if m.ShareLockClient && (len(m.ReplicaAddress) > 0 || len(m.ReplicaSrv) > 0 || m.ReplicaDiscovery != nil || len(m.SendToReplicas) > 0 && m.SendToReplicas != "none") {
+		return errors.New("setting the `share_lock_client` and `replica`, `replica_srv`, `replica_discovery` or `send_to_replicas` option is not allowed")
+	}
+
 	// Check SendToReplicas for valid strategy
 	switch m.SendToReplicas {
 	case "", "none":
@@ -504,40 +2029,115 @@ func (m *StorageValkeyModule) Validate() error {
 	case "readonly":
 		// This option sends readonly commands to the replica
 		break
+	case "operations":
+		// This option sends the commands of the replica operations to the replica
+		break
 	default:
 		return errors.New("invalid value for `send_to_replicas`")
 	}
 
-	// Verify TLS min version
-	switch m.TlsMinVersion {
-	case "", "tlsv1.2":
-		// This is the default option
-		break
-	case "tlsv1.3":
-		break
-	default:
-		return errors.New("invalid value for `tls_min_version`")
+	// Only reads can be sent to replicas
+	for _, operation := range m.ReplicaOperations {
+		switch operation {
+		case OPERATION_LOAD, OPERATION_EXISTS, OPERATION_LIST, OPERATION_STAT:
+			break
+		default:
+			return fmt.Errorf("invalid operation '%s' for `replica_operations` (load, exists, list or stat required)", operation)
+		}
+	}
+
+	if len(m.ReplicaOperations) > 0 && m.SendToReplicas != "operations" {
+		return errors.New("the `replica_operations` option requires `send_to_replicas operations`")
 	}
 
-	// Verify TLS options are PEM or filepaths
-	if !validatePemStringOrFilepathOption(m.TlsCaCert) {
-		return errors.New("given value is no PEM string or filepath for key `tls_ca_cert`")
+	if m.MaxReplicaLag < 0 {
+		return errors.New("impossible value for `max_replica_lag` option (value >= 0 required)")
+	} else if m.MaxReplicaLag > 0 && (len(m.SendToReplicas) == 0 || m.SendToReplicas == "none") {
+		return errors.New("the `max_replica_lag` option requires `send_to_replicas`")
 	}
-	if !validatePemStringOrFilepathOption(m.TlsClientCert) {
-		return errors.New("given value is no PEM string or filepath for key `tls_client_cert`")
+
+	if m.NodeProbeInterval < 0 {
+		return errors.New("impossible value for `node_probe_interval` option (value >= 0 required)")
+	} else if m.NodeProbeInterval > 0 && m.ReadNodeSelector != "lowest_latency" && m.MaxReplicaLag == 0 {
+		return errors.New("the `node_probe_interval` option requires `read_node_selector lowest_latency` or `max_replica_lag`")
+	}
+
+	// Verify TLS options
+	if err := m.tlsOptions().validate(); err != nil {
+		return err
+	}
+
+	// The client certificate is either given or issued
+	if m.TlsClientPki != nil {
+		if err := m.TlsClientPki.validate(); err != nil {
+			return err
+		}
+
+		if len(m.TlsClientCert) > 0 || len(m.TlsClientKey) > 0 {
+			return errors.New("setting the `tls_client_pki` and `tls_client_cert` or `tls_client_key` option is not allowed")
+		}
+	}
+
+	if m.TlsClientLoader != nil {
+		if err := m.TlsClientLoader.validate(); err != nil {
+			return err
+		}
+
+		if m.TlsClientPki != nil {
+			return errors.New("setting the `tls_client_loader` and `tls_client_pki` option is not allowed")
+		}
+
+		if len(m.TlsClientCert) > 0 || len(m.TlsClientKey) > 0 {
+			return errors.New("setting the `tls_client_loader` and `tls_client_cert` or `tls_client_key` option is not allowed")
+		}
 	}
-	if !validatePemStringOrFilepathOption(m.TlsClientKey) {
-		return errors.New("given value is no PEM string or filepath for key `tls_client_key`")
+
+	// Verify the sentinel block
+	if m.Sentinel != nil {
+		if len(m.SentinelMasterSet) > 0 && len(m.Sentinel.MasterSet) > 0 {
+			return errors.New("setting the `sentinel_master_set` and `sentinel.master_set` option is not allowed")
+		}
+
+		// Without a master set, the addresses are no sentinels
+		if len(m.SentinelMasterSet) == 0 && len(m.Sentinel.MasterSet) == 0 && !isUrlSet {
+			return errors.New("the `sentinel` block requires the `master_set` option")
+		}
+
+		if err := m.Sentinel.tlsOptions().validate(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func (m *StorageValkeyModule) tlsOptions() tlsOptions {
+	return tlsOptions{
+		Insecure:     m.TlsInsecure,
+		MinVersion:   m.TlsMinVersion,
+		MaxVersion:   m.TlsMaxVersion,
+		ServerName:   m.TlsServerName,
+		CipherSuites: m.TlsCipherSuites,
+		Curves:       m.TlsCurves,
+		CaCert:       m.TlsCaCert,
+		CaCerts:      m.TlsCaCerts,
+		SystemRoots:  m.TlsSystemRoots,
+		ClientCert:   m.TlsClientCert,
+		ClientKey:    m.TlsClientKey,
+		Reload:       m.TlsReload,
+	}
+}
+
 func (m StorageValkeyModule) Cleanup() error {
 	if m.storage != nil {
 		m.storage.Close()
 	}
 
+	// The mirror is released only after the storage has flushed its queue
+	if m.mirrorCancel != nil {
+		m.mirrorCancel()
+	}
+
 	return nil
 }
 
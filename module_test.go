@@ -0,0 +1,151 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/valkey-io/valkey-go"
+)
+
+func TestTuningOptionsUnmarshalCaddyfile(t *testing.T) {
+	m := StorageValkeyModule{}
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`valkey {
+		dial_timeout 5s
+		dial_keep_alive 1m
+		conn_write_timeout 1m30s
+		blocking_pool_size 100
+		pipeline_multiplex 2
+		ring_scale_each_conn 8
+		read_buffer_each_conn 65536
+		write_buffer_each_conn 32768
+		max_flush_delay 100us
+		disable_auto_pipelining true
+		always_resp2 true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := StorageValkeyModule{
+		DialTimeout:           caddy.Duration(5 * time.Second),
+		DialKeepAlive:         caddy.Duration(time.Minute),
+		ConnWriteTimeout:      caddy.Duration(90 * time.Second),
+		BlockingPoolSize:      100,
+		PipelineMultiplex:     2,
+		RingScaleEachConn:     8,
+		ReadBufferEachConn:    65536,
+		WriteBufferEachConn:   32768,
+		MaxFlushDelay:         caddy.Duration(100 * time.Microsecond),
+		DisableAutoPipelining: true,
+		AlwaysResp2:           true,
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected tuning options %+v, got %+v", expected, m)
+	}
+
+	for _, input := range []string{"dial_timeout 5", "dial_timeout 5s 10s", "blocking_pool_size many", "always_resp2 maybe"} {
+		m := StorageValkeyModule{}
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("valkey {\n" + input + "\n}")); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestTuningOptionsValidate(t *testing.T) {
+	tests := map[string]struct {
+		module StorageValkeyModule
+		err    string
+	}{
+		"valid": {
+			module: StorageValkeyModule{DialTimeout: caddy.Duration(time.Second), PipelineMultiplex: 2, ReadBufferEachConn: MIN_BUFFER_EACH_CONN},
+		},
+		"negative duration": {
+			module: StorageValkeyModule{ConnWriteTimeout: caddy.Duration(-time.Second)},
+			err:    "impossible value for `conn_write_timeout` option (value >= 0 required)",
+		},
+		"negative size": {
+			module: StorageValkeyModule{BlockingPoolSize: -1},
+			err:    "impossible value for `blocking_pool_size` option (value >= 0 required)",
+		},
+		"pipeline multiplex": {
+			module: StorageValkeyModule{PipelineMultiplex: valkey.MaxPipelineMultiplex + 1},
+			err:    "impossible value for `pipeline_multiplex` option",
+		},
+		"ring scale": {
+			module: StorageValkeyModule{RingScaleEachConn: MAX_RING_SCALE_EACH_CONN + 1},
+			err:    "impossible value for `ring_scale_each_conn` option",
+		},
+		"resp2 with client cache": {
+			module: StorageValkeyModule{AlwaysResp2: true},
+			err:    "the `always_resp2` option requires `disable_client_cache`",
+		},
+		"small buffer": {
+			module: StorageValkeyModule{WriteBufferEachConn: MIN_BUFFER_EACH_CONN - 1},
+			err:    "impossible value for `read_buffer_each_conn` or `write_buffer_each_conn` option",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The defaults are set by Provision, which runs first
+			test.module.LockMajority = 2
+
+			err := test.module.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestTuningOptionsApplied(t *testing.T) {
+	server := newFakeValkey(t)
+
+	m := StorageValkeyModule{
+		InitAddress:        []string{server.address},
+		DialTimeout:        caddy.Duration(time.Second),
+		ConnWriteTimeout:   caddy.Duration(time.Second),
+		PipelineMultiplex:  1,
+		AlwaysResp2:        true,
+		DisableClientCache: true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Cleanup() })
+
+	if err := m.storage.Store(context.Background(), "certificates/example.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := m.storage.Load(context.Background(), "certificates/example.crt"); err != nil || string(value) != "certificate" {
+		t.Fatalf("expected the stored value, got %q: %v", value, err)
+	}
+	if err := m.storage.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.storage.Unlock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// RESP2 connections never switch the protocol to RESP3
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, hello := range server.hellos {
+		if len(hello) > 1 && hello[1] == "3" {
+			t.Fatalf("expected no RESP3 handshake with `always_resp2`, got %v", hello)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package caddystoragevalkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_PKI_COMMON_NAME = "caddy"
+	DEFAULT_PKI_LIFETIME    = 12 * time.Hour
+
+	// Client certificates are renewed after this share of their lifetime
+	PKI_RENEWAL_RATIO = 2.0 / 3.0
+)
+
+// PkiClientCertificateConfig selects the authority of the caddy pki app, which
+// issues the client certificate for the TLS connection with valkey.
+type PkiClientCertificateConfig struct {
+	// The id of the authority in the pki app
+	CA string `json:"ca,omitempty"`
+
+	CommonName string         `json:"common_name,omitempty"`
+	Lifetime   caddy.Duration `json:"lifetime,omitempty"`
+
+	// The storage containing the keys of the authority, which needs to be the same
+	// as the storage of the authority in the pki app. It is only used when valkey
+	// is the global storage, as the pki app is not available then
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+}
+
+func (c *PkiClientCertificateConfig) validate() error {
+	if c.Lifetime < 0 {
+		return errors.New("impossible value for `tls_client_pki.lifetime` option (value >= 0 required)")
+	}
+
+	return nil
+}
+
+// pkiClientCertificate issues client certificates signed by the intermediate of
+// an authority of the pki app and renews them before they expire.
+//
+// No context is kept, as a shared connection outlives the config it was
+// provisioned with. The intermediate is loaded from the pki app of the config
+// provisioned, which has the settings of the authority. When valkey is the
+// global storage, the pki app is provisioned after the storage, so the
+// intermediate is read from the storage of the authority instead. Renewed
+// intermediates are taken from the pki app of the running config.
+type pkiClientCertificate struct {
+	config PkiClientCertificateConfig
+	logger *zap.Logger
+
+	mu              sync.Mutex
+	intermediate    *x509.Certificate
+	intermediateKey crypto.Signer
+	certificate     *tls.Certificate
+	renewAt         time.Time
+}
+
+func newPkiClientCertificate(ctx caddy.Context, config PkiClientCertificateConfig, logger *zap.Logger) (*pkiClientCertificate, error) {
+	if len(config.CA) == 0 {
+		config.CA = caddypki.DefaultCAID
+	}
+	if len(config.CommonName) == 0 {
+		config.CommonName = DEFAULT_PKI_COMMON_NAME
+	}
+	if config.Lifetime == 0 {
+		config.Lifetime = caddy.Duration(DEFAULT_PKI_LIFETIME)
+	}
+
+	// Without storage, the authority would use the global storage, which is not
+	// available while the global storage itself is provisioned
+	if config.StorageRaw == nil && ctx.Storage() == nil {
+		return nil, errors.New("the `tls_client_pki.storage` option is required when valkey is the global storage, as the keys of the authority can not be stored in valkey itself")
+	}
+
+	p := &pkiClientCertificate{
+		config: config,
+		logger: logger.Named("pki"),
+	}
+
+	if err := p.loadAuthority(ctx, true); err != nil {
+		return nil, err
+	}
+
+	// Fail early on a broken authority instead of on the first handshake
+	if _, err := p.getClientCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// loadAuthority loads the intermediate of the authority, using the context only
+// while loading. While provisioning, the pki app of the provisioned config is
+// used, unless valkey is the global storage. Afterwards, the pki app of the
+// running config is used.
+func (p *pkiClientCertificate) loadAuthority(ctx caddy.Context, provisioning bool) error {
+	ca, err := p.pkiAppAuthority(ctx, provisioning)
+	if err != nil {
+		return fmt.Errorf("loading authority '%s' of `tls_client_pki`: %v", p.config.CA, err)
+	}
+
+	if ca == nil {
+		if !provisioning {
+			return fmt.Errorf("authority '%s' of `tls_client_pki` is not configured in the running pki app", p.config.CA)
+		}
+
+		return p.loadStoredAuthority(ctx)
+	}
+
+	intermediateKey, ok := ca.IntermediateKey().(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("intermediate key of authority '%s' can not sign", p.config.CA)
+	}
+	p.intermediate = ca.IntermediateCertificate()
+	p.intermediateKey = intermediateKey
+
+	return nil
+}
+
+// pkiAppAuthority returns the authority from the pki app of the context, or nil
+// when the pki app is not available.
+func (p *pkiClientCertificate) pkiAppAuthority(ctx caddy.Context, provisioning bool) (*caddypki.CA, error) {
+	// The pki app would be provisioned without storage while valkey is
+	// provisioned as the global storage
+	if provisioning && ctx.Storage() == nil {
+		return nil, nil
+	}
+
+	var app any
+	var err error
+	if provisioning {
+		app, err = ctx.App("pki")
+	} else {
+		// Only an app already loaded by the running config is used
+		app, err = ctx.AppIfConfigured("pki")
+		if errors.Is(err, caddy.ErrNotConfigured) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pkiApp, ok := app.(*caddypki.PKI)
+	if !ok {
+		return nil, fmt.Errorf("unexpected pki app of type %T", app)
+	}
+
+	if provisioning {
+		return pkiApp.GetCA(ctx, p.config.CA)
+	}
+
+	return pkiApp.CAs[p.config.CA], nil
+}
+
+// loadStoredAuthority reads the intermediate of the authority from the storage
+// of `tls_client_pki`, where the pki app stores it.
+func (p *pkiClientCertificate) loadStoredAuthority(ctx caddy.Context) error {
+	// Loading the module clears the raw config
+	config := p.config
+	val, err := ctx.LoadModule(&config, "StorageRaw")
+	if err != nil {
+		return fmt.Errorf("loading storage module of `tls_client_pki`: %v", err)
+	}
+	storage, err := val.(caddy.StorageConverter).CertMagicStorage()
+	if err != nil {
+		return fmt.Errorf("creating storage of `tls_client_pki`: %v", err)
+	}
+
+	prefix := path.Join("pki", "authorities", certmagic.StorageKeys.Safe(p.config.CA))
+
+	certPem, err := storage.Load(ctx, path.Join(prefix, "intermediate.crt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("authority '%s' of `tls_client_pki` has no intermediate in its storage yet, which the pki app creates on its first start with the same storage", p.config.CA)
+	} else if err != nil {
+		return fmt.Errorf("loading intermediate of authority '%s': %v", p.config.CA, err)
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return fmt.Errorf("decoding intermediate of authority '%s': no PEM block found", p.config.CA)
+	}
+	intermediate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("decoding intermediate of authority '%s': %v", p.config.CA, err)
+	}
+
+	keyPem, err := storage.Load(ctx, path.Join(prefix, "intermediate.key"))
+	if err != nil {
+		return fmt.Errorf("loading intermediate key of authority '%s': %v", p.config.CA, err)
+	}
+	intermediateKey, err := certmagic.PEMDecodePrivateKey(keyPem)
+	if err != nil {
+		return fmt.Errorf("decoding intermediate key of authority '%s': %v", p.config.CA, err)
+	}
+
+	p.intermediate = intermediate
+	p.intermediateKey = intermediateKey
+
+	return nil
+}
+
+func (p *pkiClientCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.certificate != nil && time.Now().Before(p.renewAt) {
+		return p.certificate, nil
+	}
+
+	certificate, err := p.issue()
+	if err != nil {
+		// Keep using the previous certificate while it is still valid
+		if p.certificate != nil && time.Now().Before(p.certificate.Leaf.NotAfter) {
+			p.logger.Error("renewing client certificate failed, keeping the previous one", zap.Time("not_after", p.certificate.Leaf.NotAfter), zap.Error(err))
+			return p.certificate, nil
+		}
+
+		return nil, err
+	}
+
+	p.certificate = certificate
+	p.renewAt = time.Now().Add(time.Duration(float64(time.Until(certificate.Leaf.NotAfter)) * PKI_RENEWAL_RATIO))
+	p.logger.Info("issued client certificate",
+		zap.String("ca", p.config.CA),
+		zap.String("common_name", p.config.CommonName),
+		zap.Time("not_after", certificate.Leaf.NotAfter),
+	)
+
+	return certificate, nil
+}
+
+// issue signs a new client certificate with the intermediate of the authority.
+func (p *pkiClientCertificate) issue() (*tls.Certificate, error) {
+	lifetime := time.Duration(p.config.Lifetime)
+
+	// The certificate can not outlive its intermediate, so the intermediate
+	// renewed by the pki app is loaded in that case
+	if time.Now().Add(lifetime).After(p.intermediate.NotAfter) {
+		if err := p.loadAuthority(caddy.ActiveContext(), false); err != nil {
+			if !time.Now().Before(p.intermediate.NotAfter) {
+				return nil, err
+			}
+			p.logger.Warn("loading the renewed intermediate failed, the client certificate expires with the current one", zap.Time("not_after", p.intermediate.NotAfter), zap.Error(err))
+		}
+	}
+
+	intermediate := p.intermediate
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow for some clock skew between caddy and valkey
+	now := time.Now()
+	notBefore := now.Add(-time.Minute)
+	notAfter := now.Add(lifetime)
+	if notAfter.After(intermediate.NotAfter) {
+		notAfter = intermediate.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: p.config.CommonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, intermediate, &key.PublicKey, p.intermediateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing client certificate with authority '%s': %v", p.config.CA, err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, intermediate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
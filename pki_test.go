@@ -0,0 +1,156 @@
+package caddystoragevalkey
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+	"go.uber.org/zap"
+)
+
+func TestPkiClientCertificateKeepsIntermediateWithoutRunningPkiApp(t *testing.T) {
+	ca := newTestCA(t, "intermediate")
+
+	p := &pkiClientCertificate{
+		config: PkiClientCertificateConfig{CA: "local", CommonName: "caddy", Lifetime: caddy.Duration(24 * time.Hour)},
+		logger: zap.NewNop(),
+
+		intermediate:    ca.cert,
+		intermediateKey: ca.key,
+	}
+
+	// No config is running, so the renewed intermediate can not be loaded and
+	// the certificate expires with the current intermediate
+	certificate, err := p.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.NotAfter.Equal(ca.cert.NotAfter) {
+		t.Fatalf("expected certificate to expire with intermediate at %s, got %s", ca.cert.NotAfter, certificate.Leaf.NotAfter)
+	}
+	if certificate.Leaf.Subject.CommonName != "caddy" {
+		t.Fatalf("expected common name caddy, got %s", certificate.Leaf.Subject.CommonName)
+	}
+	if err := certificate.Leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Fatalf("expected certificate signed by intermediate: %v", err)
+	}
+}
+
+func TestPkiClientCertificateFailsWithExpiredIntermediate(t *testing.T) {
+	ca := newTestCA(t, "intermediate")
+	ca.cert.NotAfter = time.Now().Add(-time.Minute)
+
+	p := &pkiClientCertificate{
+		config: PkiClientCertificateConfig{CA: "local", CommonName: "caddy", Lifetime: caddy.Duration(time.Hour)},
+		logger: zap.NewNop(),
+
+		intermediate:    ca.cert,
+		intermediateKey: ca.key,
+	}
+
+	if _, err := p.getClientCertificate(nil); err == nil {
+		t.Fatal("expected issuing with expired intermediate to fail")
+	}
+}
+
+func TestPkiClientCertificateRenewsAfterRenewAt(t *testing.T) {
+	ca := newTestCA(t, "intermediate")
+
+	p := &pkiClientCertificate{
+		config: PkiClientCertificateConfig{CA: "local", CommonName: "caddy", Lifetime: caddy.Duration(10 * time.Minute)},
+		logger: zap.NewNop(),
+
+		intermediate:    ca.cert,
+		intermediateKey: ca.key,
+	}
+
+	first, err := p.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(p.renewAt); until <= 0 || until > 10*time.Minute*2/3 {
+		t.Fatalf("expected renewal after 2/3 of the lifetime, got %s", until)
+	}
+
+	// Before renewAt the certificate is reused
+	cached, err := p.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != first {
+		t.Fatal("expected certificate to be reused before renewal")
+	}
+
+	p.mu.Lock()
+	p.renewAt = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+
+	renewed, err := p.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) == 0 {
+		t.Fatal("expected a new certificate after renewAt")
+	}
+	if renewed.Leaf.NotAfter.Before(first.Leaf.NotAfter) {
+		t.Fatalf("expected renewed certificate to expire not before %s, got %s", first.Leaf.NotAfter, renewed.Leaf.NotAfter)
+	}
+	if err := renewed.Leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Fatalf("expected renewed certificate signed by intermediate: %v", err)
+	}
+}
+
+func TestPkiClientCertificateLoadsRenewedIntermediateFromRunningPkiApp(t *testing.T) {
+	requireModuleLoading(t)
+
+	config, err := json.Marshal(map[string]any{
+		"admin":   map[string]any{"disabled": true, "config": map[string]any{"persist": false}},
+		"storage": map[string]any{"module": "file_system", "root": t.TempDir()},
+		"apps": map[string]any{
+			"pki": map[string]any{
+				"certificate_authorities": map[string]any{"local": map[string]any{"install_trust": false}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caddy.Load(config, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+
+	app, err := caddy.ActiveContext().AppIfConfigured("pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewedIntermediate := app.(*caddypki.PKI).CAs["local"].IntermediateCertificate()
+
+	// The current intermediate expires before a new client certificate would
+	ca := newTestCA(t, "intermediate")
+	ca.cert.NotAfter = time.Now().Add(time.Hour)
+
+	p := &pkiClientCertificate{
+		config: PkiClientCertificateConfig{CA: "local", CommonName: "caddy", Lifetime: caddy.Duration(12 * time.Hour)},
+		logger: zap.NewNop(),
+
+		intermediate:    ca.cert,
+		intermediateKey: ca.key,
+	}
+
+	certificate, err := p.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.intermediate != renewedIntermediate {
+		t.Fatal("expected the intermediate of the running pki app to be loaded")
+	}
+	if err := certificate.Leaf.CheckSignatureFrom(renewedIntermediate); err != nil {
+		t.Fatalf("expected certificate signed by the renewed intermediate: %v", err)
+	}
+	if !certificate.Leaf.NotAfter.After(ca.cert.NotAfter) {
+		t.Fatalf("expected certificate to outlive the previous intermediate at %s, got %s", ca.cert.NotAfter, certificate.Leaf.NotAfter)
+	}
+}
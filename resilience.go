@@ -0,0 +1,282 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// Retries of a single operation with a jittered exponential backoff, starting
+	// with the initial delay and capped at the maximum delay.
+	RETRY_INITIAL_DELAY = 100 * time.Millisecond
+	RETRY_MAX_DELAY     = 2 * time.Second
+
+	DEFAULT_CIRCUIT_BREAKER_COOLDOWN = 10 * time.Second
+
+	CIRCUIT_BREAKER_CLOSED    = "closed"
+	CIRCUIT_BREAKER_OPEN      = "open"
+	CIRCUIT_BREAKER_HALF_OPEN = "half_open"
+)
+
+// ErrCircuitOpen is returned without contacting valkey, while the circuit
+// breaker considers valkey to be unavailable.
+var ErrCircuitOpen = errors.New("valkey is unavailable, circuit breaker is open")
+
+// errOperationTimeout is the cause of a context ended by the operation timeouts,
+// which tells them apart from the deadline of the caller.
+var errOperationTimeout = fmt.Errorf("storage operation timeout: %w", context.DeadlineExceeded)
+
+// operationTimeouts limit the duration of the storage operations by kind. Zero
+// keeps the deadline of the context given by the caller.
+type operationTimeouts struct {
+	read  time.Duration
+	write time.Duration
+	list  time.Duration
+	lock  time.Duration
+}
+
+func (t operationTimeouts) of(operation string) time.Duration {
+	switch operation {
+	case OPERATION_LOAD, OPERATION_EXISTS, OPERATION_STAT:
+		return t.read
+	case OPERATION_STORE, OPERATION_DELETE:
+		return t.write
+	case OPERATION_LIST:
+		return t.list
+	}
+
+	// The lock is bound to its context, so the lock timeout is applied separately
+	return 0
+}
+
+// isTransientError reports whether the error is expected to go away by itself,
+// e.g. during a failover or while a node is loading its data.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if valkeyErr, ok := valkey.IsValkeyErr(err); ok {
+		message := valkeyErr.Error()
+
+		return (valkeyErr.IsLoading() ||
+			valkeyErr.IsTryAgain() ||
+			valkeyErr.IsClusterDown() ||
+			strings.HasPrefix(message, "READONLY") ||
+			strings.HasPrefix(message, "MASTERDOWN"))
+	}
+
+	var netErr net.Error
+
+	return (errors.Is(err, valkey.ErrClosing) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr))
+}
+
+// isUnavailableError reports whether the error indicates that valkey is not
+// available, as opposed to errors caused by the operation itself.
+func isUnavailableError(err error) bool {
+	return isTransientError(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// jitter returns a random delay between the half and the full given delay.
+func jitter(delay time.Duration) time.Duration {
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// withRetries runs the idempotent function until it succeeds, fails with an
+// error that is not transient or no retries are left.
+func (c *CaddyStorageValkey) withRetries(ctx context.Context, operation string, fn func() error) error {
+	delay := RETRY_INITIAL_DELAY
+
+	for attempt := 0; ; attempt++ {
+		if err := c.breaker.allow(); err != nil {
+			return err
+		}
+
+		err := fn()
+		c.breaker.record(ctx, err)
+
+		if !isTransientError(err) || attempt >= c.maxRetries {
+			return err
+		}
+
+		storageMetrics.retries.WithLabelValues(operation).Inc()
+		c.logger.Debug("retrying storage operation", zap.String("operation", operation), zap.Int("attempt", attempt+1), zap.Error(err))
+
+		select {
+		case <-time.After(jitter(delay)):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(delay*2, RETRY_MAX_DELAY)
+	}
+}
+
+// tryLock tries to acquire the lock within the lock timeout. The lock is bound
+// to the given context and a deadline would also end the held lock, so the lock
+// timeout only cancels the context while the lock is being acquired.
+func (c *CaddyStorageValkey) tryLock(ctx context.Context, key string) (context.CancelFunc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	if c.timeouts.lock <= 0 {
+		_, cancel, err := c.locker.TryWithContext(ctx, key)
+		c.breaker.record(ctx, err)
+
+		return cancel, err
+	}
+
+	acquireCtx, cancelAcquire := context.WithCancel(ctx)
+	timer := time.AfterFunc(c.timeouts.lock, cancelAcquire)
+
+	_, cancel, err := c.locker.TryWithContext(acquireCtx, key)
+
+	// A lock acquired just before the timeout is released again right away
+	if !timer.Stop() {
+		if err == nil {
+			cancel()
+		}
+		err = fmt.Errorf("acquiring lock '%s': %w", key, context.DeadlineExceeded)
+	}
+
+	c.breaker.record(ctx, err)
+	if err != nil {
+		cancelAcquire()
+		return nil, err
+	}
+
+	return func() {
+		cancel()
+		cancelAcquire()
+	}, nil
+}
+
+// circuitBreaker fails fast after the given number of consecutive failures
+// caused by an unavailable valkey. After the cooldown, a single operation is
+// let through to probe whether valkey is available again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	open      prometheus.Gauge
+	logger    *zap.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker creates a circuit breaker for the given addresses, or nil
+// when the threshold disables it. A nil circuit breaker lets everything through.
+func newCircuitBreaker(threshold int, cooldown time.Duration, address []string, logger *zap.Logger) *circuitBreaker {
+	if threshold < 1 {
+		return nil
+	}
+
+	if cooldown <= 0 {
+		cooldown = DEFAULT_CIRCUIT_BREAKER_COOLDOWN
+	}
+
+	open := storageMetrics.circuitBreakerOpen.WithLabelValues(strings.Join(address, ","))
+	open.Set(0)
+
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		open:      open,
+		logger:    logger.Named("circuit_breaker"),
+		state:     CIRCUIT_BREAKER_CLOSED,
+	}
+}
+
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CIRCUIT_BREAKER_OPEN:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+
+		// Let this operation probe whether valkey is available again
+		b.setState(CIRCUIT_BREAKER_HALF_OPEN)
+		return nil
+	case CIRCUIT_BREAKER_HALF_OPEN:
+		// Only the probing operation is let through
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The caller gave up on the operation, which tells nothing about valkey
+	if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errOperationTimeout) {
+		// Let the next operation probe again
+		if b.state == CIRCUIT_BREAKER_HALF_OPEN {
+			b.state = CIRCUIT_BREAKER_OPEN
+		}
+
+		return
+	}
+
+	if !isUnavailableError(err) {
+		b.failures = 0
+		if b.state != CIRCUIT_BREAKER_CLOSED {
+			b.setState(CIRCUIT_BREAKER_CLOSED)
+		}
+
+		return
+	}
+
+	b.failures++
+	if b.state == CIRCUIT_BREAKER_HALF_OPEN || (b.state == CIRCUIT_BREAKER_CLOSED && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(CIRCUIT_BREAKER_OPEN)
+	}
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+
+	switch state {
+	case CIRCUIT_BREAKER_OPEN:
+		b.open.Set(1)
+		b.logger.Warn("valkey is unavailable, failing fast", zap.Int("failures", b.failures), zap.Duration("cooldown", b.cooldown))
+	case CIRCUIT_BREAKER_HALF_OPEN:
+		b.logger.Info("probing whether valkey is available again")
+	case CIRCUIT_BREAKER_CLOSED:
+		b.open.Set(0)
+		b.logger.Info("valkey is available again")
+	}
+}
@@ -0,0 +1,137 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// slowFakeValkey delays the replies to the storage while slow is set.
+func slowFakeValkey(t *testing.T, slow *atomic.Bool, delay time.Duration) *fakeValkey {
+	f := newFakeValkey(t)
+	f.handle = func(args []string) (string, bool) {
+		if slow.Load() && strings.EqualFold(args[0], "HGET") {
+			time.Sleep(delay)
+		}
+		return "", false
+	}
+
+	return f
+}
+
+func TestCircuitBreakerIgnoresCallerContext(t *testing.T) {
+	slow := &atomic.Bool{}
+	f := slowFakeValkey(t, slow, 200*time.Millisecond)
+	storage := newTestStorage(t, f, CaddyStorageValkeyOptions{CircuitBreakerThreshold: 2})
+
+	if err := storage.Store(context.Background(), "certificates/example.crt", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Short deadlines of the caller do not open the circuit breaker
+	slow.Store(true)
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := storage.Load(ctx, "certificates/example.crt")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	}
+	slow.Store(false)
+
+	if _, err := storage.Load(context.Background(), "certificates/example.crt"); err != nil {
+		t.Fatalf("expected the circuit breaker to stay closed, got %v", err)
+	}
+}
+
+func TestCircuitBreakerOpensOnReadTimeout(t *testing.T) {
+	slow := &atomic.Bool{}
+	f := slowFakeValkey(t, slow, 200*time.Millisecond)
+	storage := newTestStorage(t, f, CaddyStorageValkeyOptions{
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  time.Hour,
+		ReadTimeout:             20 * time.Millisecond,
+	})
+
+	if err := storage.Store(context.Background(), "certificates/example.crt", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timeouts of the storage itself count as failures
+	slow.Store(true)
+	for range 2 {
+		if _, err := storage.Load(context.Background(), "certificates/example.crt"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	}
+	slow.Store(false)
+
+	if _, err := storage.Load(context.Background(), "certificates/example.crt"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit breaker to be open, got %v", err)
+	}
+
+	if value := gatherValue(t, "caddy_storage_valkey_circuit_breaker_open", map[string]string{"address": f.address}); value != 1 {
+		t.Fatalf("expected the circuit breaker of %s to be open, got %v", f.address, value)
+	}
+}
+
+func TestCircuitBreakerGaugePerAddress(t *testing.T) {
+	first := newCircuitBreaker(1, time.Hour, []string{"first:6379"}, zap.NewNop())
+	second := newCircuitBreaker(1, time.Hour, []string{"second:6379", "third:6379"}, zap.NewNop())
+
+	first.record(context.Background(), context.DeadlineExceeded)
+	second.record(context.Background(), nil)
+
+	if value := gatherValue(t, "caddy_storage_valkey_circuit_breaker_open", map[string]string{"address": "first:6379"}); value != 1 {
+		t.Fatalf("expected the first circuit breaker to be open, got %v", value)
+	}
+	if value := gatherValue(t, "caddy_storage_valkey_circuit_breaker_open", map[string]string{"address": "second:6379,third:6379"}); value != 0 {
+		t.Fatalf("expected the second circuit breaker to be closed, got %v", value)
+	}
+}
+
+func TestLockTimeoutLeavesNoLockHeld(t *testing.T) {
+	f := newFakeValkey(t)
+	slow := &atomic.Bool{}
+	slow.Store(true)
+	f.handle = func(args []string) (string, bool) {
+		if slow.Load() && strings.EqualFold(args[0], "EVAL") && strings.Contains(args[1], `"NX"`) {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return "", false
+	}
+	storage := newTestStorage(t, f, CaddyStorageValkeyOptions{LockTimeout: 50 * time.Millisecond})
+
+	if err := storage.Lock(context.Background(), "issue_cert_example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lock timeout, got %v", err)
+	}
+
+	// The lock keys set after giving up are removed again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		held := len(f.strings)
+		f.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no lock keys after the lock timeout, got %d", held)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slow.Store(false)
+	if err := storage.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatalf("expected the lock to be free, got %v", err)
+	}
+	if err := storage.Unlock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,337 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_NODE_PROBE_INTERVAL = 5 * time.Second
+	NODE_PROBE_TIMEOUT          = 2 * time.Second
+
+	// Nodes no longer offered by the client are not probed anymore after this
+	// number of probe intervals
+	NODE_PROBE_EXPIRY_INTERVALS = 10
+)
+
+// The operations sent to replicas by default with `send_to_replicas operations`
+var DEFAULT_REPLICA_OPERATIONS = []string{OPERATION_LIST, OPERATION_STAT}
+
+// newReplicaClient creates the client for the replica operations of the storage,
+// which sends all its commands to replicas, as it only receives reads.
+func newReplicaClient(clientOptions valkey.ClientOption) (valkey.Client, error) {
+	clientOptions.SendToReplicas = func(cmd valkey.Completed) bool {
+		return cmd.IsReadOnly()
+	}
+
+	return valkey.NewClient(clientOptions)
+}
+
+// nodeProber measures the latency and the replication offset of the nodes the
+// client selects from for reads. Every node is probed through a connection of
+// its own, as the client does not expose its connections to single nodes.
+type nodeProber struct {
+	clientOptions valkey.ClientOption
+	interval      time.Duration
+	maxLag        int64
+	logger        *zap.Logger
+
+	mu    sync.Mutex
+	nodes map[string]*nodeProbe
+
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type nodeProbe struct {
+	client   valkey.Client
+	measured bool
+	latency  time.Duration
+	offset   int64
+	lastSeen time.Time
+}
+
+// newNodeProber connects to the nodes with the given options, which need to be
+// the options of the client, so the addresses of the nodes are understood.
+func newNodeProber(clientOptions valkey.ClientOption, interval time.Duration, maxLag int64, logger *zap.Logger) *nodeProber {
+	if interval <= 0 {
+		interval = DEFAULT_NODE_PROBE_INTERVAL
+	}
+
+	// Connect to exactly the given node
+	clientOptions.Standalone = valkey.StandaloneOption{}
+	clientOptions.Sentinel = valkey.SentinelOption{}
+	clientOptions.SendToReplicas = nil
+	clientOptions.ReadNodeSelector = nil
+	clientOptions.EnableReplicaAZInfo = false
+	clientOptions.ForceSingleClient = true
+	clientOptions.ReplicaOnly = false
+	clientOptions.DisableCache = true
+	clientOptions.ShuffleInit = false
+
+	return &nodeProber{
+		clientOptions: clientOptions,
+		interval:      interval,
+		maxLag:        maxLag,
+		logger:        logger.Named("node_prober"),
+		nodes:         map[string]*nodeProbe{},
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// selector returns the read node selector of the client, which skips the
+// replicas lagging behind and lets the given selector choose from the others.
+// Without a selector, the replica with the lowest latency is chosen.
+//
+// Replicas are only chosen once they have been probed, reads are sent to the
+// primary until then and whenever no replica is left.
+func (p *nodeProber) selector(base valkey.ReadNodeSelectorFunc) valkey.ReadNodeSelectorFunc {
+	return func(slot uint16, nodes []valkey.NodeInfo) int {
+		if len(nodes) < 2 {
+			return 0
+		}
+
+		probes := p.observe(nodes)
+
+		// The primary is always at the first position
+		eligible := []valkey.NodeInfo{nodes[0]}
+		indexes := []int{0}
+		for i := 1; i < len(nodes); i++ {
+			if p.isEligible(probes[0], probes[i]) {
+				eligible = append(eligible, nodes[i])
+				indexes = append(indexes, i)
+			}
+		}
+
+		if base == nil {
+			return indexes[lowestLatency(probes, indexes)]
+		}
+
+		index := base(slot, eligible)
+		if index < 0 || index >= len(indexes) {
+			return 0
+		}
+
+		return indexes[index]
+	}
+}
+
+// lowestLatency returns the position in the indexes of the replica with the
+// lowest latency, or zero for the primary when there is no replica.
+func lowestLatency(probes []nodeProbe, indexes []int) int {
+	lowest := 0
+	for i := 1; i < len(indexes); i++ {
+		if lowest == 0 || probes[indexes[i]].latency < probes[indexes[lowest]].latency {
+			lowest = i
+		}
+	}
+
+	return lowest
+}
+
+// isEligible reports whether reads can be sent to the replica.
+func (p *nodeProber) isEligible(primary nodeProbe, replica nodeProbe) bool {
+	if !replica.measured {
+		return false
+	}
+	if p.maxLag <= 0 {
+		return true
+	}
+
+	return primary.measured && primary.offset-replica.offset <= p.maxLag
+}
+
+// observe returns the last probes of the nodes. Nodes seen for the first time
+// are probed right away.
+func (p *nodeProber) observe(nodes []valkey.NodeInfo) []nodeProbe {
+	probes := make([]nodeProbe, len(nodes))
+	now := time.Now()
+	added := false
+
+	p.mu.Lock()
+	for i, node := range nodes {
+		probe, ok := p.nodes[node.Addr]
+		if !ok {
+			probe = &nodeProbe{}
+			p.nodes[node.Addr] = probe
+			added = true
+		}
+		probe.lastSeen = now
+		probes[i] = *probe
+	}
+	p.mu.Unlock()
+
+	if added {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return probes
+}
+
+// Start probes the nodes periodically until stopped.
+func (p *nodeProber) Start(valkey.Client) {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-p.wake:
+			case <-p.stop:
+				p.closeAll()
+				return
+			}
+
+			p.probeAll()
+		}
+	}()
+}
+
+func (p *nodeProber) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *nodeProber) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for address, probe := range p.nodes {
+		if probe.client != nil {
+			probe.client.Close()
+		}
+		delete(p.nodes, address)
+	}
+}
+
+func (p *nodeProber) probeAll() {
+	expiry := time.Now().Add(-NODE_PROBE_EXPIRY_INTERVALS * p.interval)
+
+	p.mu.Lock()
+	addresses := make([]string, 0, len(p.nodes))
+	for address, probe := range p.nodes {
+		if probe.lastSeen.Before(expiry) {
+			if probe.client != nil {
+				probe.client.Close()
+			}
+			delete(p.nodes, address)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	p.mu.Unlock()
+
+	for _, address := range addresses {
+		p.probe(address)
+	}
+}
+
+// probe measures the round trip of a PING and reads the replication offset of
+// the node. Nodes that can not be probed are not chosen until probed again.
+func (p *nodeProber) probe(address string) {
+	p.mu.Lock()
+	probe, ok := p.nodes[address]
+	var client valkey.Client
+	if ok {
+		client = probe.client
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var result nodeProbe
+	err := func() error {
+		if client == nil {
+			clientOptions := p.clientOptions
+			clientOptions.InitAddress = []string{address}
+
+			newClient, err := valkey.NewClient(clientOptions)
+			if err != nil {
+				return err
+			}
+			client = newClient
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), NODE_PROBE_TIMEOUT)
+		defer cancel()
+
+		start := time.Now()
+		if err := client.Do(ctx, client.B().Ping().Build()).Error(); err != nil {
+			return err
+		}
+		result.latency = time.Since(start)
+
+		info, err := client.Do(ctx, client.B().Info().Section("replication").Build()).ToString()
+		if err != nil {
+			return err
+		}
+		result.offset = parseReplicationOffset(info)
+		result.measured = true
+
+		return nil
+	}()
+
+	if err != nil {
+		p.logger.Debug("probing node failed", zap.String("address", address), zap.Error(err))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The node may have expired or the prober stopped in the meantime
+	probe, ok = p.nodes[address]
+	if !ok {
+		if client != nil {
+			client.Close()
+		}
+		return
+	}
+
+	probe.client = client
+	probe.measured = result.measured
+	probe.latency = result.latency
+	probe.offset = result.offset
+}
+
+// parseReplicationOffset returns the replication offset of `INFO replication`,
+// which is the offset of the primary on primaries and the processed offset of
+// the primary on replicas.
+func parseReplicationOffset(info string) int64 {
+	for line := range strings.Lines(info) {
+		if value, found := strings.CutPrefix(strings.TrimSpace(line), "master_repl_offset:"); found {
+			offset, _ := strconv.ParseInt(value, 10, 64)
+			return offset
+		}
+	}
+
+	return 0
+}
+
+// randomReplica chooses a random replica, or the primary when there is none.
+func randomReplica(slot uint16, nodes []valkey.NodeInfo) int {
+	if len(nodes) < 2 {
+		return 0
+	}
+
+	return 1 + rand.N(len(nodes)-1)
+}
+
+var (
+	_ ConnectionWatcher = (*nodeProber)(nil)
+)
@@ -0,0 +1,190 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+func TestReplicaOperationsUseReplicaClient(t *testing.T) {
+	primary := newFakeValkey(t)
+	replica := newFakeValkey(t)
+
+	clientOptions := valkey.ClientOption{
+		InitAddress: []string{primary.address},
+		Standalone:  valkey.StandaloneOption{ReplicaAddress: []string{replica.address}},
+		SendToReplicas: func(cmd valkey.Completed) bool {
+			return false
+		},
+	}
+	storage, err := NewCaddyStorageValkey(clientOptions, CaddyStorageValkeyOptions{ReplicaOperations: []string{OPERATION_LIST, OPERATION_STAT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	ctx := context.Background()
+	key := "certificates/example.com.crt"
+	if err := storage.Store(ctx, key, []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	replica.mu.Lock()
+	replica.hashes[key] = primary.hashes[key]
+	replica.mu.Unlock()
+
+	if _, err := storage.Load(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.List(ctx, "certificates", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, command := range []string{"HMGET", "SCAN"} {
+		if len(replica.received(command)) != 1 || len(primary.received(command)) != 0 {
+			t.Fatalf("expected `%s` of the replica operations to be sent to the replica", command)
+		}
+	}
+	for _, command := range []string{"HMSET", "HGET", "EVAL"} {
+		if len(replica.received(command)) != 0 || len(primary.received(command)) == 0 {
+			t.Fatalf("expected `%s` to be sent to the primary", command)
+		}
+	}
+}
+
+// newTestNodeProber returns a prober with the given probes, which never probes
+// by itself as it is not started.
+func newTestNodeProber(maxLag int64, probes map[string]nodeProbe) *nodeProber {
+	prober := newNodeProber(valkey.ClientOption{}, time.Minute, maxLag, zap.NewNop())
+	for address, probe := range probes {
+		probe.lastSeen = time.Now()
+		prober.nodes[address] = &probe
+	}
+
+	return prober
+}
+
+func testNodes(addresses ...string) []valkey.NodeInfo {
+	nodes := make([]valkey.NodeInfo, len(addresses))
+	for i, address := range addresses {
+		nodes[i] = valkey.NodeInfo{Addr: address}
+	}
+
+	return nodes
+}
+
+func TestNodeProberSelectsLowestLatency(t *testing.T) {
+	prober := newTestNodeProber(0, map[string]nodeProbe{
+		"primary":   {measured: true, latency: time.Millisecond},
+		"replica-1": {measured: true, latency: 30 * time.Millisecond},
+		"replica-2": {measured: true, latency: 10 * time.Millisecond},
+		"replica-3": {latency: time.Microsecond},
+	})
+	selector := prober.selector(nil)
+
+	// The primary is never chosen while a replica is left, unprobed replicas are skipped
+	if index := selector(0, testNodes("primary", "replica-1", "replica-2", "replica-3")); index != 2 {
+		t.Fatalf("expected replica with lowest latency, got node %d", index)
+	}
+
+	if index := selector(0, testNodes("primary", "replica-3")); index != 0 {
+		t.Fatalf("expected primary without probed replica, got node %d", index)
+	}
+}
+
+func TestNodeProberSkipsLaggingReplicas(t *testing.T) {
+	prober := newTestNodeProber(100, map[string]nodeProbe{
+		"primary":   {measured: true, offset: 1000},
+		"replica-1": {measured: true, offset: 850, latency: time.Millisecond},
+		"replica-2": {measured: true, offset: 950, latency: 20 * time.Millisecond},
+		"replica-3": {measured: true, offset: 500, latency: time.Microsecond},
+	})
+
+	// Without a selector, the replica with the lowest latency of the ones left is chosen
+	if index := prober.selector(nil)(0, testNodes("primary", "replica-1", "replica-2", "replica-3")); index != 2 {
+		t.Fatalf("expected the only replica within the lag, got node %d", index)
+	}
+
+	// A given selector only chooses from the replicas left
+	var offered []valkey.NodeInfo
+	selector := prober.selector(func(slot uint16, nodes []valkey.NodeInfo) int {
+		offered = nodes
+		return len(nodes) - 1
+	})
+	if index := selector(0, testNodes("primary", "replica-1", "replica-2")); index != 2 {
+		t.Fatalf("expected index of the replica chosen by the selector, got node %d", index)
+	}
+	if len(offered) != 2 || offered[0].Addr != "primary" || offered[1].Addr != "replica-2" {
+		t.Fatalf("unexpected nodes offered to the selector %v", offered)
+	}
+
+	if index := prober.selector(nil)(0, testNodes("primary", "replica-1", "replica-3")); index != 0 {
+		t.Fatalf("expected primary when all replicas lag behind, got node %d", index)
+	}
+}
+
+func TestParseReplicationOffset(t *testing.T) {
+	tests := map[string]struct {
+		info   string
+		offset int64
+	}{
+		"primary": {
+			info:   "# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:12345\r\nrepl_backlog_active:1\r\n",
+			offset: 12345,
+		},
+		"replica": {
+			info:   "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\nslave_repl_offset:100\r\nmaster_repl_offset:678\r\n",
+			offset: 678,
+		},
+		"missing": {
+			info:   "# Replication\r\nrole:master\r\n",
+			offset: 0,
+		},
+		"invalid": {
+			info:   "master_repl_offset:many\r\n",
+			offset: 0,
+		},
+	}
+
+	for name, test := range tests {
+		if offset := parseReplicationOffset(test.info); offset != test.offset {
+			t.Errorf("%s: expected offset %d, got %d", name, test.offset, offset)
+		}
+	}
+}
+
+func TestLowestLatency(t *testing.T) {
+	probes := []nodeProbe{
+		{latency: time.Microsecond},
+		{latency: 30 * time.Millisecond},
+		{latency: 10 * time.Millisecond},
+		{latency: 20 * time.Millisecond},
+	}
+
+	tests := map[string]struct {
+		indexes []int
+		lowest  int
+	}{
+		"only primary":       {indexes: []int{0}, lowest: 0},
+		"primary is skipped": {indexes: []int{0, 1}, lowest: 1},
+		"lowest replica":     {indexes: []int{0, 1, 2, 3}, lowest: 2},
+		"subset of replicas": {indexes: []int{0, 1, 3}, lowest: 2},
+	}
+
+	for name, test := range tests {
+		if lowest := lowestLatency(probes, test.indexes); lowest != test.lowest {
+			t.Errorf("%s: expected position %d, got %d", name, test.lowest, lowest)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// The version of the hash layout is kept next to the entries, below the
+	// prefix of the layout. As it is no hash, it never shows up as entry of the
+	// storage.
+	SCHEMA_VERSION_KEY = "caddyschema"
+
+	// Increase this together with a new entry in schemaMigrations
+	SCHEMA_VERSION = 1
+
+	SCHEMA_MIGRATION_LOCK_NAME = "valkey_storage_schema_migration"
+)
+
+// schemaMigration rewrites a single entry of the previous schema version into
+// the version it is registered for. It needs to be safe to run multiple times.
+type schemaMigration func(ctx context.Context, client valkey.Client, key string) error
+
+// schemaMigrations contains the migration into every version from its previous
+// version. Versions without changes to the entries need no migration.
+var schemaMigrations = map[int]schemaMigration{}
+
+// schemaMigrationResult lists all keys that have been rewritten by a migration.
+type schemaMigrationResult struct {
+	FromVersion int
+	ToVersion   int
+	Migrated    []string
+}
+
+// isVersioned reports whether the layout is owned by this module. The layouts
+// of other storages are never changed by a migration.
+func (c *CaddyStorageValkey) isVersioned() bool {
+	return c.layout.Name() == LAYOUT_HASH
+}
+
+// schemaVersionKey returns the valkey key holding the schema version.
+func (c *CaddyStorageValkey) schemaVersionKey() string {
+	return c.layout.Key(SCHEMA_VERSION_KEY)
+}
+
+// SchemaVersion returns the schema version of the stored entries, or zero when
+// no version has been stored yet.
+func (c *CaddyStorageValkey) SchemaVersion(ctx context.Context) (int, error) {
+	raw, err := c.client.Do(ctx, c.client.B().Get().Key(c.schemaVersionKey()).Build()).ToString()
+	if valkey.IsValkeyNil(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version '%s': %v", raw, err)
+	}
+
+	return version, nil
+}
+
+// CheckSchemaVersion verifies that the stored entries can be used with this
+// version of the module and stores the version for new or unversioned datasets.
+func (c *CaddyStorageValkey) CheckSchemaVersion(ctx context.Context) error {
+	return c.checkSchemaVersion(ctx, SCHEMA_VERSION)
+}
+
+// checkSchemaVersion is CheckSchemaVersion with the given supported version.
+func (c *CaddyStorageValkey) checkSchemaVersion(ctx context.Context, supportedVersion int) error {
+	if !c.isVersioned() {
+		return nil
+	}
+
+	version, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version == 0:
+		if c.layout.ReadOnly() {
+			return nil
+		}
+
+		// Unversioned datasets use the layout of the first version, as it is older
+		// than the version key. Another instance may have stored a version already.
+		err := c.client.Do(ctx, c.client.B().Set().Key(c.schemaVersionKey()).Value(strconv.Itoa(supportedVersion)).Nx().Build()).Error()
+		if valkey.IsValkeyNil(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		c.logger.Info("stored schema version", zap.Int("version", supportedVersion))
+	case version > supportedVersion:
+		return fmt.Errorf("schema version %d of storage is newer than the supported version %d, upgrade this module", version, supportedVersion)
+	case version < supportedVersion:
+		c.logger.Warn("schema version of storage is outdated, run `caddy valkey-storage migrate`",
+			zap.Int("version", version),
+			zap.Int("supported_version", supportedVersion),
+		)
+	}
+
+	return nil
+}
+
+// MigrateSchema rewrites all entries key by key into the current schema version.
+// The migration lock is held the whole time, so only a single migration runs.
+// The version is stored after every completed step, so an aborted migration
+// continues with the failed step.
+func (c *CaddyStorageValkey) MigrateSchema(ctx context.Context, dryRun bool) (schemaMigrationResult, error) {
+	return c.migrateSchema(ctx, dryRun, schemaMigrations, SCHEMA_VERSION)
+}
+
+// migrateSchema is MigrateSchema with the given migrations up to the given
+// supported version.
+func (c *CaddyStorageValkey) migrateSchema(ctx context.Context, dryRun bool, migrations map[int]schemaMigration, supportedVersion int) (result schemaMigrationResult, err error) {
+	result = schemaMigrationResult{ToVersion: supportedVersion, Migrated: []string{}}
+
+	if !c.isVersioned() {
+		return result, fmt.Errorf("the `%s` layout has no schema versions", c.layout.Name())
+	}
+
+	if c.layout.ReadOnly() && !dryRun {
+		return result, ErrReadOnlyLayout
+	}
+
+	if err := c.Lock(ctx, SCHEMA_MIGRATION_LOCK_NAME); err != nil {
+		return result, fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := c.Unlock(ctx, SCHEMA_MIGRATION_LOCK_NAME); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+
+	version, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	// Unversioned datasets use the layout of the first version
+	if version == 0 {
+		version = 1
+	}
+	result.FromVersion = version
+
+	if version > supportedVersion {
+		return result, fmt.Errorf("schema version %d of storage is newer than the supported version %d", version, supportedVersion)
+	}
+
+	for next := version + 1; next <= supportedVersion; next++ {
+		if migration, ok := migrations[next]; ok {
+			keys, err := c.List(ctx, "", true)
+			if err != nil {
+				return result, err
+			}
+
+			for _, key := range keys {
+				result.Migrated = append(result.Migrated, key)
+				if dryRun {
+					continue
+				}
+
+				if err := migration(ctx, c.client, c.layout.Key(key)); err != nil {
+					return result, fmt.Errorf("migrating key '%s' to schema version %d: %w", key, next, err)
+				}
+				c.logger.Debug("migrated key to schema version", zap.String("key", key), zap.Int("version", next))
+			}
+		}
+
+		if dryRun {
+			continue
+		}
+
+		if err := c.client.Do(ctx, c.client.B().Set().Key(c.schemaVersionKey()).Value(strconv.Itoa(next)).Build()).Error(); err != nil {
+			return result, err
+		}
+		c.logger.Info("migrated storage to schema version", zap.Int("version", next))
+	}
+
+	// Store the version of datasets that are already up to date, but unversioned
+	if !dryRun && !c.layout.ReadOnly() {
+		err := c.client.Do(ctx, c.client.B().Set().Key(c.schemaVersionKey()).Value(strconv.Itoa(supportedVersion)).Nx().Build()).Error()
+		if err != nil && !valkey.IsValkeyNil(err) {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
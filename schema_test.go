@@ -0,0 +1,136 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+func TestSchemaVersionKeyUsesLayoutPrefix(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{Layout: hashLayout{prefix: "tenant"}})
+	ctx := context.Background()
+
+	if err := storage.CheckSchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if version := server.strings["tenant/caddyschema"]; version != "1" {
+		t.Fatalf("expected schema version below the prefix, got %q", version)
+	}
+	if _, ok := server.strings[SCHEMA_VERSION_KEY]; ok {
+		t.Fatal("expected no schema version outside of the prefix")
+	}
+
+	if err := storage.Store(ctx, "certificates/example.com.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.hashes["tenant/certificates/example.com.crt"]; !ok {
+		t.Fatal("expected entry below the prefix")
+	}
+
+	keys, err := storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{"certificates/example.com.crt"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestMigrateSchemaUpgradesEntries(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	ctx := context.Background()
+
+	for _, key := range []string{"certificates/a.crt", "certificates/b.crt"} {
+		if err := storage.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.CheckSchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test migration marks every entry with the version it was migrated to
+	migrations := map[int]schemaMigration{
+		2: func(ctx context.Context, client valkey.Client, key string) error {
+			return client.Do(ctx, client.B().Hset().Key(key).FieldValue().FieldValue("schema", "2").Build()).Error()
+		},
+	}
+
+	// The outdated version is accepted, but only migrated on request
+	if err := storage.checkSchemaVersion(ctx, 2); err != nil {
+		t.Fatalf("expected outdated version to be accepted: %v", err)
+	}
+
+	result, err := storage.migrateSchema(ctx, true, migrations, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromVersion != 1 || result.ToVersion != 2 || len(result.Migrated) != 2 {
+		t.Fatalf("unexpected result of dry run %+v", result)
+	}
+	if server.strings[SCHEMA_VERSION_KEY] != "1" || server.hashes["certificates/a.crt"]["schema"] != "" {
+		t.Fatal("expected dry run to change nothing")
+	}
+
+	result, err = storage.migrateSchema(ctx, false, migrations, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(result.Migrated)
+	if !slices.Equal(result.Migrated, []string{"certificates/a.crt", "certificates/b.crt"}) {
+		t.Fatalf("unexpected migrated keys %v", result.Migrated)
+	}
+	for _, key := range result.Migrated {
+		if server.hashes[key]["schema"] != "2" {
+			t.Fatalf("expected key '%s' to be migrated", key)
+		}
+	}
+	if version := server.strings[SCHEMA_VERSION_KEY]; version != "2" {
+		t.Fatalf("expected schema version 2, got %q", version)
+	}
+
+	// The migrated entries are still readable
+	value, err := storage.Load(ctx, "certificates/a.crt")
+	if err != nil || string(value) != "certificates/a.crt" {
+		t.Fatalf("unexpected value %q after migration: %v", value, err)
+	}
+
+	// A second run has nothing left to migrate
+	result, err = storage.migrateSchema(ctx, false, migrations, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromVersion != 2 || len(result.Migrated) != 0 {
+		t.Fatalf("unexpected result of second run %+v", result)
+	}
+}
+
+func TestSchemaVersionRefusesNewerVersion(t *testing.T) {
+	server := newFakeValkey(t)
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	ctx := context.Background()
+
+	server.strings[SCHEMA_VERSION_KEY] = "2"
+
+	if err := storage.checkSchemaVersion(ctx, 1); err == nil {
+		t.Fatal("expected newer schema version to be refused on start")
+	}
+
+	migrated := false
+	migrations := map[int]schemaMigration{
+		2: func(context.Context, valkey.Client, string) error {
+			migrated = true
+			return nil
+		},
+	}
+	if _, err := storage.migrateSchema(ctx, false, migrations, 1); err == nil {
+		t.Fatal("expected migration of newer schema version to be refused")
+	}
+	if migrated || server.strings[SCHEMA_VERSION_KEY] != "2" {
+		t.Fatal("expected newer schema version to be left untouched")
+	}
+}
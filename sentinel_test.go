@@ -0,0 +1,495 @@
+package caddystoragevalkey
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/valkey-io/valkey-go"
+)
+
+// fakeSentinel is a sentinel monitoring a single master set, which announces
+// failovers to its subscribers like a real sentinel does.
+type fakeSentinel struct {
+	address   string
+	masterSet string
+
+	mu          sync.Mutex
+	master      string
+	hellos      [][]string
+	subscribers map[net.Conn]*sync.Mutex
+}
+
+func newFakeSentinel(t *testing.T, masterSet string, master string) *fakeSentinel {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newFakeSentinelOn(t, listener, masterSet, master)
+}
+
+// newFakeSentinelOn serves the sentinel on the given listener, e.g. of TLS.
+func newFakeSentinelOn(t *testing.T, listener net.Listener, masterSet string, master string) *fakeSentinel {
+	t.Helper()
+
+	s := &fakeSentinel{
+		address:     listener.Addr().String(),
+		masterSet:   masterSet,
+		master:      master,
+		subscribers: map[net.Conn]*sync.Mutex{},
+	}
+
+	var wg sync.WaitGroup
+	conns := map[net.Conn]struct{}{}
+	t.Cleanup(func() {
+		listener.Close()
+
+		s.mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			conns[conn] = struct{}{}
+			s.mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveConn(conn)
+			}()
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSentinel) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	// Pushed messages must not interleave with replies
+	writeMu := &sync.Mutex{}
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, conn)
+		s.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		reply := s.reply(conn, writeMu, args)
+
+		writeMu.Lock()
+		_, err = io.WriteString(conn, reply)
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeSentinel) reply(conn net.Conn, writeMu *sync.Mutex, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		s.hellos = append(s.hellos, args)
+		return "%3\r\n" + respBulk("server") + respBulk("valkey") + respBulk("version") + respBulk("8.0.0") +
+			respBulk("proto") + ":3\r\n"
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		kind := strings.ToLower(args[0])
+		if kind == "subscribe" {
+			s.subscribers[conn] = writeMu
+		} else {
+			delete(s.subscribers, conn)
+		}
+
+		reply := ""
+		for i, channel := range args[1:] {
+			count := i + 1
+			if kind == "unsubscribe" {
+				count = 0
+			}
+			reply += fmt.Sprintf(">3\r\n%s%s:%d\r\n", respBulk(kind), respBulk(channel), count)
+		}
+		return reply
+	case "SENTINEL":
+		if len(args) < 3 || args[2] != s.masterSet {
+			return "-ERR No such master with that name\r\n"
+		}
+
+		switch strings.ToUpper(args[1]) {
+		case "SENTINELS", "REPLICAS":
+			return respArray()
+		case "GET-MASTER-ADDR-BY-NAME":
+			host, port, _ := net.SplitHostPort(s.master)
+			return respArray(respBulk(host), respBulk(port))
+		}
+	case "PING":
+		return "+PONG\r\n"
+	}
+
+	return respOk
+}
+
+// failover switches the master and announces it to all subscribers.
+func (s *fakeSentinel) failover(master string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldHost, oldPort, _ := net.SplitHostPort(s.master)
+	newHost, newPort, _ := net.SplitHostPort(master)
+	s.master = master
+
+	message := strings.Join([]string{s.masterSet, oldHost, oldPort, newHost, newPort}, " ")
+	push := fmt.Sprintf(">3\r\n%s%s%s", respBulk("message"), respBulk("+switch-master"), respBulk(message))
+	for conn, writeMu := range s.subscribers {
+		writeMu.Lock()
+		io.WriteString(conn, push)
+		writeMu.Unlock()
+	}
+}
+
+func TestSentinelFailoverRetriesStoreOnNewMaster(t *testing.T) {
+	oldMaster := newFakeValkey(t)
+	newMaster := newFakeValkey(t)
+	sentinel := newFakeSentinel(t, "mymaster", oldMaster.address)
+
+	storage, err := NewCaddyStorageValkey(valkey.ClientOption{
+		InitAddress: []string{sentinel.address},
+		Sentinel:    valkey.SentinelOption{MasterSet: "mymaster"},
+	}, CaddyStorageValkeyOptions{MaxRetries: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	if topology := storage.Topology(); topology != string(valkey.ClientModeSentinel) {
+		t.Fatalf("expected topology %s, got %s", string(valkey.ClientModeSentinel), topology)
+	}
+
+	ctx := context.Background()
+	if err := storage.Store(ctx, "certificates/before.crt", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if len(oldMaster.received("HMSET")) != 1 {
+		t.Fatal("expected store to be sent to the master announced by the sentinel")
+	}
+
+	// The failover happens while the next write is in flight, which the old
+	// master rejects as it has become a replica
+	oldMaster.mu.Lock()
+	oldMaster.handle = func(args []string) (string, bool) {
+		if strings.ToUpper(args[0]) != "HMSET" {
+			return "", false
+		}
+
+		sentinel.failover(newMaster.address)
+		return "-READONLY You can't write against a read only replica.\r\n", true
+	}
+	oldMaster.mu.Unlock()
+
+	if err := storage.Store(ctx, "certificates/after.crt", []byte("after")); err != nil {
+		t.Fatalf("expected store to be retried on the new master: %v", err)
+	}
+	if len(oldMaster.received("HMSET")) != 2 {
+		t.Fatal("expected store to be rejected by the old master first")
+	}
+	if len(newMaster.received("HMSET")) != 1 {
+		t.Fatal("expected store to be retried on the new master")
+	}
+
+	value, err := storage.Load(ctx, "certificates/after.crt")
+	if err != nil || string(value) != "after" {
+		t.Fatalf("unexpected value %q from the new master: %v", value, err)
+	}
+	if len(newMaster.received("HGET")) != 1 {
+		t.Fatal("expected load to be sent to the new master")
+	}
+}
+
+func TestSentinelConfigUnmarshalCaddyfile(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected *SentinelConfig
+		err      string
+	}{
+		"values": {
+			input: `valkey {
+				sentinel {
+					master_set mymaster
+					username sentinel-user
+					password sentinel-secret
+					client_name caddy-sentinel
+					tls_min_version 1.3
+					tls_server_name sentinel.internal
+					tls_ca_cert /etc/sentinel/ca.crt
+					tls_client_cert /etc/sentinel/client.crt
+					tls_client_key /etc/sentinel/client.key
+				}
+			}`,
+			expected: &SentinelConfig{
+				MasterSet:     "mymaster",
+				Username:      "sentinel-user",
+				Password:      "sentinel-secret",
+				ClientName:    "caddy-sentinel",
+				TlsMinVersion: "1.3",
+				TlsServerName: "sentinel.internal",
+				TlsCaCert:     "/etc/sentinel/ca.crt",
+				TlsClientCert: "/etc/sentinel/client.crt",
+				TlsClientKey:  "/etc/sentinel/client.key",
+			},
+		},
+		"flags and lists": {
+			input: `valkey {
+				sentinel {
+					tls_insecure
+					tls_reload true
+					tls_system_roots false
+					tls_ca_certs /etc/sentinel/a.crt /etc/sentinel/b.crt
+					tls_curves X25519 P-256
+				}
+			}`,
+			expected: &SentinelConfig{
+				TlsInsecure: true,
+				TlsReload:   true,
+				TlsCaCerts:  []string{"/etc/sentinel/a.crt", "/etc/sentinel/b.crt"},
+				TlsCurves:   []string{"X25519", "P-256"},
+			},
+		},
+		"placeholders are kept": {
+			input: `valkey {
+				sentinel {
+					password {env.SENTINEL_PASSWORD}
+				}
+			}`,
+			expected: &SentinelConfig{Password: "{env.SENTINEL_PASSWORD}"},
+		},
+		"unknown option": {
+			input: `valkey {
+				sentinel {
+					db 1
+				}
+			}`,
+			err: "unknown sentinel option 'db'",
+		},
+		"argument after block name": {
+			input: `valkey {
+				sentinel mymaster {
+					username sentinel-user
+				}
+			}`,
+			err: "wrong argument count",
+		},
+		"multiple values": {
+			input: `valkey {
+				sentinel {
+					username a b
+				}
+			}`,
+			err: "expected a single value for `username`",
+		},
+		"empty list": {
+			input: `valkey {
+				sentinel {
+					tls_ca_certs
+				}
+			}`,
+			err: "wrong argument count",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := StorageValkeyModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(m.Sentinel, test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, m.Sentinel)
+			}
+		})
+	}
+}
+
+func TestSentinelConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		module StorageValkeyModule
+		err    string
+	}{
+		"master set in block": {
+			module: StorageValkeyModule{
+				InitAddress: []string{"127.0.0.1:26379"},
+				Sentinel:    &SentinelConfig{MasterSet: "mymaster", Username: "sentinel-user", Password: "sentinel-secret"},
+			},
+		},
+		"master set outside of block": {
+			module: StorageValkeyModule{
+				InitAddress:       []string{"127.0.0.1:26379"},
+				SentinelMasterSet: "mymaster",
+				Sentinel:          &SentinelConfig{TlsInsecure: true},
+			},
+		},
+		"master set in url": {
+			module: StorageValkeyModule{
+				Url:      "redis://127.0.0.1:26379?master_set=mymaster",
+				Sentinel: &SentinelConfig{Password: "sentinel-secret"},
+			},
+		},
+		"both master sets": {
+			module: StorageValkeyModule{
+				InitAddress:       []string{"127.0.0.1:26379"},
+				SentinelMasterSet: "mymaster",
+				Sentinel:          &SentinelConfig{MasterSet: "othermaster"},
+			},
+			err: "setting the `sentinel_master_set` and `sentinel.master_set` option is not allowed",
+		},
+		"missing master set": {
+			module: StorageValkeyModule{
+				InitAddress: []string{"127.0.0.1:26379"},
+				Sentinel:    &SentinelConfig{Password: "sentinel-secret"},
+			},
+			err: "the `sentinel` block requires the `master_set` option",
+		},
+		"invalid tls version": {
+			module: StorageValkeyModule{
+				InitAddress: []string{"127.0.0.1:26379"},
+				Sentinel:    &SentinelConfig{MasterSet: "mymaster", TlsMinVersion: "1.4"},
+			},
+			err: "sentinel.tls_min_version",
+		},
+		"credentials with sentinel block": {
+			module: StorageValkeyModule{
+				InitAddress: []string{"127.0.0.1:26379"},
+				Credentials: &CredentialsConfig{PasswordEnv: "VALKEY_PASSWORD"},
+				Sentinel:    &SentinelConfig{MasterSet: "mymaster"},
+			},
+			err: "the `credentials` block can not be used with sentinels",
+		},
+		"credentials with sentinel master set": {
+			module: StorageValkeyModule{
+				InitAddress:       []string{"127.0.0.1:26379"},
+				Credentials:       &CredentialsConfig{PasswordEnv: "VALKEY_PASSWORD"},
+				SentinelMasterSet: "mymaster",
+			},
+			err: "the `credentials` block can not be used with sentinels",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The defaults are set by Provision, which runs first
+			test.module.LockMajority = 2
+
+			err := test.module.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSentinelSeparateCredentialsAndTls(t *testing.T) {
+	master := newFakeValkey(t)
+
+	// Only the sentinel is served with TLS, by a CA the data nodes don't use
+	ca := newTestCA(t, "sentinel ca")
+	certificate, _, _ := ca.issue(t, "sentinel", []string{"sentinel.internal"}, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	sentinel := newFakeSentinelOn(t, listener, "mymaster", master.address)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeFile(t, caFile, ca.pem)
+
+	t.Setenv("TEST_SENTINEL_MASTER_SET", "mymaster")
+	t.Setenv("TEST_SENTINEL_PASSWORD", "sentinel-secret")
+
+	m := StorageValkeyModule{
+		InitAddress: []string{sentinel.address},
+		Username:    "data-user",
+		Password:    "data-secret",
+		Sentinel: &SentinelConfig{
+			MasterSet:     "{env.TEST_SENTINEL_MASTER_SET}",
+			Username:      "sentinel-user",
+			Password:      "{env.TEST_SENTINEL_PASSWORD}",
+			TlsServerName: "sentinel.internal",
+			TlsCaCert:     caFile,
+		},
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Cleanup() })
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.storage.Store(context.Background(), "certificates/example.crt", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if len(master.received("HMSET")) != 1 {
+		t.Fatal("expected store to be sent to the master announced by the sentinel")
+	}
+
+	sentinel.mu.Lock()
+	username, password := lastAuth(sentinel.hellos)
+	sentinel.mu.Unlock()
+	if username != "sentinel-user" || password != "sentinel-secret" {
+		t.Fatalf("expected sentinel credentials at the sentinel, got %s:%s", username, password)
+	}
+
+	if username, password := master.lastHelloAuth(); username != "data-user" || password != "data-secret" {
+		t.Fatalf("expected data node credentials at the master, got %s:%s", username, password)
+	}
+}
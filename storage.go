@@ -1,18 +1,23 @@
 package caddystoragevalkey
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"path"
-	"strconv"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/valkey-io/valkey-go"
 	"github.com/valkey-io/valkey-go/valkeylock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 const (
@@ -28,67 +33,300 @@ const (
 	// in the storage, iterating or listing the files can take quite a long time.
 	// Increasing this allows for faster iteration.
 	SCAN_COUNT = 50
+
+	TOPOLOGY_REPLICA = "replica"
 )
 
 type CaddyStorageValkey struct {
-	client valkey.Client
-	locker valkeylock.Locker
-	locks  sync.Map
+	*valkeyConnection
+	poolKey string
+
+	layout StorageLayout
+	tracer trace.Tracer
+	logger *zap.Logger
+
+	slowOperationThreshold time.Duration
+
+	timeouts   operationTimeouts
+	maxRetries int
+	breaker    *circuitBreaker
+
+	replicaOperations []string
+
+	migrateFrom    certmagic.Storage
+	migrateDeletes bool
+	mirror         *storageMirror
 }
 
 type CaddyStorageValkeyOptions struct {
 	LockMajority int
+
+	// ShareLockerClient uses a single client for the storage and the locker,
+	// instead of a separate client for each of them. This is not possible when
+	// sending commands to replicas.
+	ShareLockerClient bool
+
+	// Layout defines how the entries are kept in valkey. When not set, every
+	// entry is stored as hash with its value and meta info.
+	Layout StorageLayout
+
+	// Logger receives all log entries of the storage. When not set, nothing is logged.
+	Logger *zap.Logger
+
+	// SlowOperationThreshold is the duration after which a storage operation is
+	// logged as slow. Zero disables the logging of slow operations.
+	SlowOperationThreshold time.Duration
+
+	// The timeouts limit the duration of read, write, list and lock operations.
+	// Zero keeps the deadline of the context given by the caller.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	ListTimeout  time.Duration
+	LockTimeout  time.Duration
+
+	// MaxRetries is the number of retries of idempotent operations failing with
+	// a transient error, e.g. during a failover. Zero disables retries.
+	MaxRetries int
+
+	// CircuitBreakerThreshold is the number of consecutive failures caused by an
+	// unavailable valkey, after which all operations fail fast for the cooldown.
+	// Zero disables the circuit breaker.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	// ReplicaOperations are the operations, whose commands are sent to replicas.
+	// They use a separate client with the same options, which sends all read-only
+	// commands to replicas, so the SendToReplicas function of the client is only
+	// used for all other commands.
+	ReplicaOperations []string
+
+	// MigrateFrom is an optional storage that is used as a fallback for reads.
+	// Entries found there are copied into valkey on access, unless the layout is
+	// read-only. The storage is only changed when MigrateDeletes is set, which
+	// deletes entries there as well, so they are not migrated again.
+	MigrateFrom    certmagic.Storage
+	MigrateDeletes bool
+
+	// ConnectionPoolKey shares the connection and all held locks with every other
+	// storage using the same key. The connection is only closed, when the last
+	// of them is closed. When not set, the storage uses its own connection.
+	ConnectionPoolKey string
+
+	// MirrorTo is an optional storage that receives all successful writes
+	// asynchronously, with at most MirrorQueueSize pending writes.
+	MirrorTo        certmagic.Storage
+	MirrorQueueSize int
+
+	// Watchers run in the background while connected, e.g. to keep the addresses
+	// of the nodes up to date. They are started with the connection, so they are
+	// not used when reusing the pooled connection of another storage.
+	Watchers []ConnectionWatcher
+
+	// ConnectionOptions completes the client options of a new connection and
+	// returns the watchers to run while connected instead of Watchers. It is only
+	// called when no pooled connection is reused, so nothing opening files or
+	// sockets is built and thrown away for a reused connection.
+	ConnectionOptions func(clientOptions valkey.ClientOption) (valkey.ClientOption, []ConnectionWatcher, error)
+
+	// TracerProvider is used to create the spans of all storage operations.
+	// When not set, the global OpenTelemetry tracer provider is used.
+	TracerProvider trace.TracerProvider
 }
 
 func NewCaddyStorageValkey(clientOptions valkey.ClientOption, options CaddyStorageValkeyOptions) (*CaddyStorageValkey, error) {
-	// Create a new client for valkey
-	valkeyClient, err := valkey.NewClient(clientOptions)
-	if err != nil {
-		return nil, err
+	// Metric collectors are always present, even when not registered anywhere
+	initStorageMetrics()
+	initMigrationMetrics()
+	initMirrorMetrics()
+
+	var connection *valkeyConnection
+	connectionReused := false
+
+	newConnection := func() (*valkeyConnection, error) {
+		clientOptions, watchers := clientOptions, options.Watchers
+		if options.ConnectionOptions != nil {
+			var err error
+			clientOptions, watchers, err = options.ConnectionOptions(clientOptions)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return newValkeyConnection(clientOptions, options.LockMajority, options.ShareLockerClient, len(options.ReplicaOperations) > 0, watchers)
 	}
 
-	// Create a new locker for valkey
-	valkeyLocker, err := valkeylock.NewLocker(valkeylock.LockerOption{
-		ClientOption:   clientOptions,
-		KeyPrefix:      LOCKER_PREFIX,
-		NoLoopTracking: true,
-		KeyMajority:    int32(options.LockMajority),
-	})
+	if len(options.ConnectionPoolKey) > 0 {
+		var err error
+		connection, connectionReused, err = loadOrNewValkeyConnection(options.ConnectionPoolKey, newConnection)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		connection, err = newConnection()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if err != nil {
-		// Cleanup unused client
-		valkeyClient.Close()
-		return nil, err
+	logger := options.Logger
+	if logger == nil {
+		logger = zap.NewNop()
 	}
 
-	return &CaddyStorageValkey{client: valkeyClient, locker: valkeyLocker}, nil
+	layout := options.Layout
+	if layout == nil {
+		layout = hashLayout{}
+	}
+
+	storage := &CaddyStorageValkey{
+		valkeyConnection: connection,
+		poolKey:          options.ConnectionPoolKey,
+
+		layout: layout,
+		tracer: newTracer(options.TracerProvider),
+		logger: logger,
+
+		slowOperationThreshold: options.SlowOperationThreshold,
+
+		timeouts: operationTimeouts{
+			read:  options.ReadTimeout,
+			write: options.WriteTimeout,
+			list:  options.ListTimeout,
+			lock:  options.LockTimeout,
+		},
+		maxRetries: options.MaxRetries,
+		breaker:    newCircuitBreaker(options.CircuitBreakerThreshold, options.CircuitBreakerCooldown, connection.address, logger),
+
+		replicaOperations: options.ReplicaOperations,
+
+		migrateFrom:    options.MigrateFrom,
+		migrateDeletes: options.MigrateDeletes,
+	}
+
+	if options.MirrorTo != nil {
+		storage.mirror = newStorageMirror(options.MirrorTo, options.MirrorQueueSize, logger)
+	}
+
+	logger.Info("connected to valkey",
+		zap.Bool("reused", connectionReused),
+		zap.Bool("shared_lock_client", connection.sharedClient),
+		zap.String("topology", storage.topology),
+		zap.String("layout", layout.Name()),
+		zap.Bool("read_only", layout.ReadOnly()),
+		zap.Strings("address", connection.address),
+		zap.Strings("replica", connection.replicaAddress),
+	)
+
+	return storage, nil
+}
+
+// Topology returns the kind of valkey deployment the client is connected to,
+// which is one of `standalone`, `replica`, `sentinel` or `cluster`.
+func (c *CaddyStorageValkey) Topology() string {
+	return c.topology
 }
 
-func (c *CaddyStorageValkey) Lock(ctx context.Context, key string) error {
-	// Abort when the cancel function for the lock already exists
-	if c.Exists(ctx, key) {
+// clientFor returns the client for the commands of the operation, which is the
+// replica client for the replica operations.
+func (c *CaddyStorageValkey) clientFor(operation string) valkey.Client {
+	if c.replicaClient != nil && slices.Contains(c.replicaOperations, operation) {
+		return c.replicaClient
+	}
+
+	return c.client
+}
+
+// startOperation starts the span, the timing for the metrics and the logging of
+// a single storage operation. The returned function finishes all of them and
+// needs to be called with the resulting error of the operation.
+func (c *CaddyStorageValkey) startOperation(ctx context.Context, operation string, key string) (context.Context, trace.Span, func(error)) {
+	start := time.Now()
+
+	ctx, span := c.tracer.Start(ctx, SPAN_PREFIX+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String(ATTRIBUTE_OPERATION, operation),
+			attribute.String(ATTRIBUTE_KEY, key),
+		))
+
+	// The callers often pass a context without any deadline
+	cancel := context.CancelFunc(func() {})
+	if timeout := c.timeouts.of(operation); timeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errOperationTimeout)
+	}
+
+	return ctx, span, func(err error) {
+		cancel()
+		observeOperation(operation, start, err)
+
+		duration := time.Since(start)
+		if c.slowOperationThreshold > 0 && duration > c.slowOperationThreshold {
+			c.logger.Warn("slow storage operation",
+				zap.String("operation", operation),
+				zap.String("key", key),
+				zap.Duration("duration", duration),
+				zap.Duration("threshold", c.slowOperationThreshold),
+			)
+		}
+
+		// A missing key or a taken lock are expected results and no failure of the operation
+		outcome := operationOutcome(err)
+		if outcome == OUTCOME_ERROR {
+			c.logger.Error("storage operation failed",
+				zap.String("operation", operation),
+				zap.String("key", key),
+				zap.Error(err),
+			)
+		}
+		if outcome == OUTCOME_ERROR || outcome == OUTCOME_CONTENDED {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (c *CaddyStorageValkey) Lock(ctx context.Context, key string) (err error) {
+	ctx, span, finish := c.startOperation(ctx, OPERATION_LOCK, key)
+	defer func() { finish(err) }()
+
+	// Abort when the cancel function for the lock already exists. Lock names are
+	// never looked up in the storage migrated from.
+	if c.exists(ctx, key, false) {
 		return fmt.Errorf("lock already exists locally for key '%s'", key)
 	}
 
 	// Acquire the lock for the given key
-	_, cancel, err := c.locker.TryWithContext(ctx, key)
+	lockStart := time.Now()
+	cancel, err := c.tryLock(ctx, key)
+	span.SetAttributes(attribute.Int64(ATTRIBUTE_LOCK_WAIT, time.Since(lockStart).Milliseconds()))
 
-	if err != nil {
+	if errors.Is(err, valkeylock.ErrNotLocked) {
+		c.logger.Debug("lock is held by another instance", zap.String("key", key))
+		return err
+	} else if err != nil {
 		return err
 	}
 
 	// Remmeber the cancel function in order to unlock the lock
 	c.locks.Store(key, cancel)
+	storageMetrics.locksHeld.Inc()
+	c.logger.Debug("acquired lock", zap.String("key", key))
 
 	return nil
 }
 
-func (c *CaddyStorageValkey) Unlock(ctx context.Context, key string) error {
+func (c *CaddyStorageValkey) Unlock(ctx context.Context, key string) (err error) {
+	_, _, finish := c.startOperation(ctx, OPERATION_UNLOCK, key)
+	defer func() { finish(err) }()
+
 	// When lock found, unlock it
-	if unlock, ok := c.locks.Load(key); ok {
+	if unlock, ok := c.locks.LoadAndDelete(key); ok {
 		// Unlock and delete it
 		unlock.(context.CancelFunc)()
-		c.locks.Delete(key)
+		storageMetrics.locksHeld.Dec()
+		c.logger.Debug("released lock", zap.String("key", key))
 
 		return nil
 	}
@@ -97,75 +335,157 @@ func (c *CaddyStorageValkey) Unlock(ctx context.Context, key string) error {
 }
 
 func (c *CaddyStorageValkey) Store(ctx context.Context, key string, value []byte) error {
-	// Store the key and value with metdata
-	return c.client.Do(
-		ctx,
-		c.client.B().Hmset().
-			Key(key).
-			FieldValue().
-			FieldValue(ENTRY_KEY_VALUE, string(value[:])).
-			FieldValue(ENTRY_KEY_LASTMODIFIED, time.Now().Format(TIMEFORMAT)).
-			FieldValue(ENTRY_KEY_SIZE, fmt.Sprint(len(value))).Build()).Error()
-}
-
-func (c *CaddyStorageValkey) Load(ctx context.Context, key string) ([]byte, error) {
-	// Get only the value from valkey without meta info
-	value, err := c.client.Do(
-		ctx,
-		c.client.B().Hget().
-			Key(key).
-			Field(ENTRY_KEY_VALUE).Build()).AsBytes()
+	return c.StoreWithModified(ctx, key, value, time.Now())
+}
+
+// StoreWithModified stores the value like Store, but keeps the given modification
+// time instead of the current time. This allows copying entries between storages.
+func (c *CaddyStorageValkey) StoreWithModified(ctx context.Context, key string, value []byte, modified time.Time) (err error) {
+	ctx, span, finish := c.startOperation(ctx, OPERATION_STORE, key)
+	defer func() { finish(err) }()
+
+	err = c.withRetries(ctx, OPERATION_STORE, func() error {
+		return c.layout.Store(ctx, c.client, key, value, modified)
+	})
+
+	if err == nil {
+		storageMetrics.bytesWritten.Add(float64(len(value)))
+		span.SetAttributes(attribute.Int(ATTRIBUTE_BYTES, len(value)))
+
+		if c.mirror != nil {
+			c.mirror.enqueue(mirrorOperation{key: key, value: bytes.Clone(value), modified: modified})
+		}
+	}
+
+	return err
+}
+
+func (c *CaddyStorageValkey) Load(ctx context.Context, key string) (value []byte, err error) {
+	ctx, span, finish := c.startOperation(ctx, OPERATION_LOAD, key)
+	defer func() { finish(err) }()
 
 	// Caddy expects a specific fs Error for when the key is not present
-	if value == nil || valkey.IsValkeyNil(err) {
-		return nil, fs.ErrNotExist
+	err = c.withRetries(ctx, OPERATION_LOAD, func() error {
+		value, err = c.layout.Load(ctx, c.clientFor(OPERATION_LOAD), key)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) && c.migrateFrom != nil {
+		value, _, err = c.migrateKey(ctx, OPERATION_LOAD, key)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	storageMetrics.bytesRead.Add(float64(len(value)))
+	span.SetAttributes(attribute.Int(ATTRIBUTE_BYTES, len(value)))
 
-	return value, err
+	return value, nil
 }
 
-func (c *CaddyStorageValkey) Delete(ctx context.Context, key string) error {
-	return c.client.Do(ctx, c.client.B().Del().Key(key).Build()).Error()
+func (c *CaddyStorageValkey) Delete(ctx context.Context, key string) (err error) {
+	ctx, _, finish := c.startOperation(ctx, OPERATION_DELETE, key)
+	defer func() { finish(err) }()
+
+	if c.layout.ReadOnly() {
+		return ErrReadOnlyLayout
+	}
+
+	err = c.withRetries(ctx, OPERATION_DELETE, func() error {
+		return c.client.Do(ctx, c.client.B().Del().Key(c.layout.Key(key)).Build()).Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.mirror != nil {
+		c.mirror.enqueue(mirrorOperation{key: key, delete: true})
+	}
+
+	// Otherwise the deleted entry would be migrated again with the next read
+	if c.migrateFrom != nil && c.migrateDeletes {
+		return c.deleteFromMigrationSource(ctx, key)
+	}
+
+	return nil
 }
 
 func (c *CaddyStorageValkey) Exists(ctx context.Context, key string) bool {
-	r, err := c.client.Do(ctx, c.client.B().Exists().Key(key).Build()).AsBool()
+	return c.exists(ctx, key, true)
+}
+
+// exists checks for the key in valkey, and if wanted in the storage migrated
+// from when missing in valkey.
+func (c *CaddyStorageValkey) exists(ctx context.Context, key string, migrate bool) bool {
+	ctx, _, finish := c.startOperation(ctx, OPERATION_EXISTS, key)
+
+	// The migration runs within the timeout of the operation, like for Load and Stat
+	var r bool
+	err := c.withRetries(ctx, OPERATION_EXISTS, func() (err error) {
+		r, err = c.clientFor(OPERATION_EXISTS).Do(ctx, c.client.B().Exists().Key(c.layout.Key(key)).Build()).AsBool()
+		return err
+	})
+	defer finish(err)
+
 	if err != nil {
 		return false
 	}
 
+	if !r && migrate && c.migrateFrom != nil {
+		_, _, err := c.migrateKey(ctx, OPERATION_EXISTS, key)
+		return err == nil
+	}
+
 	return r
 }
 
-func (c *CaddyStorageValkey) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	r := []string{}
+func (c *CaddyStorageValkey) List(ctx context.Context, prefix string, recursive bool) (r []string, err error) {
+	ctx, span, finish := c.startOperation(ctx, OPERATION_LIST, "")
+	defer func() { finish(err) }()
+	span.SetAttributes(
+		attribute.String(ATTRIBUTE_PREFIX, prefix),
+		attribute.Bool(ATTRIBUTE_RECURSIVE, recursive),
+	)
+
+	r = []string{}
 	initialCursorId := uint64(0)
 	cursorId := initialCursorId
+	scanIterations := 0
 
 	// For handling non-recursive list
 	keysMap := make(map[string]bool)
 
 	for {
 		// Scan based on the given prefix
-		entry, err := c.client.Do(
-			ctx,
-			c.client.B().Scan().
-				Cursor(cursorId).
-				Match(fmt.Sprintf("%s*", prefix)).
-				Count(SCAN_COUNT).Build()).AsScanEntry()
+		var entry valkey.ScanEntry
+		err := c.withRetries(ctx, OPERATION_LIST, func() (err error) {
+			entry, err = c.clientFor(OPERATION_LIST).Do(
+				ctx,
+				c.client.B().Scan().
+					Cursor(cursorId).
+					Match(fmt.Sprintf("%s*", c.layout.Key(prefix))).
+					Count(SCAN_COUNT).
+					Type(c.layout.ScanType()).Build()).AsScanEntry()
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
+		scanIterations++
 
-		if !recursive {
-			// for non-recursive split path and look for unique keys just under given prefix
-			for _, key := range entry.Elements {
+		for _, valkeyKey := range entry.Elements {
+			key, ok := c.layout.StorageKey(valkeyKey)
+			if !ok {
+				continue
+			}
+
+			if !recursive {
+				// for non-recursive split path and look for unique keys just under given prefix
 				dir := strings.Split(strings.TrimPrefix(key, prefix+"/"), "/")
 				keysMap[dir[0]] = true
+			} else {
+				// for recursive, we accept all elements
+				r = append(r, key)
 			}
-		} else {
-			// for recursive, we accept all elements
-			r = append(r, entry.Elements...)
 		}
 
 		// Scan is done, when we arrived at the initial cursor again
@@ -177,6 +497,31 @@ func (c *CaddyStorageValkey) List(ctx context.Context, prefix string, recursive
 		cursorId = entry.Cursor
 	}
 
+	storageMetrics.listScanIterations.Observe(float64(scanIterations))
+	span.SetAttributes(attribute.Int(ATTRIBUTE_SCAN_ITERATIONS, scanIterations))
+
+	// Merge the keys of the storage migrated from
+	if c.migrateFrom != nil {
+		migrationKeys, err := c.listMigrationSource(ctx, prefix, recursive)
+		if err != nil {
+			return nil, err
+		}
+
+		// Avoid duplicates of keys that have already been migrated
+		knownKeys := make(map[string]bool, len(r))
+		for _, key := range r {
+			knownKeys[key] = true
+		}
+
+		for _, key := range migrationKeys {
+			if !recursive {
+				keysMap[path.Base(key)] = true
+			} else if !knownKeys[key] {
+				r = append(r, key)
+			}
+		}
+	}
+
 	if !recursive {
 		// for non-recursive extract actual keys from keys map
 		for key := range keysMap {
@@ -184,69 +529,74 @@ func (c *CaddyStorageValkey) List(ctx context.Context, prefix string, recursive
 		}
 	}
 
+	span.SetAttributes(attribute.Int(ATTRIBUTE_KEYS, len(r)))
+
 	return r, nil
 }
 
-func (c *CaddyStorageValkey) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	// Minimal keyinfo (IsTerminal is always true, as we only create files, no directories)
-	info := certmagic.KeyInfo{Key: key, IsTerminal: true}
-
-	// Get meta info for key
-	value, err := c.client.Do(
-		ctx,
-		c.client.B().Hmget().
-			Key(key).
-			Field(ENTRY_KEY_LASTMODIFIED, ENTRY_KEY_SIZE).Build()).ToArray()
+func (c *CaddyStorageValkey) Stat(ctx context.Context, key string) (info certmagic.KeyInfo, err error) {
+	ctx, span, finish := c.startOperation(ctx, OPERATION_STAT, key)
+	defer func() { finish(err) }()
 
-	if err != nil {
-		return info, err
-	}
+	err = c.withRetries(ctx, OPERATION_STAT, func() error {
+		info, err = c.layout.Stat(ctx, c.clientFor(OPERATION_STAT), key)
+		return err
+	})
 
-	if len(value) != 2 {
-		return info, fmt.Errorf("unexpected return length of reading values for key '%s'", key)
-	}
+	if errors.Is(err, fs.ErrNotExist) {
+		if c.migrateFrom != nil {
+			migratedValue, migratedInfo, err := c.migrateKey(ctx, OPERATION_STAT, key)
+			if err != nil {
+				return info, err
+			}
 
-	// Parse last modified
-	lastModifiedRaw, err := value[0].ToString()
-	if err != nil {
-		return info, err
-	}
+			info.Modified = migratedInfo.Modified
+			info.Size = int64(len(migratedValue))
 
-	lastModified, err := time.Parse(TIMEFORMAT, lastModifiedRaw)
-	if err != nil {
-		return info, err
-	}
-	info.Modified = lastModified
+			return info, nil
+		}
 
-	// Parse size
-	sizeRaw, err := value[1].ToString()
-	if err != nil {
+		return info, fs.ErrNotExist
+	} else if err != nil {
 		return info, err
 	}
 
-	size, err := strconv.ParseInt(sizeRaw, 10, 64)
-	if err != nil {
-		return info, err
-	}
-	info.Size = size
+	span.SetAttributes(attribute.Int64(ATTRIBUTE_BYTES, info.Size))
 
 	return info, nil
 }
 
-func (c *CaddyStorageValkey) Close() error {
-	// Cleanup all held locks by this instance
+// HeldLocks returns the names of all locks currently held by this instance.
+func (c *CaddyStorageValkey) HeldLocks() []string {
+	r := []string{}
+
 	c.locks.Range(func(key, value any) bool {
-		value.(context.CancelFunc)()
+		r = append(r, key.(string))
 
 		return true
 	})
-	c.locks.Clear()
 
-	// Close all connections
-	c.client.Close()
-	c.locker.Close()
+	return r
+}
 
-	return nil
+// Ping checks whether the valkey server is reachable with the current client.
+func (c *CaddyStorageValkey) Ping(ctx context.Context) error {
+	return c.client.Do(ctx, c.client.B().Ping().Build()).Error()
+}
+
+// Close closes the connection, which also releases all held locks. A pooled
+// connection is only closed, once no other storage uses it anymore.
+func (c *CaddyStorageValkey) Close() error {
+	// Apply pending writes to the mirror before closing
+	if c.mirror != nil {
+		c.mirror.close()
+	}
+
+	if len(c.poolKey) > 0 {
+		return releaseValkeyConnection(c.poolKey)
+	}
+
+	return c.valkeyConnection.Destruct()
 }
 
 var (
@@ -0,0 +1,590 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tlsOptions are the TLS settings of a single connection as given in the config.
+type tlsOptions struct {
+	Insecure     bool
+	MinVersion   string
+	MaxVersion   string
+	ServerName   string
+	CipherSuites []string
+	Curves       []string
+	CaCert       string
+	CaCerts      []string
+	SystemRoots  bool
+	ClientCert   string
+	ClientKey    string
+
+	// Read the CA and client certificate files again when they change
+	Reload bool
+
+	// Prepended to the option names in error messages, e.g. for the sentinel block
+	optionPrefix string
+}
+
+func (o tlsOptions) optionName(name string) string {
+	return fmt.Sprintf("`%s%s`", o.optionPrefix, name)
+}
+
+// Names of the curves as used by the tls app of caddy
+var tlsCurves = map[string]tls.CurveID{
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"x25519":         tls.X25519,
+	"secp256r1":      tls.CurveP256,
+	"secp384r1":      tls.CurveP384,
+	"secp521r1":      tls.CurveP521,
+}
+
+// isConfigured reports whether any TLS option has been set.
+func (o tlsOptions) isConfigured() bool {
+	return (o.Insecure ||
+		len(o.MinVersion) > 0 ||
+		len(o.MaxVersion) > 0 ||
+		len(o.ServerName) > 0 ||
+		len(o.CipherSuites) > 0 ||
+		len(o.Curves) > 0 ||
+		len(o.CaCert) > 0 ||
+		len(o.CaCerts) > 0 ||
+		o.SystemRoots ||
+		len(o.ClientCert) > 0 ||
+		len(o.ClientKey) > 0 ||
+		o.Reload)
+}
+
+func (o tlsOptions) validate() error {
+	// Verify TLS min and max version, the min version defaults to TLS v1.2
+	minVersion, ok := tlsVersion(o.MinVersion)
+	if !ok {
+		return fmt.Errorf("invalid value for %s", o.optionName("tls_min_version"))
+	}
+	maxVersion, ok := tlsVersion(o.MaxVersion)
+	if !ok {
+		return fmt.Errorf("invalid value for %s", o.optionName("tls_max_version"))
+	}
+	if maxVersion != 0 && maxVersion < max(minVersion, tls.VersionTLS12) {
+		return fmt.Errorf("the %s option needs to be at least %s", o.optionName("tls_max_version"), o.optionName("tls_min_version"))
+	}
+
+	// Cipher suites of TLS v1.3 are not configurable
+	if _, err := cipherSuiteIds(o.CipherSuites); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", o.optionName("tls_cipher_suites"), err)
+	}
+	if len(o.CipherSuites) > 0 && minVersion == tls.VersionTLS13 {
+		return fmt.Errorf("the %s option only applies to TLS v1.2", o.optionName("tls_cipher_suites"))
+	}
+
+	if _, err := curveIds(o.Curves); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", o.optionName("tls_curves"), err)
+	}
+
+	// Verify TLS options are PEM or filepaths
+	if !validatePemStringOrFilepathOption(o.CaCert) {
+		return fmt.Errorf("given value is no PEM string or filepath for key %s", o.optionName("tls_ca_cert"))
+	}
+	for _, caCert := range o.CaCerts {
+		if len(caCert) == 0 || !validatePemStringOrFilepathOption(caCert) {
+			return fmt.Errorf("given value is no PEM string or filepath for key %s", o.optionName("tls_ca_certs"))
+		}
+	}
+	if !validatePemStringOrFilepathOption(o.ClientCert) {
+		return fmt.Errorf("given value is no PEM string or filepath for key %s", o.optionName("tls_client_cert"))
+	}
+	if !validatePemStringOrFilepathOption(o.ClientKey) {
+		return fmt.Errorf("given value is no PEM string or filepath for key %s", o.optionName("tls_client_key"))
+	}
+
+	// The system roots are used anyway without a custom CA
+	if o.SystemRoots && len(o.caCertEntries()) == 0 {
+		return fmt.Errorf("the %s option requires %s or %s", o.optionName("tls_system_roots"), o.optionName("tls_ca_cert"), o.optionName("tls_ca_certs"))
+	}
+
+	// Only files can change while running
+	if o.Reload && !o.hasReloadableCaCert() && !isReloadableFile(o.ClientCert) && !isReloadableFile(o.ClientKey) {
+		return fmt.Errorf("the %s option requires %s, %s, %s or %s to be a file", o.optionName("tls_reload"), o.optionName("tls_ca_cert"), o.optionName("tls_ca_certs"), o.optionName("tls_client_cert"), o.optionName("tls_client_key"))
+	}
+
+	return nil
+}
+
+// apply applies the options to the given TLS config, which is created when not
+// present yet. It can be present when we parse the URL and it has the TLS mentioned.
+// With reloading, the returned reloader needs to wrap the dial function of the
+// client, as it verifies the certificate of the server itself.
+func (o tlsOptions) apply(tlsConfig *tls.Config, logger *zap.Logger) (*tls.Config, *tlsReloader, error) {
+	// Initialize client TLS config if not present
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: o.Insecure,
+		}
+	} else {
+		tlsConfig.InsecureSkipVerify = o.Insecure
+	}
+
+	// Set min version, or fallback to default
+	if len(o.MinVersion) > 0 {
+		switch o.MinVersion {
+		case "tlsv1.2":
+			tlsConfig.MinVersion = tls.VersionTLS12
+		case "tlsv1.3":
+			tlsConfig.MinVersion = tls.VersionTLS13
+		default:
+			return nil, nil, fmt.Errorf("invalid value for %s", o.optionName("tls_min_version"))
+		}
+	} else {
+		// Default is TLS v1.2
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	// Set max version, zero allows the latest version supported
+	maxVersion, ok := tlsVersion(o.MaxVersion)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid value for %s", o.optionName("tls_max_version"))
+	}
+	tlsConfig.MaxVersion = maxVersion
+
+	// Verify the certificate against this name instead of the host of the address
+	if len(o.ServerName) > 0 {
+		tlsConfig.ServerName = o.ServerName
+	}
+
+	if len(o.CipherSuites) > 0 {
+		cipherSuites, err := cipherSuiteIds(o.CipherSuites)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %v", o.optionName("tls_cipher_suites"), err)
+		}
+		tlsConfig.CipherSuites = cipherSuites
+	}
+
+	if len(o.Curves) > 0 {
+		curves, err := curveIds(o.Curves)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %v", o.optionName("tls_curves"), err)
+		}
+		tlsConfig.CurvePreferences = curves
+	}
+
+	// Initialize CA Certificate if present
+	if len(o.caCertEntries()) > 0 {
+		caCertPool, err := o.caCertPool()
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	// Configure client certificate
+	if len(o.ClientCert) > 0 || len(o.ClientKey) > 0 {
+		// SMall sanity check
+		if len(o.ClientCert) > 0 && len(o.ClientKey) == 0 {
+			return nil, nil, errors.New("both client certificate and key need to be provided, key is missing")
+		} else if len(o.ClientCert) == 0 && len(o.ClientKey) > 0 {
+			return nil, nil, errors.New("both client certificate and key need to be provided, certificate is missing")
+		}
+
+		clientCertificate, err := o.clientCertificate()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Given we have a client certificate, we require and verify everything for security purposes
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.Certificates = []tls.Certificate{clientCertificate}
+	}
+
+	// Replace the material read above with the one read again on changes
+	var reloader *tlsReloader
+	if o.Reload {
+		reloader = newTlsReloader(o, logger, tlsConfig)
+		reloader.install(tlsConfig)
+	}
+
+	return tlsConfig, reloader, nil
+}
+
+// caCertPool reads all CA certificates from the PEM strings or files, optionally
+// in addition to the system roots.
+func (o tlsOptions) caCertPool() (*x509.CertPool, error) {
+	caCertPool := x509.NewCertPool()
+	if o.SystemRoots {
+		systemCertPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("loading system roots for %s: %v", o.optionName("tls_system_roots"), err)
+		}
+		caCertPool = systemCertPool
+	}
+
+	for _, caCert := range o.caCertEntries() {
+		// Strings and files can both contain a bundle of multiple certificates
+		if certData, _ := pem.Decode([]byte(caCert)); certData != nil {
+			if ok := caCertPool.AppendCertsFromPEM([]byte(caCert)); !ok {
+				return nil, fmt.Errorf("failed to add %s PEM string to certificate pool", o.optionName("tls_ca_cert"))
+			}
+		} else if isFilePath(caCert) {
+			cert, err := os.ReadFile(caCert)
+			if err != nil {
+				return nil, err
+			}
+			if ok := caCertPool.AppendCertsFromPEM(cert); !ok {
+				return nil, fmt.Errorf("failed to add %s file content to certificate pool", o.optionName("tls_ca_cert"))
+			}
+		} else {
+			return nil, fmt.Errorf("failed to add %s is no PEM string or filepath", o.optionName("tls_ca_cert"))
+		}
+	}
+
+	return caCertPool, nil
+}
+
+// clientCertificate reads the client keypair from the PEM strings or files.
+func (o tlsOptions) clientCertificate() (tls.Certificate, error) {
+	var certPem []byte
+	var keyPem []byte
+
+	// NOTE: The following two blocks have been copied in order to keep the verbose error messages
+
+	if certData, _ := pem.Decode([]byte(o.ClientCert)); certData != nil {
+		certPem = []byte(o.ClientCert)
+	} else if isFilePath(o.ClientCert) {
+		rawCert, err := os.ReadFile(o.ClientCert)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if certData, _ := pem.Decode(rawCert); certData != nil {
+			certPem = rawCert
+		} else {
+			return tls.Certificate{}, fmt.Errorf("invalid PEM in %s file", o.optionName("tls_client_cert"))
+		}
+	} else {
+		return tls.Certificate{}, fmt.Errorf("failed to add %s is no PEM string or filepath", o.optionName("tls_client_cert"))
+	}
+
+	if keyData, _ := pem.Decode([]byte(o.ClientKey)); keyData != nil {
+		keyPem = []byte(o.ClientKey)
+	} else if isFilePath(o.ClientKey) {
+		rawKey, err := os.ReadFile(o.ClientKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if keyData, _ := pem.Decode(rawKey); keyData != nil {
+			keyPem = rawKey
+		} else {
+			return tls.Certificate{}, fmt.Errorf("invalid PEM in %s file", o.optionName("tls_client_key"))
+		}
+	} else {
+		return tls.Certificate{}, fmt.Errorf("failed to add %s is no PEM string or filepath", o.optionName("tls_client_key"))
+	}
+
+	// Build certificate out of keypair
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+// caCertEntries returns all given CA certificates as PEM strings or filepaths.
+func (o tlsOptions) caCertEntries() []string {
+	entries := []string{}
+	if len(o.CaCert) > 0 {
+		entries = append(entries, o.CaCert)
+	}
+
+	return append(entries, o.CaCerts...)
+}
+
+// tlsVersion returns the version of the given option value, or zero when empty.
+func tlsVersion(val string) (uint16, bool) {
+	switch val {
+	case "":
+		return 0, true
+	case "tlsv1.2":
+		return tls.VersionTLS12, true
+	case "tlsv1.3":
+		return tls.VersionTLS13, true
+	}
+
+	return 0, false
+}
+
+// cipherSuiteIds returns the ids of the given cipher suite names. Insecure cipher
+// suites are not accepted.
+func cipherSuiteIds(names []string) ([]uint16, error) {
+	ids := []uint16{}
+
+	for _, name := range names {
+		found := false
+		for _, cipherSuite := range tls.CipherSuites() {
+			if cipherSuite.Name == name {
+				ids = append(ids, cipherSuite.ID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+	}
+
+	return ids, nil
+}
+
+func curveIds(names []string) ([]tls.CurveID, error) {
+	ids := []tls.CurveID{}
+
+	for _, name := range names {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// hasReloadableCaCert reports whether any CA certificate is read from a file.
+func (o tlsOptions) hasReloadableCaCert() bool {
+	for _, caCert := range o.caCertEntries() {
+		if isReloadableFile(caCert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReloadableFile reports whether the value is a file instead of a PEM string.
+func isReloadableFile(val string) bool {
+	if cert, _ := pem.Decode([]byte(val)); cert != nil {
+		return false
+	}
+
+	return isFilePath(val)
+}
+
+// tlsReloader reads the CA and client certificate files again, when they have
+// changed since they have been read last. The files are checked on every TLS
+// handshake, which only happens for new connections. The previous material is
+// kept until the changed files can be parsed, which means files in the middle of
+// being written are just read again on the next handshake.
+type tlsReloader struct {
+	options tlsOptions
+	logger  *zap.Logger
+
+	// The config the reloader is installed on
+	tlsConfig *tls.Config
+
+	mu                sync.Mutex
+	modTimes          map[string]time.Time
+	caCertPool        *x509.CertPool
+	clientCertificate *tls.Certificate
+}
+
+func newTlsReloader(options tlsOptions, logger *zap.Logger, tlsConfig *tls.Config) *tlsReloader {
+	r := &tlsReloader{
+		options:    options,
+		logger:     logger.Named("tls"),
+		modTimes:   map[string]time.Time{},
+		caCertPool: tlsConfig.RootCAs,
+	}
+	if len(tlsConfig.Certificates) > 0 {
+		r.clientCertificate = &tlsConfig.Certificates[0]
+	}
+
+	// The material has just been read by apply
+	for _, file := range r.files() {
+		r.modTimes[file], _ = modTime(file)
+	}
+
+	return r
+}
+
+// install replaces the static material of the TLS config with the callbacks.
+func (r *tlsReloader) install(tlsConfig *tls.Config) {
+	r.tlsConfig = tlsConfig
+
+	if r.clientCertificate != nil && (isReloadableFile(r.options.ClientCert) || isReloadableFile(r.options.ClientKey)) {
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = r.getClientCertificate
+	}
+
+	// The default verification only uses the static pool, so it is done here instead
+	if r.verifiesServer() {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return r.verifyConnection(state, state.ServerName)
+		}
+	}
+}
+
+// verifiesServer reports whether the certificate of the server is verified by
+// the reloader instead of the default verification.
+func (r *tlsReloader) verifiesServer() bool {
+	return r.caCertPool != nil && r.options.hasReloadableCaCert() && !r.options.Insecure
+}
+
+// dialCtxFn wraps the dial function of the client, so the certificate of the
+// server is verified against the name it is dialed with. The name sent with SNI
+// is not enough, as it is missing for IP addresses. Without a dial function,
+// the client dials by itself.
+func (r *tlsReloader) dialCtxFn(next dialCtxFn) dialCtxFn {
+	return func(ctx context.Context, address string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+		// The dial function is shared with the sentinels, which have a TLS config
+		// of their own, and unix sockets do not use TLS
+		if tlsConfig != r.tlsConfig || !r.verifiesServer() || isUnixSocketPath(address) {
+			return dialTls(ctx, next, address, dialer, tlsConfig)
+		}
+
+		serverName := tlsConfig.ServerName
+		if len(serverName) == 0 {
+			serverName, _, _ = net.SplitHostPort(address)
+		}
+		if len(serverName) == 0 {
+			return nil, fmt.Errorf("no server name to verify the certificate of %s against, set %s", address, r.options.optionName("tls_server_name"))
+		}
+
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = serverName
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return r.verifyConnection(state, serverName)
+		}
+
+		return dialTls(ctx, next, address, dialer, tlsConfig)
+	}
+}
+
+// dialTls dials with the given dial function, or like the client does without.
+func dialTls(ctx context.Context, dial dialCtxFn, address string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+	if dial != nil {
+		return dial(ctx, address, dialer, tlsConfig)
+	}
+	if tlsConfig == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	return (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+}
+
+// files returns all files of the material, which is read from files.
+func (r *tlsReloader) files() []string {
+	files := []string{}
+	for _, val := range append(r.options.caCertEntries(), r.options.ClientCert, r.options.ClientKey) {
+		if isReloadableFile(val) {
+			files = append(files, val)
+		}
+	}
+
+	return files
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// reloadIfChanged reads the material again, when any of the files has changed.
+func (r *tlsReloader) reloadIfChanged() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := []string{}
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		current, err := modTime(file)
+		if err != nil {
+			// Files are often replaced by a rename, try again on the next handshake
+			continue
+		}
+		if !current.Equal(r.modTimes[file]) {
+			modTimes[file] = current
+			changed = append(changed, file)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	caCertPool := r.caCertPool
+	if r.caCertPool != nil && r.options.hasReloadableCaCert() {
+		pool, err := r.options.caCertPool()
+		if err != nil {
+			r.logger.Warn("keeping previous CA certificate, changed file is invalid", zap.Strings("files", changed), zap.Error(err))
+			return
+		}
+		caCertPool = pool
+	}
+
+	clientCertificate := r.clientCertificate
+	if r.clientCertificate != nil && (isReloadableFile(r.options.ClientCert) || isReloadableFile(r.options.ClientKey)) {
+		certificate, err := r.options.clientCertificate()
+		if err != nil {
+			r.logger.Warn("keeping previous client certificate, changed files are invalid", zap.Strings("files", changed), zap.Error(err))
+			return
+		}
+		clientCertificate = &certificate
+	}
+
+	// Invalid files are read again on the next handshake, as their time is kept
+	for file, current := range modTimes {
+		r.modTimes[file] = current
+	}
+	r.caCertPool = caCertPool
+	r.clientCertificate = clientCertificate
+	r.logger.Info("reloaded TLS certificates", zap.Strings("files", changed))
+}
+
+func (r *tlsReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.clientCertificate, nil
+}
+
+// verifyConnection does the same verification as the default one, but with the
+// current CA certificate pool. The certificate is never accepted without a name
+// to verify it against.
+func (r *tlsReloader) verifyConnection(state tls.ConnectionState, serverName string) error {
+	if len(serverName) == 0 {
+		return fmt.Errorf("no server name to verify the certificate against, set %s", r.options.optionName("tls_server_name"))
+	}
+
+	r.reloadIfChanged()
+
+	r.mu.Lock()
+	caCertPool := r.caCertPool
+	r.mu.Unlock()
+
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no server certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         caCertPool,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
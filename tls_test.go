@@ -0,0 +1,524 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, commonName string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a certificate for the given names and IP addresses, with its
+// certificate and key PEM encoded.
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, ips []net.IP) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, certPem, keyPem
+}
+
+// testTlsServer accepts TLS connections with the current certificate and
+// remembers the common name of the last client certificate.
+type testTlsServer struct {
+	address     string
+	certificate atomic.Pointer[tls.Certificate]
+	clientName  atomic.Pointer[string]
+}
+
+func newTestTlsServer(t *testing.T, certificate tls.Certificate, clientCAs *x509.CertPool) *testTlsServer {
+	t.Helper()
+
+	s := &testTlsServer{}
+	s.certificate.Store(&certificate)
+
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.certificate.Load(), nil
+		},
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s.address = listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+					s.clientName.Store(&certs[0].Subject.CommonName)
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	return s
+}
+
+// writeFile writes the file with a modification time after the previous one,
+// as the reloader only reads files with a changed modification time.
+func writeFile(t *testing.T, file string, content []byte) {
+	t.Helper()
+
+	var modified time.Time
+	if info, err := os.Stat(file); err == nil {
+		modified = info.ModTime().Add(time.Second)
+	} else {
+		modified = time.Now()
+	}
+
+	if err := os.WriteFile(file, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dialWith(dial dialCtxFn, address string, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dial(ctx, address, &net.Dialer{}, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func TestTlsReloaderRotatesCaCertificate(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	oldCA := newTestCA(t, "old")
+	newCA := newTestCA(t, "new")
+	localhost := []net.IP{net.ParseIP("127.0.0.1")}
+
+	oldCertificate, _, _ := oldCA.issue(t, "server", nil, localhost)
+	newCertificate, _, _ := newCA.issue(t, "server", nil, localhost)
+	otherCertificate, _, _ := oldCA.issue(t, "server", nil, []net.IP{net.ParseIP("10.0.0.5")})
+
+	writeFile(t, caFile, oldCA.pem)
+
+	tlsConfig, reloader, err := tlsOptions{CaCert: caFile, Reload: true}.apply(nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloader == nil {
+		t.Fatal("expected reloader")
+	}
+	dial := reloader.dialCtxFn(nil)
+
+	server := newTestTlsServer(t, oldCertificate, nil)
+	if err := dialWith(dial, server.address, tlsConfig); err != nil {
+		t.Fatalf("dialing with trusted certificate: %v", err)
+	}
+
+	// A certificate of the trusted CA is only accepted for its own address
+	server.certificate.Store(&otherCertificate)
+	if err := dialWith(dial, server.address, tlsConfig); err == nil {
+		t.Fatal("expected certificate of other IP address to be rejected")
+	}
+
+	// The certificate of the new CA is only trusted once the file changed
+	server.certificate.Store(&newCertificate)
+	if err := dialWith(dial, server.address, tlsConfig); err == nil {
+		t.Fatal("expected certificate of new CA to be rejected before the swap")
+	}
+
+	writeFile(t, caFile, newCA.pem)
+	if err := dialWith(dial, server.address, tlsConfig); err != nil {
+		t.Fatalf("dialing after swapping CA: %v", err)
+	}
+
+	server.certificate.Store(&oldCertificate)
+	if err := dialWith(dial, server.address, tlsConfig); err == nil {
+		t.Fatal("expected certificate of old CA to be rejected after the swap")
+	}
+
+	// Invalid content keeps the previous CA
+	writeFile(t, caFile, []byte("-----BEGIN CERTIFICATE-----\ninvalid"))
+	server.certificate.Store(&newCertificate)
+	if err := dialWith(dial, server.address, tlsConfig); err != nil {
+		t.Fatalf("dialing after writing invalid CA: %v", err)
+	}
+}
+
+func TestTlsReloaderVerifiesServerName(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCA(t, "ca")
+	certificate, _, _ := ca.issue(t, "server", []string{"valkey.example.com"}, nil)
+	writeFile(t, caFile, ca.pem)
+
+	server := newTestTlsServer(t, certificate, nil)
+
+	// The name of the certificate differs from the IP address dialed
+	tlsConfig, reloader, err := tlsOptions{CaCert: caFile, Reload: true}.apply(nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialWith(reloader.dialCtxFn(nil), server.address, tlsConfig); err == nil {
+		t.Fatal("expected certificate for other name to be rejected")
+	}
+
+	// Without the dial function, no name is known for an IP address
+	dial := func(ctx context.Context, address string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+		return dialTls(ctx, nil, address, dialer, tlsConfig)
+	}
+	if err := dialWith(dial, server.address, tlsConfig); err == nil {
+		t.Fatal("expected verification without server name to fail")
+	}
+
+	tlsConfig, reloader, err = tlsOptions{CaCert: caFile, ServerName: "valkey.example.com", Reload: true}.apply(nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialWith(reloader.dialCtxFn(nil), server.address, tlsConfig); err != nil {
+		t.Fatalf("dialing with server name: %v", err)
+	}
+}
+
+func TestTlsReloaderRotatesClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	ca := newTestCA(t, "ca")
+	serverCertificate, _, _ := ca.issue(t, "server", nil, []net.IP{net.ParseIP("127.0.0.1")})
+	_, oldCert, oldKey := ca.issue(t, "old-client", nil, nil)
+	_, newCert, newKey := ca.issue(t, "new-client", nil, nil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := newTestTlsServer(t, serverCertificate, clientCAs)
+
+	writeFile(t, certFile, oldCert)
+	writeFile(t, keyFile, oldKey)
+
+	tlsConfig, reloader, err := tlsOptions{CaCert: string(ca.pem), ClientCert: certFile, ClientKey: keyFile, Reload: true}.apply(nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := reloader.dialCtxFn(nil)
+
+	for _, expected := range []string{"old-client", "new-client"} {
+		if expected == "new-client" {
+			writeFile(t, certFile, newCert)
+			writeFile(t, keyFile, newKey)
+		}
+
+		if err := dialWith(dial, server.address, tlsConfig); err != nil {
+			t.Fatalf("dialing with client certificate %s: %v", expected, err)
+		}
+
+		// The server finishes the handshake after the client
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if name := server.clientName.Load(); name != nil && *name == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected client certificate %s", expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// generateTestCerts runs the script generating the certificates of the test
+// containers and returns the directory they are written to.
+func generateTestCerts(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is required to generate the test certificates")
+	}
+
+	script, err := filepath.Abs(filepath.Join("scripts", "generate-test-certs.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "tests"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The DH params are only used by the server and take long to generate
+	if err := os.WriteFile(filepath.Join(dir, "tests", "valkey.dh"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("bash", script)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generating test certificates: %v\n%s", err, output)
+	}
+
+	return filepath.Join(dir, "tests")
+}
+
+// handshakeWith connects to the address and returns the state of the handshake.
+func handshakeWith(address string, tlsConfig *tls.Config) (tls.ConnectionState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dialTls(ctx, nil, address, &net.Dialer{}, tlsConfig)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	return conn.(*tls.Conn).ConnectionState(), nil
+}
+
+func TestTlsOptionsWithTestCerts(t *testing.T) {
+	certs := generateTestCerts(t)
+	caFile := filepath.Join(certs, "ca.crt")
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(certs, "server.crt"), filepath.Join(certs, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestTlsServer(t, serverCertificate, nil)
+
+	// The bundle starts with another CA, so the CA of the server is only found in its second block
+	otherCA := newTestCA(t, "other")
+	bundle := append(append([]byte{}, otherCA.pem...), caPem...)
+	bundleFile := filepath.Join(t.TempDir(), "bundle.crt")
+	writeFile(t, bundleFile, bundle)
+	otherCAFile := filepath.Join(t.TempDir(), "other.crt")
+	writeFile(t, otherCAFile, otherCA.pem)
+
+	tests := map[string]struct {
+		options tlsOptions
+		trusted bool
+	}{
+		"ca cert file":           {options: tlsOptions{CaCert: caFile}, trusted: true},
+		"ca cert string":         {options: tlsOptions{CaCert: string(caPem)}, trusted: true},
+		"ca bundle string":       {options: tlsOptions{CaCert: string(bundle)}, trusted: true},
+		"ca bundle file":         {options: tlsOptions{CaCert: bundleFile}, trusted: true},
+		"additional ca certs":    {options: tlsOptions{CaCert: otherCAFile, CaCerts: []string{caFile}}, trusted: true},
+		"only ca certs":          {options: tlsOptions{CaCerts: []string{string(otherCA.pem), string(caPem)}}, trusted: true},
+		"system roots":           {options: tlsOptions{CaCert: caFile, SystemRoots: true}, trusted: true},
+		"other ca":               {options: tlsOptions{CaCert: otherCAFile}},
+		"other ca bundle":        {options: tlsOptions{CaCerts: []string{otherCAFile, string(otherCA.pem)}}},
+		"insecure":               {options: tlsOptions{CaCert: otherCAFile, Insecure: true}, trusted: true},
+		"server name":            {options: tlsOptions{CaCert: caFile, ServerName: "localhost"}, trusted: true},
+		"other server name":      {options: tlsOptions{CaCert: caFile, ServerName: "valkey.example.com"}},
+		"insecure server name":   {options: tlsOptions{CaCert: caFile, ServerName: "valkey.example.com", Insecure: true}, trusted: true},
+		"max version tlsv1.2":    {options: tlsOptions{CaCert: caFile, MaxVersion: "tlsv1.2"}, trusted: true},
+		"min version tlsv1.3":    {options: tlsOptions{CaCert: caFile, MinVersion: "tlsv1.3"}, trusted: true},
+		"cipher suites":          {options: tlsOptions{CaCert: caFile, MaxVersion: "tlsv1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}, trusted: true},
+		"curves":                 {options: tlsOptions{CaCert: caFile, Curves: []string{"secp384r1"}}, trusted: true},
+		"cipher suites of ecdsa": {options: tlsOptions{CaCert: caFile, MaxVersion: "tlsv1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tlsConfig, _, err := test.options.apply(nil, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := handshakeWith(server.address, tlsConfig)
+			if !test.trusted {
+				if err == nil {
+					t.Fatal("expected handshake to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected handshake to succeed: %v", err)
+			}
+
+			switch {
+			case len(test.options.MaxVersion) > 0 && state.Version != tls.VersionTLS12:
+				t.Errorf("expected TLS v1.2, got %s", tls.VersionName(state.Version))
+			case len(test.options.MinVersion) > 0 && state.Version != tls.VersionTLS13:
+				t.Errorf("expected TLS v1.3, got %s", tls.VersionName(state.Version))
+			case len(test.options.CipherSuites) > 0 && tls.CipherSuiteName(state.CipherSuite) != test.options.CipherSuites[0]:
+				t.Errorf("expected cipher suite %s, got %s", test.options.CipherSuites[0], tls.CipherSuiteName(state.CipherSuite))
+			case len(test.options.Curves) > 0 && state.CurveID != tls.CurveP384:
+				t.Errorf("expected curve %s, got %s", tls.CurveP384, state.CurveID)
+			}
+		})
+	}
+}
+
+func TestTlsOptionsClientCertificateWithTestCerts(t *testing.T) {
+	certs := generateTestCerts(t)
+	caFile := filepath.Join(certs, "ca.crt")
+	certFile := filepath.Join(certs, "client.crt")
+	keyFile := filepath.Join(certs, "client.key")
+
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(certs, "server.crt"), filepath.Join(certs, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPem)
+	server := newTestTlsServer(t, serverCertificate, clientCAs)
+
+	if _, _, err := (tlsOptions{CaCert: caFile, ClientCert: certFile}).apply(nil, zap.NewNop()); err == nil {
+		t.Fatal("expected client certificate without key to be rejected")
+	}
+	if _, _, err := (tlsOptions{CaCert: caFile, ClientKey: keyFile}).apply(nil, zap.NewNop()); err == nil {
+		t.Fatal("expected client key without certificate to be rejected")
+	}
+	if _, _, err := (tlsOptions{CaCert: caFile, ClientCert: keyFile, ClientKey: certFile}).apply(nil, zap.NewNop()); err == nil {
+		t.Fatal("expected swapped client certificate and key to be rejected")
+	}
+
+	certPem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]tlsOptions{
+		"files":   {CaCert: caFile, ClientCert: certFile, ClientKey: keyFile},
+		"strings": {CaCert: caFile, ClientCert: string(certPem), ClientKey: string(keyPem)},
+	}
+
+	for name, options := range tests {
+		server.clientName.Store(nil)
+
+		tlsConfig, _, err := options.apply(nil, zap.NewNop())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := handshakeWith(server.address, tlsConfig); err != nil {
+			t.Fatalf("%s: dialing with client certificate: %v", name, err)
+		}
+
+		// The server finishes the handshake after the client
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if clientName := server.clientName.Load(); clientName != nil && *clientName == "Client-only" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected client certificate of the test certificates", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
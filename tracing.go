@@ -0,0 +1,30 @@
+package caddystoragevalkey
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "github.com/oltdaniel/caddy-storage-valkey"
+
+	SPAN_PREFIX = "storage_valkey."
+
+	ATTRIBUTE_OPERATION       = "storage.operation"
+	ATTRIBUTE_KEY             = "storage.key"
+	ATTRIBUTE_PREFIX          = "storage.prefix"
+	ATTRIBUTE_RECURSIVE       = "storage.recursive"
+	ATTRIBUTE_BYTES           = "storage.bytes"
+	ATTRIBUTE_KEYS            = "storage.keys"
+	ATTRIBUTE_SCAN_ITERATIONS = "storage.scan_iterations"
+	ATTRIBUTE_LOCK_WAIT       = "storage.lock.wait_ms"
+)
+
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	// Fallback to whatever has been configured globally
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	return provider.Tracer(TRACER_NAME)
+}
@@ -0,0 +1,158 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTracedTestStorage(t *testing.T, f *fakeValkey) (*CaddyStorageValkey, *tracetest.InMemoryExporter) {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	return newTestStorage(t, f, CaddyStorageValkeyOptions{TracerProvider: provider}), exporter
+}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+
+	return attributes
+}
+
+func TestTracingRecordsOperations(t *testing.T) {
+	server := newFakeValkey(t)
+	storage, exporter := newTracedTestStorage(t, server)
+	ctx := context.Background()
+
+	if err := storage.Store(ctx, "certificates/example.com.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Load(ctx, "certificates/example.com.crt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.List(ctx, "certificates", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans of nested operations, e.g. the existence check of Lock, are ignored
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if _, ok := spans[span.Name]; !ok {
+			spans[span.Name] = span
+		}
+	}
+
+	expected := map[string]map[attribute.Key]attribute.Value{
+		SPAN_PREFIX + OPERATION_STORE: {
+			ATTRIBUTE_OPERATION: attribute.StringValue(OPERATION_STORE),
+			ATTRIBUTE_KEY:       attribute.StringValue("certificates/example.com.crt"),
+			ATTRIBUTE_BYTES:     attribute.IntValue(len("certificate")),
+		},
+		SPAN_PREFIX + OPERATION_LOAD: {
+			ATTRIBUTE_OPERATION: attribute.StringValue(OPERATION_LOAD),
+			ATTRIBUTE_KEY:       attribute.StringValue("certificates/example.com.crt"),
+			ATTRIBUTE_BYTES:     attribute.IntValue(len("certificate")),
+		},
+		SPAN_PREFIX + OPERATION_LIST: {
+			ATTRIBUTE_OPERATION: attribute.StringValue(OPERATION_LIST),
+			ATTRIBUTE_PREFIX:    attribute.StringValue("certificates"),
+			ATTRIBUTE_RECURSIVE: attribute.BoolValue(true),
+			ATTRIBUTE_KEYS:      attribute.IntValue(1),
+		},
+		SPAN_PREFIX + OPERATION_LOCK: {
+			ATTRIBUTE_OPERATION: attribute.StringValue(OPERATION_LOCK),
+			ATTRIBUTE_KEY:       attribute.StringValue("issue_cert_example.com"),
+		},
+		SPAN_PREFIX + OPERATION_UNLOCK: {
+			ATTRIBUTE_OPERATION: attribute.StringValue(OPERATION_UNLOCK),
+			ATTRIBUTE_KEY:       attribute.StringValue("issue_cert_example.com"),
+		},
+	}
+
+	for name, attributes := range expected {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected span %s", name)
+			continue
+		}
+		if span.SpanKind != trace.SpanKindClient {
+			t.Errorf("expected span %s of kind client, got %s", name, span.SpanKind)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("expected span %s without error", name)
+		}
+
+		actual := spanAttributes(span)
+		for key, value := range attributes {
+			if actual[key] != value {
+				t.Errorf("expected attribute %s of span %s to be %s, got %s", key, name, value.Emit(), actual[key].Emit())
+			}
+		}
+	}
+
+	if _, ok := spanAttributes(spans[SPAN_PREFIX+OPERATION_LOCK])[ATTRIBUTE_LOCK_WAIT]; !ok {
+		t.Errorf("expected attribute %s of lock span", ATTRIBUTE_LOCK_WAIT)
+	}
+}
+
+func TestTracingRecordsErrors(t *testing.T) {
+	server := newFakeValkey(t)
+	server.handle = func(args []string) (string, bool) {
+		switch strings.ToUpper(args[0]) {
+		case "HGET", "HMSET", "EVAL":
+			return "-ERR injected failure\r\n", true
+		}
+		return "", false
+	}
+	storage, exporter := newTracedTestStorage(t, server)
+	ctx := context.Background()
+
+	if err := storage.Store(ctx, "certificates/example.com.crt", []byte("certificate")); err == nil {
+		t.Fatal("expected store to fail")
+	}
+	if _, err := storage.Load(ctx, "certificates/example.com.crt"); err == nil {
+		t.Fatal("expected load to fail")
+	}
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err == nil {
+		t.Fatal("expected lock to fail")
+	}
+
+	for _, operation := range []string{OPERATION_STORE, OPERATION_LOAD, OPERATION_LOCK} {
+		var span *tracetest.SpanStub
+		for _, s := range exporter.GetSpans() {
+			if s.Name == SPAN_PREFIX+operation {
+				span = &s
+				break
+			}
+		}
+		if span == nil {
+			t.Errorf("expected span of %s", operation)
+			continue
+		}
+
+		if span.Status.Code != codes.Error || !strings.Contains(span.Status.Description, "injected failure") {
+			t.Errorf("expected error status of %s span, got %+v", operation, span.Status)
+		}
+		if len(span.Events) == 0 || span.Events[0].Name != "exception" {
+			t.Errorf("expected error event of %s span", operation)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package caddystoragevalkey
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/certmagic"
+	"github.com/valkey-io/valkey-go/valkeylock"
+)
+
+const (
+	// Prevents multiple imports into the same storage at the same time
+	IMPORT_LOCK_NAME = "valkey_storage_import"
+
+	// Locks held by others are tried again, until giving up on the import
+	IMPORT_LOCK_RETRY_INTERVAL       = time.Second
+	DEFAULT_IMPORT_LOCK_WAIT_TIMEOUT = 5 * time.Minute
+
+	// These lock names are shared with certmagic, so live Caddy instances will not
+	// clean the storage or issue certificates while they get imported.
+	CERTMAGIC_CLEAN_LOCK_NAME = "storage_clean"
+	CERTMAGIC_ISSUE_LOCK_OP   = "issue_cert"
+
+	CERTMAGIC_CERTIFICATES_PREFIX = "certificates"
+
+	FILE_SYSTEM_LOCKS_PREFIX = "locks/"
+)
+
+// transferEntry is a single storage entry that is exported or imported.
+type transferEntry struct {
+	Key      string
+	Value    []byte
+	Modified time.Time
+}
+
+// transferFilter restricts the transferred entries to the keys below any of the
+// included prefixes, while skipping all keys below any of the excluded prefixes.
+type transferFilter struct {
+	include []string
+	exclude []string
+}
+
+func newTransferFilter(fl caddycmd.Flags) (transferFilter, error) {
+	include, err := fl.GetStringArray("include")
+	if err != nil {
+		return transferFilter{}, err
+	}
+
+	exclude, err := fl.GetStringArray("exclude")
+	if err != nil {
+		return transferFilter{}, err
+	}
+
+	return transferFilter{include: include, exclude: exclude}, nil
+}
+
+func (f transferFilter) matches(key string) bool {
+	for _, prefix := range f.exclude {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+
+	// Without any include prefix every key is included
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, prefix := range f.include {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTarPath decides whether the export or import location is a tar archive
+// instead of a directory in the file_system storage layout.
+func isTarPath(location string) bool {
+	return strings.HasSuffix(location, ".tar")
+}
+
+func sameEntry(a transferEntry, b transferEntry) bool {
+	// The storage only keeps the modification time with a precision of seconds
+	return a.Key == b.Key &&
+		sha256.Sum256(a.Value) == sha256.Sum256(b.Value) &&
+		a.Modified.Truncate(time.Second).Equal(b.Modified.Truncate(time.Second))
+}
+
+func verifyEntries(expected []transferEntry, actual []transferEntry) error {
+	actualByKey := make(map[string]transferEntry, len(actual))
+	for _, entry := range actual {
+		actualByKey[entry.Key] = entry
+	}
+
+	for _, entry := range expected {
+		other, ok := actualByKey[entry.Key]
+		if !ok {
+			return fmt.Errorf("verification failed, key '%s' is missing", entry.Key)
+		}
+		if !sameEntry(entry, other) {
+			return fmt.Errorf("verification failed, key '%s' differs", entry.Key)
+		}
+	}
+
+	return nil
+}
+
+func readEntriesFromStorage(ctx context.Context, storage *CaddyStorageValkey, filter transferFilter) ([]transferEntry, error) {
+	keys, err := storage.List(ctx, "", true)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	entries := []transferEntry{}
+	for _, key := range keys {
+		if !filter.matches(key) {
+			continue
+		}
+
+		entry, err := readEntryFromStorage(ctx, storage, key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func readEntryFromStorage(ctx context.Context, storage *CaddyStorageValkey, key string) (transferEntry, error) {
+	value, err := storage.Load(ctx, key)
+	if err != nil {
+		return transferEntry{}, fmt.Errorf("%s: %w", key, err)
+	}
+
+	info, err := storage.Stat(ctx, key)
+	if err != nil {
+		return transferEntry{}, fmt.Errorf("%s: %w", key, err)
+	}
+
+	return transferEntry{Key: key, Value: value, Modified: info.Modified}, nil
+}
+
+func readEntriesFromDir(dir string, filter transferFilter) ([]transferEntry, error) {
+	entries := []transferEntry{}
+
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		// Keys always use slashes, independent of the platform
+		key := filepath.ToSlash(relPath)
+
+		// The file_system storage keeps its lock files next to the data
+		if strings.HasPrefix(key, FILE_SYSTEM_LOCKS_PREFIX) {
+			return nil
+		}
+
+		if !filter.matches(key) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		value, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, transferEntry{Key: key, Value: value, Modified: info.ModTime()})
+
+		return nil
+	})
+
+	return entries, err
+}
+
+func readEntriesFromTar(archivePath string, filter transferFilter) ([]transferEntry, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []transferEntry{}
+	tr := tar.NewReader(f)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading archive: %v", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || !filter.matches(hdr.Name) {
+			continue
+		}
+
+		value, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive: %v", err)
+		}
+
+		entries = append(entries, transferEntry{Key: hdr.Name, Value: value, Modified: hdr.ModTime})
+	}
+
+	return entries, nil
+}
+
+func writeEntriesToDir(dir string, entries []transferEntry) error {
+	for _, entry := range entries {
+		// Refuse keys escaping the target directory
+		if !filepath.IsLocal(filepath.FromSlash(entry.Key)) {
+			return fmt.Errorf("refusing to export key '%s' outside of the target directory", entry.Key)
+		}
+
+		filePath := filepath.Join(dir, filepath.FromSlash(entry.Key))
+
+		// Same permissions as the file_system storage uses
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filePath, entry.Value, 0o600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(filePath, entry.Modified, entry.Modified); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeEntriesToTar(archivePath string, entries []transferEntry) error {
+	f, err := os.OpenFile(archivePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name: entry.Key,
+			Mode: 0o600,
+			Size: int64(len(entry.Value)),
+			// The tar writer would round to the nearest second otherwise
+			ModTime: entry.Modified.Truncate(time.Second),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing archive: %v", err)
+		}
+		if _, err := io.Copy(tw, bytes.NewReader(entry.Value)); err != nil {
+			return fmt.Errorf("writing archive: %v", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing archive: %v", err)
+	}
+
+	return f.Close()
+}
+
+// issueLockNames returns the certmagic issuance lock of each certificate
+// directory (certificates/<issuer>/<domain>) among the entries. Certmagic locks
+// the name it manages, while the directory is only its storage-safe form, e.g.
+// `wildcard_.example.com` for `*.example.com`. The name is therefore taken from
+// the SANs of the certificate or its metadata, which turn into the directory.
+func issueLockNames(entries []transferEntry) map[string]string {
+	lockNames := map[string]string{}
+
+	for _, entry := range entries {
+		dir, safeName, ok := certificateDir(entry.Key)
+		if !ok {
+			continue
+		}
+
+		for _, name := range certificateNames(entry) {
+			if certmagic.StorageKeys.Safe(name) == safeName {
+				lockNames[dir] = fmt.Sprintf("%s_%s", CERTMAGIC_ISSUE_LOCK_OP, name)
+				break
+			}
+		}
+	}
+
+	return lockNames
+}
+
+// certificateDir returns the directory and the storage-safe name of the domain,
+// if the key belongs to a certificate (certificates/<issuer>/<domain>/<file>).
+func certificateDir(key string) (string, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || parts[0] != CERTMAGIC_CERTIFICATES_PREFIX {
+		return "", "", false
+	}
+
+	return path.Join(parts[:3]...), parts[2], true
+}
+
+// certificateNames returns the SANs of a certificate or of its metadata. Other
+// entries, like the private key, have none.
+func certificateNames(entry transferEntry) []string {
+	switch path.Ext(entry.Key) {
+	case ".crt":
+		block, _ := pem.Decode(entry.Value)
+		if block == nil {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+
+		names := slices.Clone(cert.DNSNames)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+
+		return append(names, cert.EmailAddresses...)
+	case ".json":
+		var resource certmagic.CertificateResource
+		if err := json.Unmarshal(entry.Value, &resource); err != nil {
+			return nil
+		}
+
+		return resource.SANs
+	}
+
+	return nil
+}
+
+// lockWhenFree acquires the lock, waiting up to the given duration while another
+// instance holds it, e.g. while a Caddy instance cleans the storage. Zero waits
+// until the context ends.
+func lockWhenFree(ctx context.Context, storage *CaddyStorageValkey, lockName string, wait time.Duration) error {
+	// The lock is bound to the given context, so the timeout is not applied to it
+	deadline := time.Now().Add(wait)
+
+	waiting := false
+	for {
+		err := storage.Lock(ctx, lockName)
+		if !errors.Is(err, valkeylock.ErrNotLocked) {
+			return err
+		}
+
+		if wait > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("still held by another instance after %s", wait)
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "waiting for the %s lock held by another instance\n", lockName)
+			waiting = true
+		}
+
+		select {
+		case <-time.After(IMPORT_LOCK_RETRY_INTERVAL):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// importEntries imports and verifies the entries. Every entry is read back while
+// its locks are still held, so live instances can not change it in between.
+func importEntries(ctx context.Context, storage *CaddyStorageValkey, entries []transferEntry, lockWait time.Duration) error {
+	// Hold the global locks for the whole import
+	for _, lockName := range []string{IMPORT_LOCK_NAME, CERTMAGIC_CLEAN_LOCK_NAME} {
+		if err := lockWhenFree(ctx, storage, lockName, lockWait); err != nil {
+			return fmt.Errorf("unable to acquire %s lock: %v", lockName, err)
+		}
+		defer storage.Unlock(ctx, lockName)
+	}
+
+	lockNames := issueLockNames(entries)
+	for _, entry := range entries {
+		if err := importEntry(ctx, storage, entry, lockNames, lockWait); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func importEntry(ctx context.Context, storage *CaddyStorageValkey, entry transferEntry, lockNames map[string]string, lockWait time.Duration) error {
+	// Avoid racing with a live instance issuing the same certificate. Without the
+	// certificate or its metadata, the directory is the best guess of the name.
+	if dir, safeName, ok := certificateDir(entry.Key); ok {
+		lockName, found := lockNames[dir]
+		if !found {
+			lockName = fmt.Sprintf("%s_%s", CERTMAGIC_ISSUE_LOCK_OP, safeName)
+		}
+
+		if err := lockWhenFree(ctx, storage, lockName, lockWait); err != nil {
+			return fmt.Errorf("unable to acquire %s lock: %v", lockName, err)
+		}
+		defer storage.Unlock(ctx, lockName)
+	}
+
+	if err := storage.StoreWithModified(ctx, entry.Key, entry.Value, entry.Modified); err != nil {
+		return fmt.Errorf("%s: %w", entry.Key, err)
+	}
+
+	// Read the imported entry back for verification
+	imported, err := readEntryFromStorage(ctx, storage, entry.Key)
+	if err != nil {
+		return err
+	}
+
+	return verifyEntries([]transferEntry{entry}, []transferEntry{imported})
+}
+
+func printTransferEntries(entries []transferEntry) {
+	for _, entry := range entries {
+		fmt.Printf("%s\t%d\t%s\n", entry.Key, len(entry.Value), entry.Modified.Format(time.RFC3339))
+	}
+}
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	target := fl.String("to")
+	if target == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--to is required")
+	}
+
+	filter, err := newTransferFilter(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	entries, err := readEntriesFromStorage(context.Background(), storage, filter)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	if fl.Bool("dry-run") {
+		printTransferEntries(entries)
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	// Write the entries and read them back for verification
+	var exported []transferEntry
+	if isTarPath(target) {
+		if err := writeEntriesToTar(target, entries); err != nil {
+			return caddy.ExitCodeFailedQuit, err
+		}
+		exported, err = readEntriesFromTar(target, filter)
+	} else {
+		if err := writeEntriesToDir(target, entries); err != nil {
+			return caddy.ExitCodeFailedQuit, err
+		}
+		exported, err = readEntriesFromDir(target, filter)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	if err := verifyEntries(entries, exported); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	fmt.Printf("exported and verified %d keys to %s\n", len(entries), target)
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	source := fl.String("from")
+	if source == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--from is required")
+	}
+
+	filter, err := newTransferFilter(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var entries []transferEntry
+	if isTarPath(source) {
+		entries, err = readEntriesFromTar(source, filter)
+	} else {
+		entries, err = readEntriesFromDir(source, filter)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	// Keys from a directory are always valid, but an archive could contain anything
+	for _, entry := range entries {
+		if path.Clean(entry.Key) != entry.Key || strings.HasPrefix(entry.Key, "/") {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid key '%s' in import", entry.Key)
+		}
+	}
+
+	if fl.Bool("dry-run") {
+		printTransferEntries(entries)
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	storage, cancel, err := loadStorageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if err := importEntries(context.Background(), storage, entries, fl.Duration("lock-wait")); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	fmt.Printf("imported and verified %d keys from %s\n", len(entries), source)
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,171 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestIssueLockNamesUseCertificateNames(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	_, wildcardCert, wildcardKey := ca.issue(t, "*.example.com", []string{"*.example.com"}, nil)
+	_, ipCert, _ := ca.issue(t, "10.0.0.1", nil, []net.IP{net.ParseIP("10.0.0.1")})
+
+	metadata, err := json.Marshal(certmagic.CertificateResource{SANs: []string{"Example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []transferEntry{
+		{Key: "certificates/acme/wildcard_.example.com/wildcard_.example.com.crt", Value: wildcardCert},
+		{Key: "certificates/acme/wildcard_.example.com/wildcard_.example.com.key", Value: wildcardKey},
+		{Key: "certificates/acme/example.org/example.org.json", Value: metadata},
+		{Key: "certificates/acme/10.0.0.1/10.0.0.1.crt", Value: ipCert},
+		{Key: "certificates/acme/example.net/example.net.key", Value: []byte("key")},
+		{Key: "acme/account.json", Value: []byte("{}")},
+	}
+
+	// Only the certificate or its metadata know the name locked by certmagic
+	expected := map[string]string{
+		"certificates/acme/wildcard_.example.com": "issue_cert_*.example.com",
+		"certificates/acme/example.org":           "issue_cert_Example.org",
+		"certificates/acme/10.0.0.1":              "issue_cert_10.0.0.1",
+	}
+	if lockNames := issueLockNames(entries); !maps.Equal(lockNames, expected) {
+		t.Fatalf("expected lock names %v, got %v", expected, lockNames)
+	}
+}
+
+// lockedNames returns the names of the locks acquired at the server.
+func lockedNames(f *fakeValkey) []string {
+	var names []string
+	for _, args := range f.received("EVAL") {
+		for _, arg := range args {
+			// The locker keeps each lock as <prefix>:<index>:<name>
+			if key, found := strings.CutPrefix(arg, LOCKER_PREFIX+":"); found {
+				_, name, _ := strings.Cut(key, ":")
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+func TestImportWaitsForHeldLocks(t *testing.T) {
+	server := newFakeValkey(t)
+	instance := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	importer := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	ctx := context.Background()
+
+	ca := newTestCA(t, "ca")
+	_, cert, _ := ca.issue(t, "*.example.com", []string{"*.example.com"}, nil)
+	entries := []transferEntry{
+		{Key: "certificates/acme/wildcard_.example.com/wildcard_.example.com.crt", Value: cert, Modified: time.Now()},
+	}
+
+	// A Caddy instance cleaning the storage
+	if err := instance.Lock(ctx, CERTMAGIC_CLEAN_LOCK_NAME); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- importEntries(ctx, importer, entries, DEFAULT_IMPORT_LOCK_WAIT_TIMEOUT)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected import to wait for the lock, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(server.received("HMSET")) != 0 {
+		t.Fatal("expected nothing to be imported while the lock is held")
+	}
+
+	if err := instance.Unlock(ctx, CERTMAGIC_CLEAN_LOCK_NAME); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected import to continue once the lock is released")
+	}
+
+	if len(server.received("HMSET")) != 1 {
+		t.Fatal("expected entry to be imported")
+	}
+	if !slices.Contains(lockedNames(server), "issue_cert_*.example.com") {
+		t.Fatalf("expected issuance lock of the certificate name, got locks %v", lockedNames(server))
+	}
+}
+
+func TestImportGivesUpAfterLockWait(t *testing.T) {
+	server := newFakeValkey(t)
+	instance := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	importer := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+	ctx := context.Background()
+
+	if err := instance.Lock(ctx, CERTMAGIC_CLEAN_LOCK_NAME); err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Unlock(ctx, CERTMAGIC_CLEAN_LOCK_NAME)
+
+	entries := []transferEntry{{Key: "acme/account.json", Value: []byte("{}"), Modified: time.Now()}}
+	err := importEntries(ctx, importer, entries, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "still held by another instance after 100ms") {
+		t.Fatalf("expected the import to give up waiting for the lock, got %v", err)
+	}
+	if len(server.received("HMSET")) != 0 {
+		t.Fatal("expected nothing to be imported")
+	}
+}
+
+func TestImportVerifiesWhileLocksAreHeld(t *testing.T) {
+	server := newFakeValkey(t)
+	importer := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+
+	ca := newTestCA(t, "ca")
+	_, cert, _ := ca.issue(t, "example.com", []string{"example.com"}, nil)
+	entry := transferEntry{Key: "certificates/acme/example.com/example.com.crt", Value: cert, Modified: time.Now()}
+
+	if err := importEntries(context.Background(), importer, []transferEntry{entry}, DEFAULT_IMPORT_LOCK_WAIT_TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	// The entry is read back before the first lock is released
+	lastRead, firstRelease := -1, -1
+	for i, args := range server.commands {
+		switch strings.ToUpper(args[0]) {
+		case "HGET", "HMGET":
+			if strings.HasSuffix(args[1], entry.Key) {
+				lastRead = i
+			}
+		case "EVAL":
+			if firstRelease == -1 && strings.Contains(args[1], `"DEL"`) {
+				firstRelease = i
+			}
+		}
+	}
+
+	if lastRead == -1 || firstRelease == -1 {
+		t.Fatalf("expected the entry to be read back and the locks to be released, got commands %v", server.commands)
+	}
+	if lastRead > firstRelease {
+		t.Fatal("expected the imported entry to be verified while the locks are held")
+	}
+}
@@ -0,0 +1,248 @@
+package caddystoragevalkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// The canary entry is stored below this storage key, followed by a random name
+	VERIFY_CANARY_PREFIX = "valkey_storage_verify"
+
+	VERIFY_TIMEOUT = 30 * time.Second
+)
+
+// VerificationError lists everything found missing while verifying the storage.
+type VerificationError struct {
+	Problems []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("verifying the storage failed: %s", strings.Join(e.Problems, "; "))
+}
+
+// Verify checks that the storage is usable before any certificate depends on
+// it. Every command needed by the storage is checked with `ACL DRYRUN` where
+// the server and the user allow it, then a canary entry is stored, loaded,
+// listed and deleted and a canary lock is acquired and released. All problems
+// found are returned together as VerificationError.
+func (c *CaddyStorageValkey) Verify(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, VERIFY_TIMEOUT)
+	defer cancel()
+
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err != nil {
+		return err
+	}
+	canaryKey := VERIFY_CANARY_PREFIX + "/" + hex.EncodeToString(name)
+
+	problems := c.verifyPermissions(ctx, canaryKey)
+	problems = append(problems, c.verifyRoundTrip(ctx, canaryKey)...)
+
+	if len(problems) > 0 {
+		return &VerificationError{Problems: problems}
+	}
+
+	c.logger.Info("verified storage", zap.String("canary_key", canaryKey))
+
+	return nil
+}
+
+// verifyPermissions checks all commands of the storage with `ACL DRYRUN`, which
+// is skipped on servers without ACLs or when the user may not run it.
+func (c *CaddyStorageValkey) verifyPermissions(ctx context.Context, canaryKey string) []string {
+	username, err := c.client.Do(ctx, c.client.B().AclWhoami().Build()).ToString()
+	if err != nil {
+		c.logger.Warn("permissions of the storage can not be checked", zap.Error(err))
+		return nil
+	}
+
+	problems := []string{}
+	for _, command := range c.requiredCommands(canaryKey) {
+		result, err := c.client.Do(ctx, c.client.B().AclDryrun().Username(username).Command(command[0]).Arg(command[1:]...).Build()).ToString()
+
+		if isDryrunUnavailable(err) {
+			c.logger.Warn("permissions of the storage can not be checked", zap.String("username", username), zap.Error(err))
+			return nil
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("checking permission for `%s` failed: %v", command[0], err))
+			continue
+		}
+
+		// Denied commands are reported as regular reply with the reason
+		if result != "OK" {
+			problems = append(problems, fmt.Sprintf("user '%s' may not run `%s`: %s", username, command[0], result))
+		}
+	}
+
+	return problems
+}
+
+// isDryrunUnavailable reports whether the server does not know `ACL DRYRUN` or
+// the user may not run it.
+func isDryrunUnavailable(err error) bool {
+	var valkeyErr *valkey.ValkeyError
+	if !errors.As(err, &valkeyErr) {
+		return false
+	}
+
+	message := strings.ToLower(valkeyErr.Error())
+
+	return strings.HasPrefix(message, "noperm") || strings.Contains(message, "unknown subcommand")
+}
+
+// requiredCommands returns the commands sent by the storage for the canary key,
+// with the arguments needed to check the permissions for the keys as well.
+func (c *CaddyStorageValkey) requiredCommands(canaryKey string) [][]string {
+	key := c.layout.Key(canaryKey)
+	lockKey := fmt.Sprintf("%s:0:%s", LOCKER_PREFIX, canaryKey)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	commands := [][]string{
+		{"PING"},
+		{"EXISTS", key},
+		{"SCAN", "0", "MATCH", c.layout.Key(VERIFY_CANARY_PREFIX) + "*", "COUNT", strconv.Itoa(SCAN_COUNT), "TYPE", c.layout.ScanType()},
+
+		// The locker runs scripts, where only the command and the key are checked,
+		// so the commands of the scripts are checked on their own
+		{"EVALSHA", strings.Repeat("0", 40), "1", lockKey, "value", now},
+		{"EVAL", "return 0", "1", lockKey, "value", now},
+		{"SET", lockKey, "value", "NX", "PXAT", now},
+		{"GET", lockKey},
+		{"PEXPIREAT", lockKey, now},
+		{"DEL", lockKey},
+	}
+
+	// The shared client only tracks the lock keys
+	if c.sharedClient {
+		commands = append(commands, []string{"CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", LOCKER_PREFIX + ":", "NOLOOP"})
+	} else {
+		commands = append(commands, []string{"CLIENT", "TRACKING", "ON", "OPTOUT", "NOLOOP"})
+	}
+
+	readOnly := c.layout.ReadOnly()
+	layout := c.layout
+	if l, ok := layout.(readOnlyLayout); ok {
+		layout = l.StorageLayout
+	}
+
+	switch layout.(type) {
+	case hashLayout:
+		commands = append(commands,
+			[]string{"HGET", key, ENTRY_KEY_VALUE},
+			[]string{"HMGET", key, ENTRY_KEY_VALUE, ENTRY_KEY_LASTMODIFIED, ENTRY_KEY_SIZE},
+			[]string{"GET", c.schemaVersionKey()},
+		)
+		if !readOnly {
+			commands = append(commands,
+				[]string{"HMSET", key, ENTRY_KEY_VALUE, "value", ENTRY_KEY_LASTMODIFIED, now, ENTRY_KEY_SIZE, "5"},
+				[]string{"SET", c.schemaVersionKey(), strconv.Itoa(SCHEMA_VERSION), "NX"},
+			)
+		}
+	case tlsredisLayout, redisLayout:
+		commands = append(commands, []string{"GET", key})
+		if !readOnly {
+			commands = append(commands, []string{"SET", key, "value"})
+		}
+	}
+
+	if !readOnly {
+		commands = append(commands, []string{"DEL", key})
+	}
+
+	return commands
+}
+
+// verifyRoundTrip runs the operations of the storage with a canary entry and a
+// canary lock. With a read-only layout, the canary entry is only looked up.
+func (c *CaddyStorageValkey) verifyRoundTrip(ctx context.Context, canaryKey string) []string {
+	// The canary is neither mirrored nor looked up in the storage migrated from,
+	// and it is read from the primary, as replicas may not have received it yet
+	canary := *c
+	canary.mirror = nil
+	canary.migrateFrom = nil
+	canary.replicaOperations = nil
+
+	problems := []string{}
+	report := func(operation string, err error) {
+		problems = append(problems, fmt.Sprintf("%s of canary key '%s' failed: %v", operation, canaryKey, err))
+	}
+
+	if _, err := canary.List(ctx, VERIFY_CANARY_PREFIX, true); err != nil {
+		report(OPERATION_LIST, err)
+	}
+
+	if c.layout.ReadOnly() {
+		if _, err := canary.Load(ctx, canaryKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			report(OPERATION_LOAD, err)
+		}
+		if _, err := canary.Stat(ctx, canaryKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			report(OPERATION_STAT, err)
+		}
+	} else if err := canary.verifyCanaryEntry(ctx, canaryKey); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if err := canary.Lock(ctx, canaryKey); err != nil {
+		report(OPERATION_LOCK, err)
+	} else if err := canary.Unlock(ctx, canaryKey); err != nil {
+		report(OPERATION_UNLOCK, err)
+	}
+
+	return problems
+}
+
+// verifyCanaryEntry stores the canary entry and checks it can be read back,
+// before deleting it again. The first failing operation is returned.
+func (c *CaddyStorageValkey) verifyCanaryEntry(ctx context.Context, canaryKey string) (err error) {
+	value := []byte(canaryKey)
+	failed := func(operation string, err error) error {
+		return fmt.Errorf("%s of canary key '%s' failed: %v", operation, canaryKey, err)
+	}
+
+	if err := c.Store(ctx, canaryKey, value); err != nil {
+		return failed(OPERATION_STORE, err)
+	}
+
+	// Do not leave the canary behind, even when reading it failed
+	defer func() {
+		if deleteErr := c.Delete(ctx, canaryKey); deleteErr != nil && err == nil {
+			err = failed(OPERATION_DELETE, deleteErr)
+		}
+	}()
+
+	loaded, err := c.Load(ctx, canaryKey)
+	if err != nil {
+		return failed(OPERATION_LOAD, err)
+	} else if !bytes.Equal(loaded, value) {
+		return failed(OPERATION_LOAD, errors.New("loaded value differs from stored value"))
+	}
+
+	info, err := c.Stat(ctx, canaryKey)
+	if err != nil {
+		return failed(OPERATION_STAT, err)
+	} else if info.Size != int64(len(value)) {
+		return failed(OPERATION_STAT, fmt.Errorf("size %d differs from stored size %d", info.Size, len(value)))
+	}
+
+	keys, err := c.List(ctx, VERIFY_CANARY_PREFIX, true)
+	if err != nil {
+		return failed(OPERATION_LIST, err)
+	} else if !slices.Contains(keys, canaryKey) {
+		return failed(OPERATION_LIST, errors.New("stored key is not listed"))
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package caddystoragevalkey
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// aclFakeValkey answers `ACL DRYRUN` like a server where the user may not run
+// the denied commands, which also fail when they are run.
+func aclFakeValkey(t *testing.T, denied ...string) *fakeValkey {
+	f := newFakeValkey(t)
+	f.handle = func(args []string) (string, bool) {
+		command := strings.ToUpper(args[0])
+
+		if command == "ACL" && strings.EqualFold(args[1], "WHOAMI") {
+			return respBulk("caddy"), true
+		}
+		if command == "ACL" && strings.EqualFold(args[1], "DRYRUN") {
+			if slices.Contains(denied, strings.ToUpper(args[3])) {
+				return respBulk("User caddy has no permissions to run the '" + strings.ToLower(args[3]) + "' command"), true
+			}
+			return respOk, true
+		}
+		if slices.Contains(denied, command) {
+			return "-NOPERM User caddy has no permissions to run the '" + strings.ToLower(command) + "' command\r\n", true
+		}
+
+		return "", false
+	}
+
+	return f
+}
+
+// dryrunCommands returns the commands checked with `ACL DRYRUN`.
+func dryrunCommands(f *fakeValkey) []string {
+	var commands []string
+	for _, args := range f.received("ACL") {
+		if strings.EqualFold(args[1], "DRYRUN") {
+			commands = append(commands, args[3])
+		}
+	}
+
+	return commands
+}
+
+func TestVerifyReportsDeniedCommands(t *testing.T) {
+	server := aclFakeValkey(t, "HMSET")
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+
+	err := storage.Verify(context.Background())
+
+	var verificationErr *VerificationError
+	if !errors.As(err, &verificationErr) {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+	if len(verificationErr.Problems) != 2 {
+		t.Fatalf("expected the denied permission and the failed store, got %v", verificationErr.Problems)
+	}
+	if !strings.Contains(verificationErr.Problems[0], "user 'caddy' may not run `HMSET`: User caddy has no permissions to run the 'hmset' command") {
+		t.Fatalf("expected the denied command to be reported, got %q", verificationErr.Problems[0])
+	}
+	if !strings.Contains(verificationErr.Problems[1], "store of canary key '"+VERIFY_CANARY_PREFIX+"/") || !strings.Contains(verificationErr.Problems[1], "NOPERM") {
+		t.Fatalf("expected the failed store to be reported, got %q", verificationErr.Problems[1])
+	}
+
+	// Every command the storage sends is checked
+	expected := []string{}
+	for _, command := range storage.requiredCommands(VERIFY_CANARY_PREFIX + "/canary") {
+		expected = append(expected, command[0])
+	}
+	if checked := dryrunCommands(server); !slices.Equal(checked, expected) {
+		t.Fatalf("expected the commands %v to be checked, got %v", expected, checked)
+	}
+
+	// The lock is checked even after the store failed
+	if !slices.ContainsFunc(lockedNames(server), func(name string) bool { return strings.HasPrefix(name, VERIFY_CANARY_PREFIX+"/") }) {
+		t.Fatalf("expected the canary lock to be acquired, got locks %v", lockedNames(server))
+	}
+}
+
+func TestVerifyWithoutDryrun(t *testing.T) {
+	server := newFakeValkey(t)
+	server.handle = func(args []string) (string, bool) {
+		if strings.EqualFold(args[0], "ACL") && strings.EqualFold(args[1], "DRYRUN") {
+			return "-ERR unknown subcommand 'DRYRUN'. Try ACL HELP.\r\n", true
+		}
+		return "", false
+	}
+	storage := newTestStorage(t, server, CaddyStorageValkeyOptions{})
+
+	if err := storage.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first command is checked before giving up on the permissions
+	if checked := dryrunCommands(server); len(checked) != 1 {
+		t.Fatalf("expected the permission check to be skipped, got %v", checked)
+	}
+
+	// The canary entry and lock are not left behind
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.hashes) != 0 || slices.ContainsFunc(slices.Collect(maps.Keys(server.strings)), func(key string) bool { return strings.HasPrefix(key, LOCKER_PREFIX) }) {
+		t.Fatalf("expected the canary to be removed, got hashes %v and strings %v", server.hashes, server.strings)
+	}
+}
+
+func TestVerifyOnStartFailsProvision(t *testing.T) {
+	server := aclFakeValkey(t, "HMSET", "SCAN")
+
+	m := StorageValkeyModule{
+		InitAddress:   []string{server.address},
+		VerifyOnStart: true,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	err := m.Provision(ctx)
+	t.Cleanup(func() { m.Cleanup() })
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+
+	for _, problem := range []string{"verifying the storage failed", "may not run `SCAN`", "may not run `HMSET`", "list of canary key", "store of canary key"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to be reported, got %v", problem, err)
+		}
+	}
+}